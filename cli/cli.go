@@ -0,0 +1,684 @@
+// Package cli implements the local-proxy command line interface. Rule changes
+// and pause/resume go through the control socket of a running instance when
+// there is one; everything else operates directly on the SQLite database.
+package cli
+
+import (
+	"bufio"
+	"changeme/control_service"
+	"changeme/db_service"
+	"changeme/logging_service"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// tailInterval is how often `tail` polls for new requests
+const tailInterval = time.Second
+
+// errUsage is returned for invalid invocations after usage has been printed
+var errUsage = errors.New("invalid usage")
+
+// errInstanceUnreachable is returned for rule changes while a running
+// instance holds the data directory but its control socket is unavailable
+var errInstanceUnreachable = errors.New("local-proxy is running but its control socket is unavailable; change rules in the app or restart it")
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(e *env, args []string) error
+}
+
+// env carries the output streams and lazily opened services for a command
+type env struct {
+	stdout  io.Writer
+	stderr  io.Writer
+	dataDir string
+	json    bool
+	opts    Options
+
+	db      *db_service.DatabaseService
+	logging *logging_service.LoggingService
+}
+
+// Instance is a running local-proxy the CLI can control. It is implemented
+// by control_service.Client (over the socket) and control_service.ControlService
+// (in-process).
+type Instance interface {
+	Pause() (*control_service.Status, error)
+	Resume() (*control_service.Status, error)
+	SaveRule(rule control_service.RuleRequest) error
+	DeleteRule(domain string) error
+}
+
+// Options customise how commands are executed
+type Options struct {
+	// WorkingDir resolves relative file arguments (defaults to the process working directory).
+	WorkingDir string
+	// Instance is used instead of dialing the control socket when set.
+	Instance Instance
+}
+
+// rules is the subset of rule operations shared by the database and a running instance
+type rules interface {
+	save(rule db_service.BlockedDomainInfo) error
+	unblock(pattern string) error
+}
+
+type dbRules struct{ db *db_service.DatabaseService }
+
+func (r dbRules) save(rule db_service.BlockedDomainInfo) error {
+	if !r.db.SaveRule(rule) {
+		return fmt.Errorf("failed to block %q", rule.Domain)
+	}
+	return nil
+}
+
+func (r dbRules) unblock(pattern string) error {
+	if !r.db.UnblockDomain(pattern) {
+		return fmt.Errorf("failed to unblock %q", pattern)
+	}
+	return nil
+}
+
+type instanceRules struct{ instance Instance }
+
+func (r instanceRules) save(rule db_service.BlockedDomainInfo) error {
+	return r.instance.SaveRule(control_service.RuleRequest{
+		Domain:     rule.Domain,
+		FilterType: rule.FilterType,
+		App:        rule.App,
+		Action:     rule.Action,
+		Ports:      rule.Ports,
+	})
+}
+
+func (r instanceRules) unblock(pattern string) error {
+	return r.instance.DeleteRule(pattern)
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"block", "[-type exact|glob|regex|ip|cidr] [-ports list] [-log-only] <pattern>...", "block one or more domains", runBlock},
+		{"unblock", "<pattern>...", "remove blocking rules", runUnblock},
+		{"list", "", "list blocking rules", runList},
+		{"import", "[-log-only] <file|->", "import rules (one per line, or a JSON export)", runImport},
+		{"export", "[file]", "export rules (block rules only, unless -json)", runExport},
+		{"stats", "[-range 1h|6h|24h|7d|30d]", "show request statistics", runStats},
+		{"tail", "[-n count] [-f]", "show recent requests, optionally following new ones", runTail},
+		{"requests", "[-host s] [-decision d] [-method m] [-port n] [-rule r] [-since 24h] [-sort col] [-asc] [-n count] [-cursor c]", "search the request history", runRequests},
+		{"pause", "", "pause the running proxy", runPause},
+		{"resume", "", "resume the running proxy", runResume},
+	}
+}
+
+// IsCommandLine reports whether args (without the program name) invoke a CLI
+// subcommand, skipping any leading global flags.
+func IsCommandLine(args []string) bool {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-json" || arg == "--json":
+			continue
+		case arg == "-data-dir" || arg == "--data-dir":
+			i++
+			continue
+		case strings.HasPrefix(arg, "-data-dir=") || strings.HasPrefix(arg, "--data-dir="):
+			continue
+		}
+		for _, c := range commands {
+			if c.name == arg {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// Run executes the subcommand in args and returns the process exit code.
+// Global flags (-json, -data-dir) may appear before or after the subcommand.
+func Run(args []string, stdout, stderr io.Writer) int {
+	return RunWithOptions(args, stdout, stderr, Options{})
+}
+
+// RunWithOptions is like Run but lets the caller supply the working directory
+// and an already running instance.
+func RunWithOptions(args []string, stdout, stderr io.Writer, opts Options) int {
+	e := &env{stdout: stdout, stderr: stderr, dataDir: db_service.DataDir(), opts: opts}
+	defer e.close()
+
+	global := flag.NewFlagSet("local-proxy", flag.ContinueOnError)
+	global.SetOutput(stderr)
+	global.BoolVar(&e.json, "json", false, "print JSON instead of a table")
+	global.StringVar(&e.dataDir, "data-dir", e.dataDir, "directory containing local-proxy.db")
+	global.Usage = func() { e.usage() }
+	if err := global.Parse(args); err != nil {
+		return 2
+	}
+	if global.NArg() == 0 {
+		e.usage()
+		return 2
+	}
+
+	name := global.Arg(0)
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+		if err := c.run(e, global.Args()[1:]); err != nil {
+			if errors.Is(err, errUsage) {
+				fmt.Fprintf(stderr, "usage: local-proxy %s %s\n", c.name, c.args)
+				return 2
+			}
+			fmt.Fprintf(stderr, "local-proxy %s: %v\n", name, err)
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintf(stderr, "unknown command %q\n", name)
+	e.usage()
+	return 2
+}
+
+func (e *env) usage() {
+	fmt.Fprintln(e.stderr, "usage: local-proxy [-json] [-data-dir dir] <command> [args]")
+	fmt.Fprintln(e.stderr, "\ncommands:")
+	w := tabwriter.NewWriter(e.stderr, 0, 4, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %s %s\t%s\n", c.name, c.args, c.summary)
+	}
+	_ = w.Flush()
+}
+
+// database opens the rules database on first use
+func (e *env) database() (*db_service.DatabaseService, error) {
+	if e.db == nil {
+		db, err := db_service.NewDBService(e.dataDir)
+		if err != nil {
+			return nil, err
+		}
+		e.db = db
+	}
+	return e.db, nil
+}
+
+// instance returns the running instance to control, dialing the socket if needed
+func (e *env) instance() (Instance, error) {
+	if e.opts.Instance != nil {
+		return e.opts.Instance, nil
+	}
+	client, err := control_service.Dial(e.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// path resolves a file argument against the configured working directory
+func (e *env) path(name string) string {
+	if e.opts.WorkingDir == "" || filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(e.opts.WorkingDir, name)
+}
+
+// ruleStore prefers the running instance so it picks up rule changes
+// immediately, and falls back to the database otherwise. A running instance
+// that cannot be reached would not see changes made to the database, so
+// rules are left alone then.
+func (e *env) ruleStore() (rules, error) {
+	if instance, err := e.instance(); err == nil {
+		return instanceRules{instance}, nil
+	}
+	if control_service.InstanceRunning(e.dataDir) {
+		return nil, errInstanceUnreachable
+	}
+	db, err := e.database()
+	if err != nil {
+		return nil, err
+	}
+	return dbRules{db}, nil
+}
+
+// logs opens the request log on first use
+func (e *env) logs() (*logging_service.LoggingService, error) {
+	if e.logging == nil {
+		db, err := e.database()
+		if err != nil {
+			return nil, err
+		}
+		logging, err := logging_service.NewLoggingService(db)
+		if err != nil {
+			return nil, err
+		}
+		e.logging = logging
+	}
+	return e.logging, nil
+}
+
+func (e *env) close() {
+	if e.db != nil {
+		_ = e.db.ServiceShutdown()
+	}
+}
+
+// printJSON writes v as indented JSON
+func (e *env) printJSON(v any) error {
+	enc := json.NewEncoder(e.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// newFlags returns a flag set for a subcommand that reports errors via errUsage
+func (e *env) newFlags(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(e.stderr)
+	flags.BoolVar(&e.json, "json", e.json, "print JSON instead of a table")
+	return flags
+}
+
+func runBlock(e *env, args []string) error {
+	flags := e.newFlags("block")
+	filterType := flags.String("type", "exact", "filter type: exact, glob, regex, ip or cidr")
+	ports := flags.String("ports", "", "only block these ports and port ranges, e.g. 22,8000-8999")
+	logOnly := flags.Bool("log-only", false, "only log matching requests as would_reject")
+	if err := flags.Parse(args); err != nil || flags.NArg() == 0 {
+		return errUsage
+	}
+	switch *filterType {
+	case "exact", "glob", "regex", "ip", "cidr":
+	default:
+		return fmt.Errorf("unknown filter type %q", *filterType)
+	}
+	if _, err := db_service.ParsePorts(*ports); err != nil {
+		return err
+	}
+
+	store, err := e.ruleStore()
+	if err != nil {
+		return err
+	}
+	action, verb := db_service.ActionBlock, "blocked"
+	if *logOnly {
+		action, verb = db_service.ActionLog, "logging"
+	}
+	for _, pattern := range flags.Args() {
+		if err := store.save(db_service.BlockedDomainInfo{Domain: pattern, FilterType: *filterType, Action: action, Ports: *ports}); err != nil {
+			return err
+		}
+		fmt.Fprintf(e.stdout, "%s %s (%s)\n", verb, pattern, *filterType)
+	}
+	return nil
+}
+
+func runUnblock(e *env, args []string) error {
+	flags := e.newFlags("unblock")
+	if err := flags.Parse(args); err != nil || flags.NArg() == 0 {
+		return errUsage
+	}
+
+	store, err := e.ruleStore()
+	if err != nil {
+		return err
+	}
+	for _, pattern := range flags.Args() {
+		if err := store.unblock(pattern); err != nil {
+			return err
+		}
+		fmt.Fprintf(e.stdout, "unblocked %s\n", pattern)
+	}
+	return nil
+}
+
+func runList(e *env, args []string) error {
+	flags := e.newFlags("list")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+
+	db, err := e.database()
+	if err != nil {
+		return err
+	}
+	rules := db.ListBlockedDomainsWithInfo()
+	if e.json {
+		return e.printJSON(nonNil(rules))
+	}
+
+	w := tabwriter.NewWriter(e.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DOMAIN\tTYPE\tACTION\tPORTS\tCREATED")
+	for _, r := range rules {
+		ports := r.Ports
+		if ports == "" {
+			ports = "*"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.Domain, r.FilterType, r.Action, ports, r.CreatedAt)
+	}
+	return w.Flush()
+}
+
+func runImport(e *env, args []string) error {
+	flags := e.newFlags("import")
+	logOnly := flags.Bool("log-only", false, "import every rule as log-only, to see what the list would block")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return errUsage
+	}
+
+	var in io.Reader = os.Stdin
+	if name := flags.Arg(0); name != "-" {
+		f, err := os.Open(e.path(name))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	rules, err := parseRules(in)
+	if err != nil {
+		return err
+	}
+
+	store, err := e.ruleStore()
+	if err != nil {
+		return err
+	}
+	imported := 0
+	for _, r := range rules {
+		if *logOnly {
+			r.Action = db_service.ActionLog
+		}
+		if err := store.save(r); err == nil {
+			imported++
+		} else {
+			fmt.Fprintf(e.stderr, "skipping invalid rule %q (%s)\n", r.Domain, r.FilterType)
+		}
+	}
+	fmt.Fprintf(e.stdout, "imported %d of %d rules\n", imported, len(rules))
+	return nil
+}
+
+// parseRules reads either a JSON export or a plain list with one rule per
+// line. Plain lines are "<pattern>" or "<type> <pattern>"; '#' starts a comment.
+func parseRules(in io.Reader) ([]db_service.BlockedDomainInfo, error) {
+	reader := bufio.NewReader(in)
+	if first, err := reader.Peek(1); err == nil && first[0] == '[' {
+		var rules []db_service.BlockedDomainInfo
+		if err := json.NewDecoder(reader).Decode(&rules); err != nil {
+			return nil, fmt.Errorf("invalid JSON rules: %w", err)
+		}
+		for i := range rules {
+			if rules[i].FilterType == "" {
+				rules[i].FilterType = "exact"
+			}
+		}
+		return rules, nil
+	}
+
+	var rules []db_service.BlockedDomainInfo
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		rule := db_service.BlockedDomainInfo{FilterType: "exact", Domain: fields[0]}
+		if len(fields) > 1 {
+			rule.FilterType, rule.Domain = fields[0], strings.Join(fields[1:], " ")
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+func runExport(e *env, args []string) error {
+	flags := e.newFlags("export")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 1 {
+		return errUsage
+	}
+
+	db, err := e.database()
+	if err != nil {
+		return err
+	}
+	rules := db.ListBlockedDomainsWithInfo()
+	// The text format only holds global block rules; it would import the
+	// others as such, so refuse before writing anything
+	if !e.json {
+		for _, r := range rules {
+			if (r.Action != "" && r.Action != db_service.ActionBlock) || r.App != "" || r.Ports != "" || r.ExpiresAt != 0 {
+				return fmt.Errorf("rule %q has an action, app, ports or expiry the text format cannot hold; export with -json", r.Domain)
+			}
+		}
+	}
+
+	out := e.stdout
+	if flags.NArg() == 1 && flags.Arg(0) != "-" {
+		f, err := os.Create(e.path(flags.Arg(0)))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if e.json {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(nonNil(rules))
+	}
+	for _, r := range rules {
+		if _, err := fmt.Fprintf(out, "%s %s\n", r.FilterType, r.Domain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runStats(e *env, args []string) error {
+	flags := e.newFlags("stats")
+	timeRange := flags.String("range", "24h", "time range: 1h, 6h, 24h, 7d or 30d")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+
+	logs, err := e.logs()
+	if err != nil {
+		return err
+	}
+	data, err := logs.GetDashboardData(*timeRange)
+	if err != nil {
+		return err
+	}
+	if e.json {
+		data.Requests = nil
+		return e.printJSON(data)
+	}
+
+	w := tabwriter.NewWriter(e.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Range\t%s\n", data.TimeRange)
+	fmt.Fprintf(w, "Total requests\t%d\n", data.TotalRequests)
+	fmt.Fprintf(w, "Approved\t%d\n", data.ApprovedCount)
+	fmt.Fprintf(w, "Rejected\t%d\n", data.RejectedCount)
+	if data.WouldRejectCount > 0 {
+		fmt.Fprintf(w, "Would reject\t%d\n", data.WouldRejectCount)
+	}
+	return w.Flush()
+}
+
+func runTail(e *env, args []string) error {
+	flags := e.newFlags("tail")
+	count := flags.Int("n", 20, "number of recent requests to show")
+	follow := flags.Bool("f", false, "keep printing new requests as they are logged")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+
+	logs, err := e.logs()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(e.stdout, 0, 4, 2, ' ', 0)
+	if !e.json {
+		fmt.Fprintln(w, "TIME\tDECISION\tMETHOD\tHOST\tPORT")
+	}
+
+	var lastID int64
+	printRequests := func(requests []logging_service.RequestDetail) error {
+		for _, r := range requests {
+			lastID = r.ID
+			if e.json {
+				if err := json.NewEncoder(e.stdout).Encode(r); err != nil {
+					return err
+				}
+				continue
+			}
+			ts := time.UnixMilli(r.Timestamp).Format(time.DateTime)
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", ts, r.Decision, r.Method, r.Host, r.Port)
+		}
+		return w.Flush()
+	}
+
+	requests, err := logs.RequestsSince(0, *count)
+	if err != nil {
+		return err
+	}
+	if err := printRequests(requests); err != nil {
+		return err
+	}
+	if !*follow {
+		return nil
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	ticker := time.NewTicker(tailInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-interrupt:
+			return nil
+		case <-ticker.C:
+			requests, err := logs.RequestsSince(lastID, 500)
+			if err != nil {
+				return err
+			}
+			if err := printRequests(requests); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func runRequests(e *env, args []string) error {
+	flags := e.newFlags("requests")
+	var q logging_service.RequestQuery
+	flags.StringVar(&q.Host, "host", "", "only hosts containing this text")
+	flags.StringVar(&q.Decision, "decision", "", "approved, rejected or would_reject")
+	flags.StringVar(&q.Method, "method", "", "request method, e.g. CONNECT")
+	flags.IntVar(&q.Port, "port", 0, "destination port")
+	flags.StringVar(&q.Rule, "rule", "", "rule that matched the request")
+	since := flags.Duration("since", 0, "only requests newer than this, e.g. 24h")
+	flags.StringVar(&q.SortBy, "sort", "timestamp", "sort by timestamp, host, port or duration")
+	flags.BoolVar(&q.Ascending, "asc", false, "sort in ascending order")
+	flags.IntVar(&q.Limit, "n", 50, "number of requests per page")
+	flags.StringVar(&q.Cursor, "cursor", "", "continue after a previous page")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+	if *since > 0 {
+		q.Start = time.Now().Add(-*since).UnixMilli()
+	}
+
+	logs, err := e.logs()
+	if err != nil {
+		return err
+	}
+	page, err := logs.QueryRequests(q)
+	if err != nil {
+		return err
+	}
+	if e.json {
+		return e.printJSON(page)
+	}
+
+	w := tabwriter.NewWriter(e.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tDECISION\tMETHOD\tHOST\tPORT")
+	for _, r := range page.Requests {
+		ts := time.UnixMilli(r.Timestamp).Format(time.DateTime)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", ts, r.Decision, r.Method, r.Host, r.Port)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(e.stdout, "%d of %d matching requests\n", len(page.Requests), page.Total)
+	if page.NextCursor != "" {
+		fmt.Fprintf(e.stdout, "next page: -cursor %s\n", page.NextCursor)
+	}
+	return nil
+}
+
+func runPause(e *env, args []string) error {
+	return e.setPaused(args, true)
+}
+
+func runResume(e *env, args []string) error {
+	return e.setPaused(args, false)
+}
+
+// setPaused pauses or resumes the running instance over the control socket
+func (e *env) setPaused(args []string, paused bool) error {
+	flags := e.newFlags("pause")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+
+	instance, err := e.instance()
+	if err != nil {
+		return err
+	}
+	var status *control_service.Status
+	if paused {
+		status, err = instance.Pause()
+	} else {
+		status, err = instance.Resume()
+	}
+	if err != nil {
+		return err
+	}
+
+	if e.json {
+		return e.printJSON(status)
+	}
+	if status.Paused {
+		fmt.Fprintln(e.stdout, "proxy paused")
+	} else {
+		fmt.Fprintln(e.stdout, "proxy resumed")
+	}
+	return nil
+}
+
+// nonNil makes sure empty lists are printed as [] rather than null
+func nonNil[T any](items []T) []T {
+	if items == nil {
+		return []T{}
+	}
+	return items
+}
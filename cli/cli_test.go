@@ -0,0 +1,275 @@
+package cli
+
+import (
+	"bytes"
+	"changeme/control_service"
+	"changeme/db_service"
+	"changeme/logging_service"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRun_BlockListUnblock(t *testing.T) {
+	dataDir := t.TempDir()
+
+	if out, code := runCLI(t, dataDir, "block", "example.com", "test.org"); code != 0 {
+		t.Fatalf("block failed with code %d: %s", code, out)
+	}
+	if out, code := runCLI(t, dataDir, "block", "-type", "glob", "*.ads.com"); code != 0 {
+		t.Fatalf("glob block failed with code %d: %s", code, out)
+	}
+
+	out, code := runCLI(t, dataDir, "-json", "list")
+	if code != 0 {
+		t.Fatalf("list failed with code %d: %s", code, out)
+	}
+	var rules []db_service.BlockedDomainInfo
+	if err := json.Unmarshal([]byte(out), &rules); err != nil {
+		t.Fatalf("list output is not JSON: %v\n%s", err, out)
+	}
+	if len(rules) != 3 {
+		t.Fatalf("expected 3 rules, got %d", len(rules))
+	}
+
+	if out, code := runCLI(t, dataDir, "unblock", "EXAMPLE.com"); code != 0 {
+		t.Fatalf("unblock failed with code %d: %s", code, out)
+	}
+	out, _ = runCLI(t, dataDir, "list")
+	if strings.Contains(out, "example.com") {
+		t.Fatalf("example.com should have been unblocked:\n%s", out)
+	}
+	if !strings.Contains(out, "*.ads.com") {
+		t.Fatalf("glob rule missing from list:\n%s", out)
+	}
+}
+
+func TestRun_TextExportRefusesRulesItCannotHold(t *testing.T) {
+	dir := t.TempDir()
+	runCLI(t, dir, "block", "exact.com")
+	runCLI(t, dir, "block", "-log-only", "ads.com")
+
+	file := filepath.Join(t.TempDir(), "rules.txt")
+	out, code := runCLI(t, dir, "export", file)
+	if code == 0 || !strings.Contains(out, "-json") {
+		t.Fatalf("expected the text export to fail and point to -json, got %d: %s", code, out)
+	}
+	if _, err := os.Stat(file); err == nil {
+		t.Fatal("no file should be written when the export fails")
+	}
+	if out, code := runCLI(t, dir, "-json", "export", file); code != 0 {
+		t.Fatalf("JSON export failed with code %d: %s", code, out)
+	}
+}
+
+func TestRun_ExportImportRoundTrip(t *testing.T) {
+	source := t.TempDir()
+	runCLI(t, source, "block", "exact.com")
+	runCLI(t, source, "block", "-type", "regex", `^ads\d+\.example\.com$`)
+
+	for _, format := range []string{"text", "json"} {
+		t.Run(format, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "rules."+format)
+			args := []string{"export", file}
+			if format == "json" {
+				args = append([]string{"-json"}, args...)
+			}
+			if out, code := runCLI(t, source, args...); code != 0 {
+				t.Fatalf("export failed with code %d: %s", code, out)
+			}
+
+			target := t.TempDir()
+			out, code := runCLI(t, target, "import", file)
+			if code != 0 {
+				t.Fatalf("import failed with code %d: %s", code, out)
+			}
+			if !strings.Contains(out, "imported 2 of 2 rules") {
+				t.Fatalf("unexpected import output: %s", out)
+			}
+
+			db, err := db_service.NewDBService(target)
+			if err != nil {
+				t.Fatalf("open target db: %v", err)
+			}
+			defer db.ServiceShutdown()
+			if !db.IsDomainBlocked("exact.com") || !db.IsDomainBlocked("ads42.example.com") {
+				t.Fatal("imported rules should block their domains")
+			}
+		})
+	}
+}
+
+func TestParseRules_PlainText(t *testing.T) {
+	input := "# comment\nexample.com\n\nglob *.tracker.net\nregex ^x\\.com$\n"
+	rules, err := parseRules(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("parseRules failed: %v", err)
+	}
+	expected := []db_service.BlockedDomainInfo{
+		{Domain: "example.com", FilterType: "exact"},
+		{Domain: "*.tracker.net", FilterType: "glob"},
+		{Domain: `^x\.com$`, FilterType: "regex"},
+	}
+	if len(rules) != len(expected) {
+		t.Fatalf("expected %d rules, got %d", len(expected), len(rules))
+	}
+	for i, want := range expected {
+		if rules[i] != want {
+			t.Errorf("rule %d = %+v, want %+v", i, rules[i], want)
+		}
+	}
+}
+
+func TestRun_Requests(t *testing.T) {
+	dir := t.TempDir()
+	db, err := db_service.NewDBService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := logging_service.NewLoggingService(db); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UnixMilli()
+	for i, host := range []string{"a.example.com", "b.example.com", "other.org"} {
+		_, err := db.Db.Exec(`INSERT INTO requests (timestamp, host, method, path, port, decision, duration)
+			VALUES (?, ?, 'CONNECT', '', 443, 'rejected', 0)`, now-int64(i), host)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.ServiceShutdown()
+
+	out, code := runCLI(t, dir, "requests", "-host", "example", "-n", "1")
+	if code != 0 {
+		t.Fatalf("requests failed with code %d: %s", code, out)
+	}
+	if !strings.Contains(out, "a.example.com") || strings.Contains(out, "b.example.com") || !strings.Contains(out, "1 of 2 matching requests") {
+		t.Fatalf("unexpected first page:\n%s", out)
+	}
+	_, cursor, ok := strings.Cut(out, "next page: -cursor ")
+	if !ok {
+		t.Fatalf("expected a cursor for the next page:\n%s", out)
+	}
+
+	out, code = runCLI(t, dir, "-json", "requests", "-host", "example", "-n", "1", "-cursor", strings.TrimSpace(cursor))
+	if code != 0 {
+		t.Fatalf("requests failed with code %d: %s", code, out)
+	}
+	var page logging_service.RequestPage
+	if err := json.Unmarshal([]byte(out), &page); err != nil {
+		t.Fatalf("requests output is not JSON: %v\n%s", err, out)
+	}
+	if len(page.Requests) != 1 || page.Requests[0].Host != "b.example.com" || page.NextCursor != "" {
+		t.Fatalf("unexpected second page: %+v", page)
+	}
+}
+
+func TestRun_UnknownCommand(t *testing.T) {
+	if _, code := runCLI(t, t.TempDir(), "frobnicate"); code != 2 {
+		t.Fatalf("expected exit code 2, got %d", code)
+	}
+}
+
+func TestIsCommandLine(t *testing.T) {
+	tests := []struct {
+		args []string
+		want bool
+	}{
+		{[]string{"block", "x.com"}, true},
+		{[]string{"-json", "list"}, true},
+		{[]string{"-data-dir", "/tmp/x", "stats"}, true},
+		{[]string{"--headless"}, false},
+		{[]string{}, false},
+	}
+	for _, tt := range tests {
+		if got := IsCommandLine(tt.args); got != tt.want {
+			t.Errorf("IsCommandLine(%v) = %v, want %v", tt.args, got, tt.want)
+		}
+	}
+}
+
+// fakeInstance records commands forwarded to a running instance
+type fakeInstance struct {
+	paused bool
+	rules  map[string]string
+}
+
+func (f *fakeInstance) Pause() (*control_service.Status, error) {
+	f.paused = true
+	return &control_service.Status{Paused: true}, nil
+}
+
+func (f *fakeInstance) Resume() (*control_service.Status, error) {
+	f.paused = false
+	return &control_service.Status{}, nil
+}
+
+func (f *fakeInstance) SaveRule(rule control_service.RuleRequest) error {
+	f.rules[rule.Domain] = rule.FilterType
+	return nil
+}
+
+func (f *fakeInstance) DeleteRule(domain string) error {
+	delete(f.rules, domain)
+	return nil
+}
+
+func TestRunWithOptions_UsesInstanceAndWorkingDir(t *testing.T) {
+	workDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(workDir, "rules.txt"), []byte("glob *.ads.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	instance := &fakeInstance{rules: map[string]string{}}
+	opts := Options{WorkingDir: workDir, Instance: instance}
+	run := func(args ...string) int {
+		var out bytes.Buffer
+		code := RunWithOptions(append([]string{"-data-dir", t.TempDir()}, args...), &out, &out, opts)
+		if code != 0 {
+			t.Logf("%v: %s", args, out.String())
+		}
+		return code
+	}
+
+	if code := run("pause"); code != 0 || !instance.paused {
+		t.Fatalf("pause was not forwarded (code %d)", code)
+	}
+	if code := run("block", "example.com"); code != 0 || instance.rules["example.com"] != "exact" {
+		t.Fatalf("block was not forwarded (code %d): %v", code, instance.rules)
+	}
+	if code := run("import", "rules.txt"); code != 0 || instance.rules["*.ads.com"] != "glob" {
+		t.Fatalf("import did not resolve against the working dir (code %d): %v", code, instance.rules)
+	}
+}
+
+func TestRun_RefusesRuleChangesBehindUnreachableInstance(t *testing.T) {
+	dir := t.TempDir()
+	lock, err := control_service.AcquireInstanceLock(dir)
+	if err != nil {
+		t.Fatalf("AcquireInstanceLock failed: %v", err)
+	}
+
+	out, code := runCLI(t, dir, "block", "example.com")
+	if code == 0 || !strings.Contains(out, "control socket is unavailable") {
+		t.Fatalf("expected the rule change to be refused, got code %d: %s", code, out)
+	}
+
+	lock.Release()
+	if out, code := runCLI(t, dir, "block", "example.com"); code != 0 {
+		t.Fatalf("block without a running instance failed with code %d: %s", code, out)
+	}
+}
+
+// runCLI runs the CLI against dataDir and returns combined output and exit code
+func runCLI(t *testing.T, dataDir string, args ...string) (string, int) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := Run(append([]string{"-data-dir", dataDir}, args...), &stdout, &stderr)
+	if stderr.Len() > 0 && code == 0 {
+		t.Logf("stderr: %s", stderr.String())
+	}
+	return stdout.String() + stderr.String(), code
+}
@@ -0,0 +1,157 @@
+package control_service
+
+import (
+	"bytes"
+	"changeme/db_service"
+	"changeme/logging_service"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ErrNotRunning is returned by Dial when no instance is listening on the socket
+var ErrNotRunning = errors.New("local-proxy is not running")
+
+// Client talks to a running instance over the control socket
+type Client struct {
+	http *http.Client
+}
+
+// Dial connects to the control socket in dataDir.
+func Dial(dataDir string) (*Client, error) {
+	socketPath := SocketPath(dataDir)
+	if _, err := os.Stat(socketPath); err != nil {
+		return nil, ErrNotRunning
+	}
+	conn, err := net.DialTimeout("unix", socketPath, time.Second)
+	if err != nil {
+		return nil, ErrNotRunning
+	}
+	_ = conn.Close()
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		},
+	}
+	return &Client{http: &http.Client{Transport: transport, Timeout: 30 * time.Second}}, nil
+}
+
+// Status returns the state of the running instance
+func (c *Client) Status() (*Status, error) {
+	var status Status
+	err := c.do(http.MethodGet, "/v1/status", nil, &status)
+	return &status, err
+}
+
+// Pause pauses the running proxy
+func (c *Client) Pause() (*Status, error) {
+	var status Status
+	err := c.do(http.MethodPost, "/v1/pause", nil, &status)
+	return &status, err
+}
+
+// Resume resumes the running proxy
+func (c *Client) Resume() (*Status, error) {
+	var status Status
+	err := c.do(http.MethodPost, "/v1/resume", nil, &status)
+	return &status, err
+}
+
+// ListRules returns the blocking rules of the running instance
+func (c *Client) ListRules() ([]db_service.BlockedDomainInfo, error) {
+	var rules []db_service.BlockedDomainInfo
+	err := c.do(http.MethodGet, "/v1/rules", nil, &rules)
+	return rules, err
+}
+
+// AddRule adds a blocking rule through the running instance
+func (c *Client) AddRule(domain, filterType string) error {
+	return c.do(http.MethodPost, "/v1/rules", RuleRequest{Domain: domain, FilterType: filterType}, nil)
+}
+
+// SaveRule adds a rule with any action through the running instance
+func (c *Client) SaveRule(rule RuleRequest) error {
+	return c.do(http.MethodPost, "/v1/rules", rule, nil)
+}
+
+// DeleteRule removes a blocking rule through the running instance
+func (c *Client) DeleteRule(domain string) error {
+	return c.do(http.MethodDelete, "/v1/rules?domain="+url.QueryEscape(domain), nil, nil)
+}
+
+// QueryRequests returns a filtered page of the request log of the running instance
+func (c *Client) QueryRequests(q logging_service.RequestQuery) (*logging_service.RequestPage, error) {
+	params := url.Values{}
+	set := func(name, value string) {
+		if value != "" {
+			params.Set(name, value)
+		}
+	}
+	set("host", q.Host)
+	set("decision", q.Decision)
+	set("method", q.Method)
+	set("rule", q.Rule)
+	set("reason", q.Reason)
+	set("user", q.User)
+	set("sort", q.SortBy)
+	set("cursor", q.Cursor)
+	for name, v := range map[string]int64{"port": int64(q.Port), "start": q.Start, "end": q.End, "limit": int64(q.Limit)} {
+		if v != 0 {
+			params.Set(name, strconv.FormatInt(v, 10))
+		}
+	}
+	if q.Ascending {
+		params.Set("asc", "true")
+	}
+
+	var page logging_service.RequestPage
+	err := c.do(http.MethodGet, "/v1/requests/query?"+params.Encode(), nil, &page)
+	return &page, err
+}
+
+func (c *Client) do(method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, "http://local-proxy"+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr errorResponse
+		if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Error != "" {
+			return errors.New(apiErr.Error)
+		}
+		return fmt.Errorf("control API returned %s", resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,327 @@
+package control_service
+
+import (
+	"changeme/db_service"
+	"changeme/logging_service"
+	"changeme/proxy_service"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Status describes the state of the running instance
+type Status struct {
+	Paused    bool `json:"paused"`
+	ProxyPort int  `json:"proxyPort"`
+	SocksPort int  `json:"socksPort,omitempty"`
+	RuleCount int  `json:"ruleCount"`
+}
+
+// RuleRequest is the body accepted by POST /v1/rules
+type RuleRequest struct {
+	Domain     string `json:"domain"`
+	FilterType string `json:"filterType"`
+	// App limits the rule to one application (process name or executable path)
+	App string `json:"app,omitempty"`
+	// Action is "block" (the default), "allow" or "log" for a dry run
+	Action string `json:"action,omitempty"`
+	// Ports limits the rule to ports and port ranges, e.g. "22,8000-8999"
+	Ports string `json:"ports,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Handler returns the control API routes without authentication
+func (c *ControlService) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/openapi.json", c.handleOpenAPI)
+	mux.HandleFunc("GET /v1/status", c.handleStatus)
+	mux.HandleFunc("POST /v1/pause", c.handlePause)
+	mux.HandleFunc("POST /v1/resume", c.handleResume)
+	mux.HandleFunc("GET /v1/rules", c.handleListRules)
+	mux.HandleFunc("POST /v1/rules", c.handleAddRule)
+	mux.HandleFunc("DELETE /v1/rules", c.handleDeleteRule)
+	mux.HandleFunc("GET /v1/dashboard", c.handleDashboard)
+	mux.HandleFunc("GET /v1/requests", c.handleRequests)
+	mux.HandleFunc("GET /v1/requests/query", c.handleQueryRequests)
+	return mux
+}
+
+// db returns the DatabaseService used for rule management
+func (c *ControlService) db() *db_service.DatabaseService {
+	if c.DbService != nil {
+		return c.DbService
+	}
+	return db_service.Instance()
+}
+
+// logger returns the LoggingService used for dashboard queries
+func (c *ControlService) logger() *logging_service.LoggingService {
+	if c.LoggingService != nil {
+		return c.LoggingService
+	}
+	return logging_service.Instance()
+}
+
+// proxy returns the ProxyService that is paused and resumed
+func (c *ControlService) proxy() *proxy_service.ProxyService {
+	if c.ProxyService != nil {
+		return c.ProxyService
+	}
+	return proxy_service.Instance()
+}
+
+func (c *ControlService) status() Status {
+	status := Status{
+		ProxyPort: proxy_service.PROXY_PORT,
+		RuleCount: len(c.db().ListBlockedDomainsWithInfo()),
+	}
+	if p := c.proxy(); p != nil {
+		status.Paused = p.IsPaused()
+		if p.EnableSocks {
+			status.SocksPort = proxy_service.SOCKS_PORT
+		}
+	}
+	return status
+}
+
+// Pause pauses the proxy and returns the resulting status
+func (c *ControlService) Pause() (*Status, error) {
+	p := c.proxy()
+	if p == nil {
+		return nil, errors.New("proxy service not running")
+	}
+	if err := p.PauseProxy(); err != nil {
+		return nil, err
+	}
+	status := c.status()
+	return &status, nil
+}
+
+// Resume resumes the proxy and returns the resulting status
+func (c *ControlService) Resume() (*Status, error) {
+	p := c.proxy()
+	if p == nil {
+		return nil, errors.New("proxy service not running")
+	}
+	if err := p.ResumeProxy(); err != nil {
+		return nil, err
+	}
+	status := c.status()
+	return &status, nil
+}
+
+// AddRule adds a blocking rule
+func (c *ControlService) AddRule(domain, filterType string) error {
+	return c.AddAppRule(domain, filterType, "")
+}
+
+// AddAppRule adds a blocking rule that only applies to app; an empty app applies to all
+func (c *ControlService) AddAppRule(domain, filterType, app string) error {
+	return c.SaveRule(RuleRequest{Domain: domain, FilterType: filterType, App: app})
+}
+
+// SaveRule adds a rule with the requested action, or updates the existing
+// rule for the same pattern and app
+func (c *ControlService) SaveRule(req RuleRequest) error {
+	rule := db_service.BlockedDomainInfo{Domain: req.Domain, FilterType: req.FilterType, App: req.App, Action: req.Action, Ports: req.Ports}
+	if !c.db().SaveRule(rule) {
+		return fmt.Errorf("invalid rule %q (%s)", req.Domain, req.FilterType)
+	}
+	return nil
+}
+
+// DeleteRule removes every blocking rule for domain
+func (c *ControlService) DeleteRule(domain string) error {
+	if !c.db().UnblockDomain(domain) {
+		return fmt.Errorf("failed to remove rule %q", domain)
+	}
+	return nil
+}
+
+// DeleteAppRule removes the rule for domain scoped to app ("" for the global rule)
+func (c *ControlService) DeleteAppRule(domain, app string) error {
+	if !c.db().UnblockDomainForApp(domain, app) {
+		return fmt.Errorf("failed to remove rule %q for %q", domain, app)
+	}
+	return nil
+}
+
+func (c *ControlService) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(openAPISpec)
+}
+
+func (c *ControlService) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, c.status())
+}
+
+func (c *ControlService) handlePause(w http.ResponseWriter, r *http.Request) {
+	status, err := c.Pause()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (c *ControlService) handleResume(w http.ResponseWriter, r *http.Request) {
+	status, err := c.Resume()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (c *ControlService) handleListRules(w http.ResponseWriter, r *http.Request) {
+	rules := c.db().ListBlockedDomainsWithInfo()
+	if rules == nil {
+		rules = []db_service.BlockedDomainInfo{}
+	}
+	writeJSON(w, http.StatusOK, rules)
+}
+
+func (c *ControlService) handleAddRule(w http.ResponseWriter, r *http.Request) {
+	var req RuleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if req.FilterType == "" {
+		req.FilterType = "exact"
+	}
+	if err := c.SaveRule(req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, req)
+}
+
+func (c *ControlService) handleDeleteRule(w http.ResponseWriter, r *http.Request) {
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeError(w, http.StatusBadRequest, "missing domain parameter")
+		return
+	}
+	var err error
+	if r.URL.Query().Has("app") {
+		err = c.DeleteAppRule(domain, r.URL.Query().Get("app"))
+	} else {
+		err = c.DeleteRule(domain)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *ControlService) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Has("start") {
+		start, err := strconv.ParseInt(query.Get("start"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid start")
+			return
+		}
+		end, _ := strconv.ParseInt(query.Get("end"), 10, 64)
+		bucket, _ := strconv.Atoi(query.Get("bucket"))
+		data, err := c.logger().GetDashboardDataRange(logging_service.DashboardQuery{
+			Start:         start,
+			End:           end,
+			BucketMinutes: bucket,
+			Timezone:      query.Get("tz"),
+		})
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, data)
+		return
+	}
+
+	timeRange := query.Get("range")
+	if timeRange == "" {
+		timeRange = "24h"
+	}
+	data, err := c.logger().GetDashboardData(timeRange)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+func (c *ControlService) handleRequests(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	after, _ := strconv.ParseInt(query.Get("after"), 10, 64)
+	limit, _ := strconv.Atoi(query.Get("limit"))
+
+	requests, err := c.logger().RequestsSince(after, limit)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if requests == nil {
+		requests = []logging_service.RequestDetail{}
+	}
+	writeJSON(w, http.StatusOK, requests)
+}
+
+func (c *ControlService) handleQueryRequests(w http.ResponseWriter, r *http.Request) {
+	q, err := parseRequestQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	page, err := c.logger().QueryRequests(q)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// parseRequestQuery reads the QueryRequests filters from URL parameters
+func parseRequestQuery(query url.Values) (logging_service.RequestQuery, error) {
+	q := logging_service.RequestQuery{
+		Host:      query.Get("host"),
+		Decision:  query.Get("decision"),
+		Method:    query.Get("method"),
+		Rule:      query.Get("rule"),
+		Reason:    query.Get("reason"),
+		User:      query.Get("user"),
+		SortBy:    query.Get("sort"),
+		Ascending: query.Get("asc") == "true" || query.Get("asc") == "1",
+		Cursor:    query.Get("cursor"),
+	}
+	var port, limit int64
+	for name, dst := range map[string]*int64{"start": &q.Start, "end": &q.End, "port": &port, "limit": &limit} {
+		if !query.Has(name) {
+			continue
+		}
+		v, err := strconv.ParseInt(query.Get(name), 10, 64)
+		if err != nil {
+			return q, fmt.Errorf("invalid %s", name)
+		}
+		*dst = v
+	}
+	q.Port, q.Limit = int(port), int(limit)
+	return q, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, errorResponse{Error: msg})
+}
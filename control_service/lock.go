@@ -0,0 +1,62 @@
+package control_service
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// LockName is the file a running instance keeps locked for as long as it runs
+const LockName = "instance.lock"
+
+// errLocked is returned by lockFile when another process holds the lock
+var errLocked = errors.New("lock is held by another process")
+
+// InstanceLock marks the data directory as used by a running instance. It
+// lets the CLI tell a running instance without a control socket from no
+// instance at all.
+type InstanceLock struct {
+	file *os.File
+}
+
+// AcquireInstanceLock takes the instance lock in dataDir. It fails when
+// another instance holds it.
+func AcquireInstanceLock(dataDir string) (*InstanceLock, error) {
+	f, err := os.OpenFile(filepath.Join(dataDir, LockName), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open instance lock: %w", err)
+	}
+	if err := lockFile(f); err != nil {
+		_ = f.Close()
+		if errors.Is(err, errLocked) {
+			return nil, fmt.Errorf("another local-proxy instance is using %s", dataDir)
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", f.Name(), err)
+	}
+	return &InstanceLock{file: f}, nil
+}
+
+// Release gives the lock up; it is released by the OS as well when the process exits.
+func (l *InstanceLock) Release() {
+	if l == nil || l.file == nil {
+		return
+	}
+	_ = unlockFile(l.file)
+	_ = l.file.Close()
+	l.file = nil
+}
+
+// InstanceRunning reports whether an instance holds the lock in dataDir
+func InstanceRunning(dataDir string) bool {
+	f, err := os.OpenFile(filepath.Join(dataDir, LockName), os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if err := lockFile(f); err != nil {
+		return errors.Is(err, errLocked)
+	}
+	_ = unlockFile(f)
+	return false
+}
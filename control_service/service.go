@@ -0,0 +1,226 @@
+package control_service
+
+import (
+	"changeme/db_service"
+	"changeme/logging_service"
+	"changeme/proxy_service"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/wailsapp/wails/v3/pkg/application"
+)
+
+const (
+	CONTROL_PORT = 30004
+
+	SocketName = "control.sock"
+	TokenName  = "control.token"
+
+	// socketDir keeps the socket in a directory only the owner can enter, so
+	// it is never reachable by others between bind and chmod.
+	socketDir = "run"
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+// ControlService exposes a local control API for a running instance. The
+// Unix domain socket is protected by file permissions; the optional loopback
+// HTTP listener requires the bearer token stored next to the database.
+type ControlService struct {
+	ctx     context.Context
+	options application.ServiceOptions
+
+	// DataDir holds the socket and token files (defaults to db_service.DataDir()).
+	DataDir string
+	// HTTPAddr enables the token-protected HTTP listener when set, e.g. "127.0.0.1:30004".
+	HTTPAddr string
+
+	ProxyService   *proxy_service.ProxyService
+	DbService      *db_service.DatabaseService
+	LoggingService *logging_service.LoggingService
+
+	token   string
+	lock    *InstanceLock
+	servers []*http.Server
+}
+
+// singleton instance for easy access from other services
+var instance *ControlService
+
+func Instance() *ControlService { return instance }
+
+func (c *ControlService) ServiceName() string { return "control_service" }
+
+// ServiceStartup starts the control listeners
+func (c *ControlService) ServiceStartup(ctx context.Context, options application.ServiceOptions) error {
+	if instance != nil {
+		log.Printf("Control Service already started")
+		return nil
+	}
+	instance = c
+	c.ctx = ctx
+	c.options = options
+
+	if err := c.Start(); err != nil {
+		// The app is still usable without remote control
+		log.Printf("Control Service init error: %v", err)
+	}
+	return nil
+}
+
+// ServiceShutdown stops the listeners and removes the socket file
+func (c *ControlService) ServiceShutdown() error {
+	c.Stop()
+	return nil
+}
+
+// Start takes the instance lock, creates the token and binds the Unix socket
+// and, if configured, the HTTP listener.
+func (c *ControlService) Start() error {
+	if c.DataDir == "" {
+		c.DataDir = db_service.DataDir()
+	}
+	if err := os.MkdirAll(c.DataDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create data dir: %w", err)
+	}
+
+	// Held even when the socket cannot be bound, so the CLI knows not to
+	// change rules behind this instance's back
+	lock, err := AcquireInstanceLock(c.DataDir)
+	if err != nil {
+		return err
+	}
+	c.lock = lock
+
+	token, err := loadOrCreateToken(filepath.Join(c.DataDir, TokenName))
+	if err != nil {
+		return err
+	}
+	c.token = token
+
+	socketPath := SocketPath(c.DataDir)
+	unixListener, err := listenUnix(socketPath)
+	if err != nil {
+		return err
+	}
+	c.serve(unixListener, c.Handler())
+	log.Printf("Control API listening on %s", socketPath)
+
+	if c.HTTPAddr != "" {
+		httpListener, err := net.Listen("tcp", c.HTTPAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", c.HTTPAddr, err)
+		}
+		c.serve(httpListener, c.requireToken(c.Handler()))
+		log.Printf("Control API listening on http://%s", httpListener.Addr())
+	}
+	return nil
+}
+
+// Stop gracefully shuts down every listener.
+func (c *ControlService) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, srv := range c.servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Warning: control API shutdown: %v", err)
+		}
+	}
+	c.servers = nil
+	c.lock.Release()
+	c.lock = nil
+}
+
+// Token returns the bearer token required by the HTTP listener
+func (c *ControlService) Token() string { return c.token }
+
+func (c *ControlService) serve(ln net.Listener, handler http.Handler) {
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	c.servers = append(c.servers, srv)
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Control API server error: %v", err)
+		}
+	}()
+}
+
+// requireToken rejects requests without the expected bearer token
+func (c *ControlService) requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		token, ok := strings.CutPrefix(auth, "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(c.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="local-proxy"`)
+			writeError(w, http.StatusUnauthorized, "missing or invalid token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// loadOrCreateToken reads the token file, generating a new random token if needed
+func loadOrCreateToken(path string) (string, error) {
+	if data, err := os.ReadFile(path); err == nil {
+		if token := strings.TrimSpace(string(data)); token != "" {
+			return token, nil
+		}
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	token := hex.EncodeToString(buf)
+	if err := os.WriteFile(path, []byte(token+"\n"), 0o600); err != nil {
+		return "", fmt.Errorf("failed to write token: %w", err)
+	}
+	return token, nil
+}
+
+// SocketPath returns the path of the control socket for dataDir
+func SocketPath(dataDir string) string {
+	return filepath.Join(dataDir, socketDir, SocketName)
+}
+
+// listenUnix binds the control socket, replacing a stale socket file left by
+// a previous instance and restricting access to the current user.
+func listenUnix(path string) (net.Listener, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	// MkdirAll leaves the mode of an existing directory alone
+	if err := os.Chmod(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to restrict %s: %w", dir, err)
+	}
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("control socket %s is already in use", path)
+		}
+		_ = os.Remove(path)
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		_ = ln.Close()
+		return nil, fmt.Errorf("failed to restrict %s: %w", path, err)
+	}
+	return ln, nil
+}
@@ -0,0 +1,244 @@
+package control_service
+
+import (
+	"changeme/db_service"
+	"changeme/logging_service"
+	"changeme/proxy_service"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestControlService_SocketRoundTrip(t *testing.T) {
+	service := setupTestService(t)
+
+	client, err := Dial(service.DataDir)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	if err := client.AddRule("*.ads.test", "glob"); err != nil {
+		t.Fatalf("AddRule failed: %v", err)
+	}
+	if !service.DbService.IsDomainBlocked("tracker.ads.test") {
+		t.Fatal("rule added over the socket should be enforced")
+	}
+
+	rules, err := client.ListRules()
+	if err != nil {
+		t.Fatalf("ListRules failed: %v", err)
+	}
+	if len(rules) != 1 || rules[0].Domain != "*.ads.test" || rules[0].FilterType != "glob" {
+		t.Fatalf("unexpected rules: %+v", rules)
+	}
+
+	if err := client.DeleteRule("*.ads.test"); err != nil {
+		t.Fatalf("DeleteRule failed: %v", err)
+	}
+	if service.DbService.IsDomainBlocked("tracker.ads.test") {
+		t.Fatal("rule removed over the socket should no longer be enforced")
+	}
+
+	if err := client.AddRule("bad[", "regex"); err == nil {
+		t.Fatal("invalid regex should be rejected")
+	}
+}
+
+func TestControlService_PauseResume(t *testing.T) {
+	service := setupTestService(t)
+	client, err := Dial(service.DataDir)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	var notified []bool
+	service.ProxyService.OnPauseChanged(func(paused bool) { notified = append(notified, paused) })
+
+	status, err := client.Pause()
+	if err != nil {
+		t.Fatalf("Pause failed: %v", err)
+	}
+	if !status.Paused || !service.ProxyService.IsPaused() {
+		t.Fatal("proxy should be paused")
+	}
+
+	status, err = client.Resume()
+	if err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	if status.Paused || service.ProxyService.IsPaused() {
+		t.Fatal("proxy should be resumed")
+	}
+
+	if len(notified) != 2 || !notified[0] || notified[1] {
+		t.Fatalf("unexpected pause notifications: %v", notified)
+	}
+}
+
+func TestControlService_HTTPRequiresToken(t *testing.T) {
+	service := setupTestService(t)
+	handler := service.requireToken(service.Handler())
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"missing", "", http.StatusUnauthorized},
+		{"wrong", "Bearer nope", http.StatusUnauthorized},
+		{"valid", "Bearer " + service.Token(), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/status", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("expected %d, got %d", tt.want, rec.Code)
+			}
+		})
+	}
+}
+
+func TestControlService_TokenPersisted(t *testing.T) {
+	service := setupTestService(t)
+
+	info, err := os.Stat(filepath.Join(service.DataDir, TokenName))
+	if err != nil {
+		t.Fatalf("token file missing: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Fatalf("token file should be private, got %v", perm)
+	}
+
+	token, err := loadOrCreateToken(filepath.Join(service.DataDir, TokenName))
+	if err != nil {
+		t.Fatalf("loadOrCreateToken failed: %v", err)
+	}
+	if token != service.Token() {
+		t.Fatal("token should be reused across restarts")
+	}
+}
+
+func TestControlService_SocketIsPrivate(t *testing.T) {
+	service := setupTestService(t)
+
+	dir := filepath.Dir(SocketPath(service.DataDir))
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatalf("socket directory missing: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o700 {
+		t.Fatalf("socket directory should be private, got %v", perm)
+	}
+	info, err = os.Stat(SocketPath(service.DataDir))
+	if err != nil {
+		t.Fatalf("socket missing: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Fatalf("socket should be private, got %v", perm)
+	}
+
+	// A directory left behind with looser permissions is tightened
+	dataDir := t.TempDir()
+	dir = filepath.Dir(SocketPath(dataDir))
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := listenUnix(SocketPath(dataDir))
+	if err != nil {
+		t.Fatalf("listenUnix failed: %v", err)
+	}
+	defer ln.Close()
+	if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0o700 {
+		t.Fatalf("expected the existing directory to be restricted, got %v (%v)", info.Mode().Perm(), err)
+	}
+}
+
+func TestControlService_QueryRequests(t *testing.T) {
+	service := setupTestService(t)
+	logging, err := logging_service.NewLoggingService(service.DbService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.LoggingService = logging
+	for i, host := range []string{"a.example.com", "b.example.com", "other.org"} {
+		_, err := service.DbService.Db.Exec(`INSERT INTO requests (timestamp, host, method, path, port, decision, duration)
+			VALUES (?, ?, 'CONNECT', '', 443, 'approved', 0)`, int64(1000+i), host)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client, err := Dial(service.DataDir)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	page, err := client.QueryRequests(logging_service.RequestQuery{Host: "example", Limit: 1, Ascending: true})
+	if err != nil {
+		t.Fatalf("QueryRequests failed: %v", err)
+	}
+	if page.Total != 2 || len(page.Requests) != 1 || page.Requests[0].Host != "a.example.com" || page.NextCursor == "" {
+		t.Fatalf("unexpected first page: %+v", page)
+	}
+	page, err = client.QueryRequests(logging_service.RequestQuery{Host: "example", Limit: 1, Ascending: true, Cursor: page.NextCursor})
+	if err != nil {
+		t.Fatalf("QueryRequests failed: %v", err)
+	}
+	if len(page.Requests) != 1 || page.Requests[0].Host != "b.example.com" || page.NextCursor != "" {
+		t.Fatalf("unexpected second page: %+v", page)
+	}
+
+	if _, err := client.QueryRequests(logging_service.RequestQuery{SortBy: "bogus"}); err == nil {
+		t.Fatal("expected an unsupported sort option to be rejected")
+	}
+}
+
+func TestInstanceLock(t *testing.T) {
+	service := setupTestService(t)
+	if !InstanceRunning(service.DataDir) {
+		t.Fatal("expected the started service to hold the instance lock")
+	}
+	if _, err := AcquireInstanceLock(service.DataDir); err == nil {
+		t.Fatal("expected a second instance to be refused the lock")
+	}
+	service.Stop()
+	if InstanceRunning(service.DataDir) {
+		t.Fatal("expected the lock to be released on stop")
+	}
+	if InstanceRunning(t.TempDir()) {
+		t.Fatal("expected no instance in an unused data directory")
+	}
+}
+
+func TestDial_NotRunning(t *testing.T) {
+	if _, err := Dial(t.TempDir()); err != ErrNotRunning {
+		t.Fatalf("expected ErrNotRunning, got %v", err)
+	}
+}
+
+// Helper function to set up a control service backed by an isolated database
+func setupTestService(t *testing.T) *ControlService {
+	dataDir := t.TempDir()
+	db, err := db_service.NewDBService(dataDir)
+	if err != nil {
+		t.Fatalf("Failed to create test db: %v", err)
+	}
+	t.Cleanup(func() { db.ServiceShutdown() })
+
+	service := &ControlService{
+		DataDir:      dataDir,
+		DbService:    db,
+		ProxyService: &proxy_service.ProxyService{DbService: db},
+	}
+	if err := service.Start(); err != nil {
+		t.Fatalf("Failed to start control service: %v", err)
+	}
+	t.Cleanup(service.Stop)
+	return service
+}
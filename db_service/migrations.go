@@ -0,0 +1,89 @@
+package db_service
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migrations upgrade the schema created by NewDBService. They run in order,
+// each in its own transaction, and PRAGMA user_version records how many
+// have been applied. Append new steps; never edit one that has shipped.
+var migrations = []string{
+	// 1: rules can be scoped to an application, so the same pattern may
+	// exist once globally and once per application
+	`CREATE TABLE blocked_domains_new (
+		domain TEXT NOT NULL,
+		filter_type TEXT DEFAULT 'exact' CHECK(filter_type IN ('exact', 'glob', 'regex')),
+		app TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (domain, app)
+	);
+	INSERT INTO blocked_domains_new (domain, filter_type, created_at)
+		SELECT domain, filter_type, created_at FROM blocked_domains;
+	DROP TABLE blocked_domains;
+	ALTER TABLE blocked_domains_new RENAME TO blocked_domains;`,
+
+	// 2: allow rules and temporary rules, for decisions made in ask mode
+	`ALTER TABLE blocked_domains ADD COLUMN action TEXT NOT NULL DEFAULT 'block';
+	ALTER TABLE blocked_domains ADD COLUMN expires_at INTEGER NOT NULL DEFAULT 0;`,
+
+	// 3: hosts seen during the learning period of the default-deny policy
+	`CREATE TABLE allowlist_candidates (
+		host TEXT PRIMARY KEY,
+		hits INTEGER NOT NULL DEFAULT 0,
+		first_seen INTEGER NOT NULL,
+		last_seen INTEGER NOT NULL
+	);`,
+
+	// 4: ip and cidr rules, which the filter_type check did not allow
+	`CREATE TABLE blocked_domains_new (
+		domain TEXT NOT NULL,
+		filter_type TEXT DEFAULT 'exact' CHECK(filter_type IN ('exact', 'glob', 'regex', 'ip', 'cidr')),
+		app TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		action TEXT NOT NULL DEFAULT 'block',
+		expires_at INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (domain, app)
+	);
+	INSERT INTO blocked_domains_new (domain, filter_type, app, created_at, action, expires_at)
+		SELECT domain, filter_type, app, created_at, action, expires_at FROM blocked_domains;
+	DROP TABLE blocked_domains;
+	ALTER TABLE blocked_domains_new RENAME TO blocked_domains;`,
+
+	// 5: rules limited to ports and port ranges
+	`ALTER TABLE blocked_domains ADD COLUMN ports TEXT NOT NULL DEFAULT '';`,
+
+	// 6: proxy users for Proxy-Authorization and SOCKS5 authentication
+	`CREATE TABLE proxy_users (
+		username TEXT PRIMARY KEY,
+		password_hash TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`,
+}
+
+// migrate applies the migrations the database has not seen yet
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, i+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package db_service
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+)
+
+// policySettingKey stores the Policy as JSON in the settings table
+const policySettingKey = "policy"
+
+// Policy decides hosts that no rule matches, and how rules see hostnames
+type Policy struct {
+	// DefaultAction is ActionAllow, or ActionBlock to only let allowed hosts pass
+	DefaultAction string `json:"defaultAction"`
+	// LearningUntil ends the learning period, in unix milliseconds. Until
+	// then hosts without a rule pass and are recorded as allowlist candidates.
+	LearningUntil int64 `json:"learningUntil"`
+	// MatchResolvedIPs lets ip and cidr rules match hostnames by the
+	// addresses they resolve to, at the cost of a lookup per connection
+	MatchResolvedIPs bool `json:"matchResolvedIPs"`
+	// AllowedPorts lists the ports tunnels may connect to, in the format of
+	// rule ports. When empty, the HTTP proxy uses DefaultAllowedPorts and
+	// SOCKS5, which carries ssh, git and database traffic, allows any port.
+	// An allow rule naming a port lets tunnels to its hosts use that port as well.
+	AllowedPorts string `json:"allowedPorts"`
+}
+
+// Learning reports whether the learning period is running
+func (p Policy) Learning() bool {
+	return p.LearningUntil > time.Now().UnixMilli()
+}
+
+// BlocksUnknown reports whether hosts that no rule matches are blocked
+func (p Policy) BlocksUnknown() bool {
+	return !p.Learning() && p.DefaultAction == ActionBlock
+}
+
+// PortAllowed reports whether HTTP proxy tunnels may connect to port
+func (p Policy) PortAllowed(port int) bool {
+	ports := p.AllowedPorts
+	if ports == "" {
+		ports = DefaultAllowedPorts
+	}
+	return portsContain(ports, port)
+}
+
+// SocksPortAllowed reports whether SOCKS5 tunnels may connect to port. Only
+// ports configured explicitly restrict them.
+func (p Policy) SocksPortAllowed(port int) bool {
+	return p.AllowedPorts == "" || portsContain(p.AllowedPorts, port)
+}
+
+// DefaultPolicy allows everything that is not blocked, on the default ports
+var DefaultPolicy = Policy{DefaultAction: ActionAllow}
+
+// Candidate is a host seen during learning without a matching rule
+type Candidate struct {
+	Host      string `json:"host"`
+	Hits      int64  `json:"hits"`
+	FirstSeen int64  `json:"firstSeen"` // unix milliseconds
+	LastSeen  int64  `json:"lastSeen"`  // unix milliseconds
+}
+
+// GetPolicy returns the configured policy, or DefaultPolicy when unset.
+func (d *DatabaseService) GetPolicy() Policy {
+	value, ok := d.GetSetting(policySettingKey)
+	if !ok {
+		return DefaultPolicy
+	}
+	var policy Policy
+	if err := json.Unmarshal([]byte(value), &policy); err != nil {
+		log.Printf("warning: invalid policy %q: %v", value, err)
+		return DefaultPolicy
+	}
+	return policy
+}
+
+// SetPolicy stores the policy; it applies to the next request.
+func (d *DatabaseService) SetPolicy(policy Policy) bool {
+	if policy.DefaultAction != ActionAllow && policy.DefaultAction != ActionBlock {
+		log.Printf("Invalid default action %q", policy.DefaultAction)
+		return false
+	}
+	ports, err := ParsePorts(policy.AllowedPorts)
+	if err != nil {
+		log.Printf("Invalid allowed ports: %v", err)
+		return false
+	}
+	policy.AllowedPorts = ports
+	value, err := json.Marshal(policy)
+	if err != nil {
+		return false
+	}
+	return d.SetSetting(policySettingKey, string(value))
+}
+
+// ApplyPolicy decides a host that no rule matched and reports whether it is
+// blocked. During the learning period the host passes and is recorded.
+func (d *DatabaseService) ApplyPolicy(host string) bool {
+	policy := d.GetPolicy()
+	if policy.Learning() {
+		d.RecordCandidate(host)
+	}
+	return policy.BlocksUnknown()
+}
+
+// RecordCandidate counts a hit for host in the candidate allowlist
+func (d *DatabaseService) RecordCandidate(host string) bool {
+	if d == nil || d.Db == nil {
+		return false
+	}
+	host = strings.ToLower(strings.TrimSpace(host))
+	if host == "" {
+		return false
+	}
+	now := time.Now().UnixMilli()
+	upsertStmt := `INSERT INTO allowlist_candidates (host, hits, first_seen, last_seen) VALUES (?, 1, ?, ?)
+		ON CONFLICT(host) DO UPDATE SET hits = hits + 1, last_seen = excluded.last_seen`
+	if _, err := d.Db.Exec(upsertStmt, host, now, now); err != nil {
+		log.Printf("DB error recording candidate %q: %v", host, err)
+		return false
+	}
+	return true
+}
+
+// ListCandidates returns the candidate allowlist, most seen first
+func (d *DatabaseService) ListCandidates() []Candidate {
+	if d == nil || d.Db == nil {
+		return []Candidate{}
+	}
+	rows, err := d.Db.Query(`SELECT host, hits, first_seen, last_seen FROM allowlist_candidates ORDER BY hits DESC, host`)
+	if err != nil {
+		log.Printf("DB error listing candidates: %v", err)
+		return []Candidate{}
+	}
+	defer rows.Close()
+
+	candidates := []Candidate{}
+	for rows.Next() {
+		var c Candidate
+		if err := rows.Scan(&c.Host, &c.Hits, &c.FirstSeen, &c.LastSeen); err != nil {
+			log.Printf("DB error scanning candidate: %v", err)
+			continue
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates
+}
+
+// ApproveCandidates adds an allow rule for each host and removes it from the
+// candidates. It returns the number of hosts approved.
+func (d *DatabaseService) ApproveCandidates(hosts []string) int {
+	approved := 0
+	for _, host := range hosts {
+		if d.SaveRule(BlockedDomainInfo{Domain: host, FilterType: "exact", Action: ActionAllow}) {
+			approved++
+		}
+	}
+	d.DismissCandidates(hosts)
+	return approved
+}
+
+// DismissCandidates removes hosts from the candidates without adding rules
+func (d *DatabaseService) DismissCandidates(hosts []string) bool {
+	if d == nil || d.Db == nil {
+		return false
+	}
+	tx, err := d.Db.Begin()
+	if err != nil {
+		log.Printf("DB error removing candidates: %v", err)
+		return false
+	}
+	defer tx.Rollback()
+	for _, host := range hosts {
+		if _, err := tx.Exec(`DELETE FROM allowlist_candidates WHERE host = ?`, strings.ToLower(strings.TrimSpace(host))); err != nil {
+			log.Printf("DB error removing candidate %q: %v", host, err)
+			return false
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("DB error removing candidates: %v", err)
+		return false
+	}
+	return true
+}
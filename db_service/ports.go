@@ -0,0 +1,82 @@
+package db_service
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultAllowedPorts are the ports HTTP proxy tunnels may use when the policy names none
+const DefaultAllowedPorts = "80,443"
+
+// portRange is an inclusive range of ports
+type portRange struct{ from, to int }
+
+// ParsePorts parses a comma separated list of ports and port ranges, such as
+// "22" or "80,443,8000-8999", and returns it normalised.
+func ParsePorts(spec string) (string, error) {
+	ranges, err := parsePortRanges(spec)
+	if err != nil {
+		return "", err
+	}
+	parts := make([]string, len(ranges))
+	for i, r := range ranges {
+		parts[i] = strconv.Itoa(r.from)
+		if r.to != r.from {
+			parts[i] += "-" + strconv.Itoa(r.to)
+		}
+	}
+	return strings.Join(parts, ","), nil
+}
+
+func parsePortRanges(spec string) ([]portRange, error) {
+	var ranges []portRange
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		from, to, isRange := strings.Cut(part, "-")
+		r := portRange{}
+		var err error
+		if r.from, err = parsePort(from); err != nil {
+			return nil, err
+		}
+		r.to = r.from
+		if isRange {
+			if r.to, err = parsePort(to); err != nil {
+				return nil, err
+			}
+			if r.to < r.from {
+				return nil, fmt.Errorf("invalid port range %q", part)
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
+}
+
+// portsContain reports whether port is in the list; an empty list contains every port
+func portsContain(spec string, port int) bool {
+	ranges, err := parsePortRanges(spec)
+	if err != nil {
+		return false
+	}
+	if len(ranges) == 0 {
+		return true
+	}
+	for _, r := range ranges {
+		if port >= r.from && port <= r.to {
+			return true
+		}
+	}
+	return false
+}
@@ -2,13 +2,17 @@ package db_service
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/wailsapp/wails/v3/pkg/application"
 	_ "modernc.org/sqlite"
@@ -22,6 +26,16 @@ type DatabaseService struct {
 
 	Db     *sql.DB
 	dbPath string
+
+	// Callbacks invoked after the rule set changes
+	rulesMu        sync.Mutex
+	rulesListeners []func()
+
+	// verified caches passwords that matched a stored hash, and rejected
+	// when credentials last failed, see CheckProxyUser
+	authMu   sync.Mutex
+	verified map[string][sha256.Size]byte
+	rejected map[[sha256.Size]byte]time.Time
 }
 
 // singleton instance for easy access from other services
@@ -54,6 +68,13 @@ func NewDBService(baseDir string) (*DatabaseService, error) {
 		return nil, fmt.Errorf("failed to register regex function: %w", err)
 	}
 
+	// Lets the logging retention job give pruned pages back to the OS. Only
+	// takes effect on new databases; older ones are converted on request by
+	// LoggingService.CompactDatabase.
+	if _, err := db.Exec("PRAGMA auto_vacuum = INCREMENTAL"); err != nil {
+		log.Printf("warning: failed to set auto_vacuum: %v", err)
+	}
+
 	createStmt := `CREATE TABLE IF NOT EXISTS blocked_domains (
 		domain TEXT PRIMARY KEY,
 		filter_type TEXT DEFAULT 'exact' CHECK(filter_type IN ('exact', 'glob', 'regex')),
@@ -64,6 +85,20 @@ func NewDBService(baseDir string) (*DatabaseService, error) {
 		return nil, fmt.Errorf("failed to create blocked_domains: %w", err)
 	}
 
+	settingsStmt := `CREATE TABLE IF NOT EXISTS settings (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	)`
+	if _, err := db.Exec(settingsStmt); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to create settings: %w", err)
+	}
+
+	if err := migrate(db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
 	service.Db = db
 	service.dbPath = sqlitePath
 
@@ -98,40 +133,72 @@ func (d *DatabaseService) ServiceShutdown() error {
 }
 
 func (d *DatabaseService) initDBs() error {
-	dataDir := application.Path(application.PathDataHome)
-	if err := os.MkdirAll(dataDir, 0o755); err != nil {
-		return fmt.Errorf("failed to create data dir: %w", err)
+	service, err := NewDBService(DataDir())
+	if err != nil {
+		return err
 	}
 
-	// SQLite for blocked domains
-	sqlitePath := filepath.Join(dataDir, "local-proxy", "local-proxy.db")
-	db, err := sql.Open("sqlite", sqlitePath+"?_journal_mode=WAL&_busy_timeout=500&_synchronous=NORMAL&_txlock=deferred")
-	if err != nil {
-		return fmt.Errorf("failed to open sqlite db: %w", err)
+	d.Db = service.Db
+	d.dbPath = service.dbPath
+
+	return nil
+}
+
+// DataDir returns the directory holding the database and other runtime files
+func DataDir() string {
+	return filepath.Join(application.Path(application.PathDataHome), "local-proxy")
+}
+
+// OnRulesChanged registers fn to be called whenever a rule is added or removed.
+func (d *DatabaseService) OnRulesChanged(fn func()) {
+	if d == nil || fn == nil {
+		return
 	}
-	if _, err := db.Exec("PRAGMA busy_timeout=5000"); err != nil {
-		log.Printf("warning: failed to set busy_timeout: %v", err)
+	d.rulesMu.Lock()
+	defer d.rulesMu.Unlock()
+	d.rulesListeners = append(d.rulesListeners, fn)
+}
+
+// notifyRulesChanged invokes every registered rules listener
+func (d *DatabaseService) notifyRulesChanged() {
+	d.rulesMu.Lock()
+	listeners := append([]func(){}, d.rulesListeners...)
+	d.rulesMu.Unlock()
+
+	for _, fn := range listeners {
+		fn()
 	}
+}
 
-	// Register regex function
-	if err := d.registerRegexFunction(db); err != nil {
-		_ = db.Close()
-		return fmt.Errorf("failed to register regex function: %w", err)
+// GetSetting returns the stored value for key and whether it was set
+func (d *DatabaseService) GetSetting(key string) (string, bool) {
+	if d == nil || d.Db == nil {
+		return "", false
 	}
-	createStmt := `CREATE TABLE IF NOT EXISTS blocked_domains (
-		domain TEXT PRIMARY KEY,
-		filter_type TEXT DEFAULT 'exact' CHECK(filter_type IN ('exact', 'glob', 'regex')),
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	)`
-	if _, err := db.Exec(createStmt); err != nil {
-		_ = db.Close()
-		return fmt.Errorf("failed to create blocked_domains: %w", err)
+	var value string
+	err := d.Db.QueryRow(`SELECT value FROM settings WHERE key = ?`, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", false
 	}
+	if err != nil {
+		log.Printf("DB error reading setting %q: %v", key, err)
+		return "", false
+	}
+	return value, true
+}
 
-	d.Db = db
-	d.dbPath = sqlitePath
-
-	return nil
+// SetSetting stores value under key, replacing any previous value
+func (d *DatabaseService) SetSetting(key, value string) bool {
+	if d == nil || d.Db == nil {
+		return false
+	}
+	upsertStmt := `INSERT INTO settings (key, value) VALUES (?, ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value`
+	if _, err := d.Db.Exec(upsertStmt, key, value); err != nil {
+		log.Printf("DB error writing setting %q: %v", key, err)
+		return false
+	}
+	return true
 }
 
 func regex(re, s string) (bool, error) {
@@ -147,52 +214,178 @@ func (d *DatabaseService) registerRegexFunction(db *sql.DB) error {
 }
 
 // IsDomainBlocked checks exact, glob, or regex patterns case-insensitively.
+// Log-only rules never block; use FindRule to see their would-block matches.
 func (d *DatabaseService) IsDomainBlocked(domain string) bool {
+	_, blocked := d.MatchDomain(domain)
+	return blocked
+}
+
+// MatchDomain returns the global rule blocking domain, if any.
+func (d *DatabaseService) MatchDomain(domain string) (BlockedDomainInfo, bool) {
+	return d.Match(MatchTarget{Domain: domain})
+}
+
+// MatchTarget describes a connection for rule evaluation. The process fields
+// are empty when the originating application is unknown.
+type MatchTarget struct {
+	// Domain is a hostname or an IP address literal
+	Domain string
+	// Port is the destination port; 0 when unknown, e.g. for DNS queries,
+	// in which case rules limited to ports do not apply
+	Port        int
+	ProcessName string
+	ProcessPath string
+	// Resolve returns the addresses Domain resolves to. When set, ip and cidr
+	// rules also match hostnames through them. It is called at most once,
+	// and only when such a rule could decide the connection.
+	Resolve func() []net.IP
+	// SkipLogOnly ignores log-only rules, to find what decides a connection
+	// a log-only rule has marked
+	SkipLogOnly bool
+}
+
+// HasAppRules reports whether any unexpired rule is scoped to an application
+func (d *DatabaseService) HasAppRules() bool {
 	if d == nil || d.Db == nil {
 		return false
 	}
-	domain = strings.ToLower(strings.TrimSpace(domain))
-	if domain == "" {
+	var exists bool
+	err := d.Db.QueryRow(`SELECT EXISTS(SELECT 1 FROM blocked_domains WHERE app != ''
+		AND (expires_at = 0 OR expires_at > ?))`, time.Now().UnixMilli()).Scan(&exists)
+	if err != nil {
+		log.Printf("DB error checking for app rules: %v", err)
 		return false
 	}
+	return exists
+}
+
+// Match returns the rule blocking target, if any.
+func (d *DatabaseService) Match(target MatchTarget) (BlockedDomainInfo, bool) {
+	rule, found := d.FindRule(target)
+	if !found || rule.Action != ActionBlock {
+		return BlockedDomainInfo{}, false
+	}
+	return rule, true
+}
+
+// FindRule returns the rule deciding target, whatever its action. Rules
+// limited to ports only apply to those ports. Rules scoped to an
+// application only apply when its name or executable path equals the
+// rule's app, and take precedence over global rules; within the
+// same scope a block rule wins over a log-only rule, which wins over an
+// allow rule. Expired rules are ignored.
+func (d *DatabaseService) FindRule(target MatchTarget) (BlockedDomainInfo, bool) {
+	if d == nil || d.Db == nil {
+		return BlockedDomainInfo{}, false
+	}
+	domain := strings.ToLower(strings.TrimSpace(target.Domain))
+	if domain == "" {
+		return BlockedDomainInfo{}, false
+	}
 
-	// Get all blocked patterns with their filter types
-	rows, err := d.Db.Query(`SELECT domain, filter_type FROM blocked_domains`)
+	// Get all active patterns with their filter types
+	rows, err := d.Db.Query(`SELECT domain, filter_type, app, action, ports, expires_at, created_at FROM blocked_domains
+		WHERE expires_at = 0 OR expires_at > ?`, time.Now().UnixMilli())
 	if err != nil {
 		log.Printf("DB error querying blocked domains: %v", err)
-		return false
+		return BlockedDomainInfo{}, false
 	}
 	defer rows.Close()
 
+	// Addresses checked by ip and cidr rules, looked up on first use
+	var ips []net.IP
+	ipsKnown := false
+	addrs := func() []net.IP {
+		if !ipsKnown {
+			ipsKnown = true
+			if ip := parseIP(domain); ip != nil {
+				ips = []net.IP{ip}
+			} else if target.Resolve != nil {
+				ips = target.Resolve()
+			}
+		}
+		return ips
+	}
+
+	var best BlockedDomainInfo
+	bestRank := -1
 	for rows.Next() {
-		var pattern, filterType string
-		if err := rows.Scan(&pattern, &filterType); err != nil {
+		var rule BlockedDomainInfo
+		if err := rows.Scan(&rule.Domain, &rule.FilterType, &rule.App, &rule.Action, &rule.Ports, &rule.ExpiresAt, &rule.CreatedAt); err != nil {
 			log.Printf("DB error scanning blocked domain: %v", err)
 			continue
 		}
+		if rule.App != "" && rule.App != target.ProcessName && rule.App != target.ProcessPath {
+			continue
+		}
+		if rule.Ports != "" && (target.Port == 0 || !portsContain(rule.Ports, target.Port)) {
+			continue
+		}
+		if target.SkipLogOnly && rule.Action == ActionLog {
+			continue
+		}
+		rank := 0
+		if rule.App != "" {
+			rank += 3
+		}
+		switch rule.Action {
+		case ActionBlock:
+			rank += 2
+		case ActionLog:
+			rank++
+		}
+		if rank <= bestRank || !d.matchPattern(domain, addrs, rule) {
+			continue
+		}
+		best, bestRank = rule, rank
+	}
 
-		// Check based on filter type
-		switch filterType {
-		case "exact":
-			if domain == strings.ToLower(pattern) {
-				return true
-			}
-		case "glob":
-			// Use SQLite GLOB for pattern matching
-			if matched, _ := d.matchGlob(domain, strings.ToLower(pattern)); matched {
+	return best, bestRank >= 0
+}
+
+// matchPattern reports whether the lowercase domain matches the rule's
+// pattern. ip and cidr rules are checked against addrs instead.
+func (d *DatabaseService) matchPattern(domain string, addrs func() []net.IP, rule BlockedDomainInfo) bool {
+	pattern := rule.Domain
+
+	// Check based on filter type
+	switch rule.FilterType {
+	case "exact":
+		return domain == strings.ToLower(pattern)
+	case "glob":
+		// Use SQLite GLOB for pattern matching
+		matched, _ := d.matchGlob(domain, strings.ToLower(pattern))
+		return matched
+	case "regex":
+		// Use Go regex for pattern matching
+		matched, _ := d.matchRegex(domain, pattern)
+		return matched
+	case "ip":
+		ruleIP := net.ParseIP(pattern)
+		for _, ip := range addrs() {
+			if ip.Equal(ruleIP) {
 				return true
 			}
-		case "regex":
-			// Use Go regex for pattern matching
-			if matched, _ := d.matchRegex(domain, pattern); matched {
+		}
+	case "cidr":
+		_, network, err := net.ParseCIDR(pattern)
+		if err != nil {
+			return false
+		}
+		for _, ip := range addrs() {
+			if network.Contains(ip) {
 				return true
 			}
 		}
 	}
-
 	return false
 }
 
+// parseIP parses an IPv4 or IPv6 literal, with or without brackets
+func parseIP(s string) net.IP {
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+}
+
 // matchGlob performs glob pattern matching (similar to SQLite GLOB)
 func (d *DatabaseService) matchGlob(text, pattern string) (bool, error) {
 	// Convert glob pattern to regex
@@ -216,38 +409,79 @@ func (d *DatabaseService) BlockDomain(domain string) bool {
 
 // BlockDomainWithType blocks a domain with a specific filter type
 func (d *DatabaseService) BlockDomainWithType(domain string, filterType string) bool {
+	return d.BlockDomainForApp(domain, filterType, "")
+}
+
+// BlockDomainForApp adds a rule that only applies to connections from app,
+// given as a process name or executable path. An empty app blocks for everyone.
+func (d *DatabaseService) BlockDomainForApp(domain, filterType, app string) bool {
+	return d.SaveRule(BlockedDomainInfo{Domain: domain, FilterType: filterType, App: app, Action: ActionBlock})
+}
+
+// SaveRule adds a rule, or replaces the action, ports and expiry of the rule
+// with the same pattern and app. An empty action blocks.
+func (d *DatabaseService) SaveRule(rule BlockedDomainInfo) bool {
 	if d == nil || d.Db == nil {
 		return false
 	}
-	domain = strings.TrimSpace(domain)
+	domain := strings.TrimSpace(rule.Domain)
 	if domain == "" {
 		return false
 	}
 
-	// Validate filter type
-	if filterType != "exact" && filterType != "glob" && filterType != "regex" {
+	// Validate the pattern for its filter type; unknown types are exact
+	filterType := rule.FilterType
+	switch filterType {
+	case "regex":
+		if _, err := regexp.Compile(domain); err != nil {
+			log.Printf("Invalid regex pattern %q: %v", domain, err)
+			return false
+		}
+	case "ip":
+		ip := parseIP(domain)
+		if ip == nil {
+			log.Printf("Invalid IP address %q", domain)
+			return false
+		}
+		domain = ip.String()
+	case "cidr":
+		_, network, err := net.ParseCIDR(domain)
+		if err != nil {
+			log.Printf("Invalid CIDR range %q: %v", domain, err)
+			return false
+		}
+		domain = network.String()
+	case "glob":
+		domain = strings.ToLower(domain)
+	default:
 		filterType = "exact"
+		domain = strings.ToLower(domain)
 	}
 
-	// For exact and glob, convert to lowercase
-	if filterType == "exact" || filterType == "glob" {
-		domain = strings.ToLower(domain)
+	action := rule.Action
+	if action == "" {
+		action = ActionBlock
+	}
+	if !ValidAction(action) {
+		log.Printf("Invalid rule action %q", action)
+		return false
 	}
 
-	// Validate regex pattern if filter type is regex
-	if filterType == "regex" {
-		if _, err := regexp.Compile(domain); err != nil {
-			log.Printf("Invalid regex pattern %q: %v", domain, err)
-			return false
-		}
+	ports, err := ParsePorts(rule.Ports)
+	if err != nil {
+		log.Printf("Invalid ports for %q: %v", domain, err)
+		return false
 	}
 
-	createStmt := `INSERT OR IGNORE INTO blocked_domains (domain, filter_type) VALUES (?, ?)`
+	upsertStmt := `INSERT INTO blocked_domains (domain, filter_type, app, action, ports, expires_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(domain, app) DO UPDATE SET
+			filter_type = excluded.filter_type, action = excluded.action, ports = excluded.ports, expires_at = excluded.expires_at`
 
-	if _, err := d.Db.Exec(createStmt, domain, filterType); err != nil {
+	if _, err := d.Db.Exec(upsertStmt, domain, filterType, strings.TrimSpace(rule.App), action, ports, rule.ExpiresAt); err != nil {
 		log.Printf("DB error adding domain %q with type %s: %v", domain, filterType, err)
 		return false
 	}
+	d.notifyRulesChanged()
 	return true
 }
 
@@ -261,6 +495,7 @@ func (d *DatabaseService) BlockGlobPattern(pattern string) bool {
 	return d.BlockDomainWithType(pattern, "glob")
 }
 
+// UnblockDomain removes every rule for domain, global and app-scoped
 func (d *DatabaseService) UnblockDomain(domain string) bool {
 	if d == nil || d.Db == nil {
 		return false
@@ -274,6 +509,25 @@ func (d *DatabaseService) UnblockDomain(domain string) bool {
 		log.Printf("DB error removing domain %q: %v", domain, err)
 		return false
 	}
+	d.notifyRulesChanged()
+	return true
+}
+
+// UnblockDomainForApp removes only the rule for domain scoped to app ("" for the global rule)
+func (d *DatabaseService) UnblockDomainForApp(domain, app string) bool {
+	if d == nil || d.Db == nil {
+		return false
+	}
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if domain == "" {
+		return false
+	}
+	deleteStmt := `DELETE FROM blocked_domains WHERE domain = ? AND app = ?`
+	if _, err := d.Db.Exec(deleteStmt, domain, strings.TrimSpace(app)); err != nil {
+		log.Printf("DB error removing domain %q for app %q: %v", domain, app, err)
+		return false
+	}
+	d.notifyRulesChanged()
 	return true
 }
 
@@ -282,7 +536,7 @@ func (d *DatabaseService) ListBlockedDomains(domain string) []string {
 		return []string{}
 	}
 
-	listStmt := `SELECT domain FROM blocked_domains ORDER BY created_at DESC`
+	listStmt := `SELECT domain FROM blocked_domains WHERE action = 'block' ORDER BY created_at DESC`
 
 	rows, err := d.Db.Query(listStmt)
 	if err != nil {
@@ -302,22 +556,48 @@ func (d *DatabaseService) ListBlockedDomains(domain string) []string {
 	return domains
 }
 
-// BlockedDomainInfo represents a blocked domain with its filter type
+// Rule actions
+const (
+	ActionBlock = "block"
+	ActionAllow = "allow"
+	// ActionLog is a dry run: matching requests pass but are logged as would_reject
+	ActionLog = "log"
+)
+
+// ValidAction reports whether action is one of the rule actions
+func ValidAction(action string) bool {
+	return action == ActionBlock || action == ActionAllow || action == ActionLog
+}
+
+// BlockedDomainInfo represents a rule: a domain pattern with its filter type and action
 type BlockedDomainInfo struct {
-	Domain     string `json:"domain"`
+	Domain string `json:"domain"`
+	// FilterType is exact, glob or regex for hostnames, or ip or cidr for
+	// an address or range of addresses
 	FilterType string `json:"filterType"`
-	CreatedAt  string `json:"createdAt"`
+	// App limits the rule to one application; empty applies to all
+	App string `json:"app"`
+	// Action is ActionBlock, ActionAllow or ActionLog
+	Action string `json:"action"`
+	// Ports limits the rule to ports and port ranges, e.g. "22,8000-8999";
+	// empty applies to every port
+	Ports string `json:"ports"`
+	// ExpiresAt is when a temporary rule stops applying, in unix milliseconds; 0 never expires
+	ExpiresAt int64  `json:"expiresAt"`
+	CreatedAt string `json:"createdAt"`
 }
 
-// ListBlockedDomainsWithInfo returns blocked domains with their filter types
+// ListBlockedDomainsWithInfo returns the active rules with their filter types and actions
 func (d *DatabaseService) ListBlockedDomainsWithInfo() []BlockedDomainInfo {
 	if d == nil || d.Db == nil {
 		return []BlockedDomainInfo{}
 	}
 
-	listStmt := `SELECT domain, filter_type, created_at FROM blocked_domains ORDER BY created_at DESC`
+	listStmt := `SELECT domain, filter_type, app, action, ports, expires_at, created_at FROM blocked_domains
+		WHERE expires_at = 0 OR expires_at > ?
+		ORDER BY created_at DESC`
 
-	rows, err := d.Db.Query(listStmt)
+	rows, err := d.Db.Query(listStmt, time.Now().UnixMilli())
 	if err != nil {
 		log.Printf("DB error listing blocked domains with info: %v", err)
 		return []BlockedDomainInfo{}
@@ -326,14 +606,19 @@ func (d *DatabaseService) ListBlockedDomainsWithInfo() []BlockedDomainInfo {
 
 	var domains []BlockedDomainInfo
 	for rows.Next() {
-		var domain, filterType, createdAt string
-		if err := rows.Scan(&domain, &filterType, &createdAt); err != nil {
+		var domain, filterType, app, action, ports, createdAt string
+		var expiresAt int64
+		if err := rows.Scan(&domain, &filterType, &app, &action, &ports, &expiresAt, &createdAt); err != nil {
 			log.Printf("DB error scanning blocked domains: %v", err)
 			continue
 		}
 		domains = append(domains, BlockedDomainInfo{
 			Domain:     domain,
 			FilterType: filterType,
+			App:        app,
+			Action:     action,
+			Ports:      ports,
+			ExpiresAt:  expiresAt,
 			CreatedAt:  createdAt,
 		})
 	}
@@ -1,10 +1,14 @@
 package db_service
 
 import (
+	"database/sql"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestNewDBService(t *testing.T) {
@@ -357,6 +361,333 @@ func TestDatabaseService_ConcurrentAccess(t *testing.T) {
 	}
 }
 
+func TestDatabaseService_Settings(t *testing.T) {
+	service := setupTestService(t)
+	defer service.ServiceShutdown()
+
+	if _, ok := service.GetSetting("missing"); ok {
+		t.Fatal("Unset setting should not be found")
+	}
+	if !service.SetSetting("retention", "a") || !service.SetSetting("retention", "b") {
+		t.Fatal("Failed to write setting")
+	}
+	if value, ok := service.GetSetting("retention"); !ok || value != "b" {
+		t.Fatalf("Expected updated value %q, got %q (found %v)", "b", value, ok)
+	}
+}
+
+func TestDatabaseService_AppScopedRules(t *testing.T) {
+	service := setupTestService(t)
+	defer service.ServiceShutdown()
+
+	if !service.BlockDomainForApp("tracker.com", "exact", "/usr/bin/curl") || !service.BlockDomainForApp("tracker.com", "exact", "firefox") {
+		t.Fatal("Failed to add app rules")
+	}
+
+	if _, blocked := service.MatchDomain("tracker.com"); blocked {
+		t.Fatal("App rules should not apply without a process")
+	}
+	if _, blocked := service.Match(MatchTarget{Domain: "tracker.com", ProcessName: "wget", ProcessPath: "/usr/bin/wget"}); blocked {
+		t.Fatal("App rule should not apply to other apps")
+	}
+	if rule, blocked := service.Match(MatchTarget{Domain: "tracker.com", ProcessName: "curl", ProcessPath: "/usr/bin/curl"}); !blocked || rule.App != "/usr/bin/curl" {
+		t.Fatalf("Expected the curl rule to match by path, got %+v (blocked %v)", rule, blocked)
+	}
+	if _, blocked := service.Match(MatchTarget{Domain: "tracker.com", ProcessName: "firefox", ProcessPath: "/opt/firefox/firefox"}); !blocked {
+		t.Fatal("Expected the firefox rule to match by name")
+	}
+
+	if !service.UnblockDomainForApp("tracker.com", "firefox") {
+		t.Fatal("Failed to remove app rule")
+	}
+	if rules := service.ListBlockedDomainsWithInfo(); len(rules) != 1 || rules[0].App != "/usr/bin/curl" {
+		t.Fatalf("Expected only the curl rule to remain, got %+v", rules)
+	}
+}
+
+func TestDatabaseService_AllowAndTemporaryRules(t *testing.T) {
+	service := setupTestService(t)
+	defer service.ServiceShutdown()
+
+	service.BlockGlobPattern("*.example.com")
+	service.SaveRule(BlockedDomainInfo{Domain: "api.example.com", App: "curl", Action: ActionAllow})
+	service.SaveRule(BlockedDomainInfo{Domain: "old.com", Action: ActionAllow, ExpiresAt: time.Now().Add(-time.Minute).UnixMilli()})
+
+	// The app-scoped allow rule beats the global block rule
+	if rule, found := service.FindRule(MatchTarget{Domain: "api.example.com", ProcessName: "curl"}); !found || rule.Action != ActionAllow {
+		t.Fatalf("Expected the app allow rule, got %+v (found %v)", rule, found)
+	}
+	if _, blocked := service.MatchDomain("api.example.com"); !blocked {
+		t.Fatal("Other clients should still be blocked")
+	}
+	if _, found := service.FindRule(MatchTarget{Domain: "old.com"}); found {
+		t.Fatal("Expired rules should be ignored")
+	}
+
+	// Saving the same pattern again replaces its action
+	service.SaveRule(BlockedDomainInfo{Domain: "api.example.com", App: "curl", Action: ActionBlock})
+	if _, blocked := service.Match(MatchTarget{Domain: "api.example.com", ProcessName: "curl"}); !blocked {
+		t.Fatal("Expected the updated rule to block")
+	}
+	if len(service.ListBlockedDomainsWithInfo()) != 2 {
+		t.Fatalf("Expected 2 active rules, got %+v", service.ListBlockedDomainsWithInfo())
+	}
+}
+
+func TestDatabaseService_LogOnlyRules(t *testing.T) {
+	service := setupTestService(t)
+	defer service.ServiceShutdown()
+
+	service.SaveRule(BlockedDomainInfo{Domain: "*.ads.com", FilterType: "glob", Action: ActionLog})
+	service.SaveRule(BlockedDomainInfo{Domain: "ok.ads.com", Action: ActionAllow})
+	service.BlockDomain("bad.ads.com")
+
+	if service.IsDomainBlocked("tracker.ads.com") {
+		t.Fatal("Log-only rules must not block")
+	}
+	if rule, found := service.FindRule(MatchTarget{Domain: "tracker.ads.com"}); !found || rule.Action != ActionLog {
+		t.Fatalf("Expected the log-only rule, got %+v (found %v)", rule, found)
+	}
+	// A log-only rule reports what a block rule would do, so it beats an allow rule
+	if rule, _ := service.FindRule(MatchTarget{Domain: "ok.ads.com"}); rule.Action != ActionLog {
+		t.Fatalf("Expected the log-only rule to win over allow, got %+v", rule)
+	}
+	if !service.IsDomainBlocked("bad.ads.com") {
+		t.Fatal("Block rules should still win over log-only rules")
+	}
+	if service.SaveRule(BlockedDomainInfo{Domain: "x.com", Action: "maybe"}) {
+		t.Fatal("Unknown actions should be rejected")
+	}
+}
+
+func TestDatabaseService_IPRules(t *testing.T) {
+	service := setupTestService(t)
+	defer service.ServiceShutdown()
+
+	if !service.BlockDomainWithType("[2001:DB8::1]", "ip") || !service.BlockDomainWithType("10.1.2.3/8", "cidr") {
+		t.Fatal("Failed to add IP rules")
+	}
+	if service.BlockDomainWithType("not-an-ip", "ip") || service.BlockDomainWithType("10.0.0.0/33", "cidr") {
+		t.Fatal("Invalid addresses should be rejected")
+	}
+
+	for domain, want := range map[string]bool{
+		"2001:db8::1":   true,
+		"[2001:db8::1]": true,
+		"2001:db8::2":   false,
+		"10.200.0.1":    true,
+		"11.0.0.1":      false,
+		"10.example":    false,
+	} {
+		if got := service.IsDomainBlocked(domain); got != want {
+			t.Errorf("IsDomainBlocked(%q) = %v, want %v", domain, got, want)
+		}
+	}
+
+	// Patterns are stored normalised
+	rule, _ := service.MatchDomain("10.0.0.1")
+	if rule.Domain != "10.0.0.0/8" {
+		t.Fatalf("Expected the normalised range, got %q", rule.Domain)
+	}
+
+	// Hostnames match through their resolved addresses only when asked to
+	resolved := 0
+	target := MatchTarget{Domain: "internal.example", Resolve: func() []net.IP {
+		resolved++
+		return []net.IP{net.ParseIP("10.9.9.9")}
+	}}
+	if _, blocked := service.Match(target); !blocked || resolved != 1 {
+		t.Fatalf("Expected a match through the resolved address after one lookup, got %v after %d", blocked, resolved)
+	}
+	if service.IsDomainBlocked("internal.example") {
+		t.Fatal("Hostnames should not match IP rules without a resolver")
+	}
+}
+
+func TestDatabaseService_PortRules(t *testing.T) {
+	service := setupTestService(t)
+	defer service.ServiceShutdown()
+
+	if !service.SaveRule(BlockedDomainInfo{Domain: "example.com", Ports: " 22, 8000-8999 "}) {
+		t.Fatal("Failed to add port rule")
+	}
+	if service.SaveRule(BlockedDomainInfo{Domain: "bad.com", Ports: "0"}) || service.SaveRule(BlockedDomainInfo{Domain: "bad.com", Ports: "90-80"}) {
+		t.Fatal("Invalid ports should be rejected")
+	}
+	if rules := service.ListBlockedDomainsWithInfo(); len(rules) != 1 || rules[0].Ports != "22,8000-8999" {
+		t.Fatalf("Expected normalised ports, got %+v", rules)
+	}
+
+	for port, want := range map[int]bool{22: true, 8080: true, 443: false, 0: false} {
+		if _, blocked := service.Match(MatchTarget{Domain: "example.com", Port: port}); blocked != want {
+			t.Errorf("Match(example.com:%d) = %v, want %v", port, blocked, want)
+		}
+	}
+}
+
+func TestPolicy_PortAllowed(t *testing.T) {
+	policy := DefaultPolicy
+	if !policy.PortAllowed(443) || !policy.PortAllowed(80) || policy.PortAllowed(22) {
+		t.Fatal("Expected only 80 and 443 by default")
+	}
+	if !policy.SocksPortAllowed(22) || !policy.SocksPortAllowed(5432) {
+		t.Fatal("Expected SOCKS5 to allow every port by default")
+	}
+	policy.AllowedPorts = "1-65535"
+	if !policy.PortAllowed(22) {
+		t.Fatal("Expected every port to be allowed")
+	}
+	policy.AllowedPorts = "443"
+	if policy.SocksPortAllowed(22) || !policy.SocksPortAllowed(443) {
+		t.Fatal("Expected configured ports to restrict SOCKS5 as well")
+	}
+}
+
+func TestDatabaseService_ProxyUsers(t *testing.T) {
+	service := setupTestService(t)
+	defer service.ServiceShutdown()
+
+	if service.SetProxyUser("bad:name", "secret") || service.SetProxyUser("alice", "") {
+		t.Fatal("Invalid users should be rejected")
+	}
+	if !service.SetProxyUser("alice", "secret") {
+		t.Fatal("Failed to add user")
+	}
+	var stored string
+	if err := service.Db.QueryRow(`SELECT password_hash FROM proxy_users WHERE username = 'alice'`).Scan(&stored); err != nil || strings.Contains(stored, "secret") {
+		t.Fatalf("Expected a password hash, got %q (%v)", stored, err)
+	}
+
+	// The second check is answered from the cache
+	if !service.CheckProxyUser("alice", "secret") || !service.CheckProxyUser("alice", "secret") {
+		t.Fatal("Expected the password to match")
+	}
+	if service.CheckProxyUser("alice", "wrong") || service.CheckProxyUser("bob", "secret") {
+		t.Fatal("Expected wrong credentials to fail")
+	}
+
+	service.SetProxyUser("alice", "changed")
+	if service.CheckProxyUser("alice", "secret") || !service.CheckProxyUser("alice", "changed") {
+		t.Fatal("Expected only the new password to match")
+	}
+	if users := service.ListProxyUsers(); len(users) != 1 || users[0].Username != "alice" {
+		t.Fatalf("Unexpected users: %+v", users)
+	}
+	service.DeleteProxyUser("alice")
+	if service.CheckProxyUser("alice", "changed") {
+		t.Fatal("Deleted users should not authenticate")
+	}
+}
+
+func TestDatabaseService_RemembersRejectedCredentials(t *testing.T) {
+	service := setupTestService(t)
+	defer service.ServiceShutdown()
+
+	service.SetProxyUser("alice", "secret")
+	if service.CheckProxyUser("alice", "wrong") || service.CheckProxyUser("bob", "secret") {
+		t.Fatal("Expected wrong credentials to fail")
+	}
+	if len(service.rejected) != 2 {
+		t.Fatalf("Expected both failures to be remembered, got %d", len(service.rejected))
+	}
+
+	// A remembered failure is refused without looking at the stored hash
+	if _, err := service.Db.Exec(`UPDATE proxy_users SET password_hash = 'invalid' WHERE username = 'alice'`); err != nil {
+		t.Fatal(err)
+	}
+	if service.CheckProxyUser("alice", "wrong") {
+		t.Fatal("Expected the remembered failure to be refused")
+	}
+
+	// Adding the user makes the remembered failure stale
+	if !service.SetProxyUser("bob", "secret") || !service.CheckProxyUser("bob", "secret") {
+		t.Fatal("Expected a new user to authenticate after an earlier failure")
+	}
+}
+
+func TestDatabaseService_PolicyLearning(t *testing.T) {
+	service := setupTestService(t)
+	defer service.ServiceShutdown()
+
+	if service.ApplyPolicy("a.com") {
+		t.Fatal("The default policy should allow unknown hosts")
+	}
+	if service.SetPolicy(Policy{DefaultAction: "maybe"}) {
+		t.Fatal("Expected an invalid default action to be rejected")
+	}
+
+	learning := Policy{DefaultAction: ActionBlock, LearningUntil: time.Now().Add(time.Hour).UnixMilli()}
+	if !service.SetPolicy(learning) {
+		t.Fatal("Failed to save policy")
+	}
+	for _, host := range []string{"a.com", "b.com", "A.com"} {
+		if service.ApplyPolicy(host) {
+			t.Fatalf("%s should pass while learning", host)
+		}
+	}
+	candidates := service.ListCandidates()
+	if len(candidates) != 2 || candidates[0].Host != "a.com" || candidates[0].Hits != 2 {
+		t.Fatalf("Unexpected candidates: %+v", candidates)
+	}
+
+	if n := service.ApproveCandidates([]string{"a.com"}); n != 1 {
+		t.Fatalf("Expected 1 approved candidate, got %d", n)
+	}
+	if rule, found := service.FindRule(MatchTarget{Domain: "a.com"}); !found || rule.Action != ActionAllow {
+		t.Fatalf("Expected an allow rule for a.com, got %+v", rule)
+	}
+	if candidates := service.ListCandidates(); len(candidates) != 1 || candidates[0].Host != "b.com" {
+		t.Fatalf("Expected only b.com to remain, got %+v", candidates)
+	}
+
+	// Once learning ends only allowed hosts pass
+	service.SetPolicy(Policy{DefaultAction: ActionBlock})
+	if !service.ApplyPolicy("b.com") {
+		t.Fatal("Unknown hosts should be blocked after learning")
+	}
+}
+
+func TestNewDBService_MigratesRules(t *testing.T) {
+	tempDir := t.TempDir()
+	service := setupLegacyDB(t, tempDir)
+	if _, err := service.Exec(`INSERT INTO blocked_domains (domain, filter_type) VALUES ('old.com', 'glob')`); err != nil {
+		t.Fatal(err)
+	}
+	service.Close()
+
+	migrated, err := NewDBService(tempDir)
+	if err != nil {
+		t.Fatalf("NewDBService failed: %v", err)
+	}
+	defer migrated.ServiceShutdown()
+
+	rules := migrated.ListBlockedDomainsWithInfo()
+	if len(rules) != 1 || rules[0].Domain != "old.com" || rules[0].FilterType != "glob" || rules[0].App != "" {
+		t.Fatalf("Rule not migrated: %+v", rules)
+	}
+	var version int
+	if err := migrated.Db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil || version != len(migrations) {
+		t.Fatalf("Expected schema version %d, got %d (%v)", len(migrations), version, err)
+	}
+}
+
+// setupLegacyDB creates a database with the rules table from before migrations existed
+func setupLegacyDB(t *testing.T, dir string) *sql.DB {
+	db, err := sql.Open("sqlite", filepath.Join(dir, "local-proxy.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`CREATE TABLE blocked_domains (
+		domain TEXT PRIMARY KEY,
+		filter_type TEXT DEFAULT 'exact' CHECK(filter_type IN ('exact', 'glob', 'regex')),
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
 // Helper function to set up a test service
 func setupTestService(t *testing.T) *DatabaseService {
 	tempDir := t.TempDir()
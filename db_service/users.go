@@ -0,0 +1,233 @@
+package db_service
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Password hashing parameters. Stored hashes record their own iteration
+// count, so raising it only affects passwords set afterwards.
+const (
+	passwordIterations = 600000
+	passwordSaltSize   = 16
+	passwordKeySize    = 32
+	passwordScheme     = "pbkdf2-sha256"
+)
+
+const (
+	// rejectedTTL is how long a wrong password is remembered, so repeating it
+	// costs a map lookup instead of a key derivation
+	rejectedTTL = 10 * time.Minute
+	// maxRejected bounds the number of remembered wrong passwords
+	maxRejected = 4096
+)
+
+// dummyHash is checked for unknown users, so they take as long to refuse as
+// a wrong password
+var dummyHash = sync.OnceValue(func() string {
+	hash, _ := hashPassword("local-proxy")
+	return hash
+})
+
+// ProxyUser is an account allowed to use the proxy when authentication is required
+type ProxyUser struct {
+	Username  string `json:"username"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// SetProxyUser adds a user, or changes the password of an existing one
+func (d *DatabaseService) SetProxyUser(username, password string) bool {
+	if d == nil || d.Db == nil {
+		return false
+	}
+	username = strings.TrimSpace(username)
+	// The SOCKS5 handshake limits both to 255 bytes; HTTP basic auth splits on ':'
+	if username == "" || len(username) > 255 || strings.Contains(username, ":") || password == "" || len(password) > 255 {
+		log.Printf("Invalid proxy user %q", username)
+		return false
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		log.Printf("Failed to hash password for %q: %v", username, err)
+		return false
+	}
+	upsertStmt := `INSERT INTO proxy_users (username, password_hash) VALUES (?, ?)
+		ON CONFLICT(username) DO UPDATE SET password_hash = excluded.password_hash`
+	if _, err := d.Db.Exec(upsertStmt, username, hash); err != nil {
+		log.Printf("DB error saving proxy user %q: %v", username, err)
+		return false
+	}
+	d.forgetVerified()
+	return true
+}
+
+// DeleteProxyUser removes a user
+func (d *DatabaseService) DeleteProxyUser(username string) bool {
+	if d == nil || d.Db == nil {
+		return false
+	}
+	if _, err := d.Db.Exec(`DELETE FROM proxy_users WHERE username = ?`, strings.TrimSpace(username)); err != nil {
+		log.Printf("DB error removing proxy user %q: %v", username, err)
+		return false
+	}
+	d.forgetVerified()
+	return true
+}
+
+// forgetVerified drops the remembered passwords after the users change
+func (d *DatabaseService) forgetVerified() {
+	d.authMu.Lock()
+	d.verified = nil
+	d.rejected = nil
+	d.authMu.Unlock()
+}
+
+// ListProxyUsers returns the users ordered by name, without their password hashes
+func (d *DatabaseService) ListProxyUsers() []ProxyUser {
+	if d == nil || d.Db == nil {
+		return []ProxyUser{}
+	}
+	rows, err := d.Db.Query(`SELECT username, created_at FROM proxy_users ORDER BY username`)
+	if err != nil {
+		log.Printf("DB error listing proxy users: %v", err)
+		return []ProxyUser{}
+	}
+	defer rows.Close()
+
+	users := []ProxyUser{}
+	for rows.Next() {
+		var u ProxyUser
+		if err := rows.Scan(&u.Username, &u.CreatedAt); err != nil {
+			log.Printf("DB error scanning proxy user: %v", err)
+			continue
+		}
+		users = append(users, u)
+	}
+	return users
+}
+
+// CheckProxyUser reports whether password is correct for username. Clients
+// send their credentials with every request, so a password that matched is
+// remembered for its stored hash; changing the password replaces the hash.
+// Wrong passwords and unknown users are remembered for a while as well, so
+// repeating them does not cost another key derivation.
+func (d *DatabaseService) CheckProxyUser(username, password string) bool {
+	if d == nil || d.Db == nil {
+		return false
+	}
+	attempt := sha256.Sum256([]byte(username + "\x00" + password))
+	if d.recentlyRejected(attempt) {
+		return false
+	}
+
+	var stored string
+	err := d.Db.QueryRow(`SELECT password_hash FROM proxy_users WHERE username = ?`, username).Scan(&stored)
+	if errors.Is(err, sql.ErrNoRows) {
+		verifyPassword(dummyHash(), password)
+		d.reject(attempt)
+		return false
+	}
+	if err != nil {
+		log.Printf("DB error checking proxy user %q: %v", username, err)
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(password))
+	d.authMu.Lock()
+	cached, ok := d.verified[stored]
+	d.authMu.Unlock()
+	if ok {
+		return subtle.ConstantTimeCompare(cached[:], sum[:]) == 1
+	}
+
+	if !verifyPassword(stored, password) {
+		d.reject(attempt)
+		return false
+	}
+	d.authMu.Lock()
+	if d.verified == nil {
+		d.verified = make(map[string][sha256.Size]byte)
+	}
+	d.verified[stored] = sum
+	d.authMu.Unlock()
+	return true
+}
+
+// recentlyRejected reports whether the credentials failed within rejectedTTL
+func (d *DatabaseService) recentlyRejected(attempt [sha256.Size]byte) bool {
+	d.authMu.Lock()
+	defer d.authMu.Unlock()
+	at, ok := d.rejected[attempt]
+	return ok && time.Since(at) < rejectedTTL
+}
+
+// reject remembers credentials that failed
+func (d *DatabaseService) reject(attempt [sha256.Size]byte) {
+	d.authMu.Lock()
+	defer d.authMu.Unlock()
+	if d.rejected == nil {
+		d.rejected = make(map[[sha256.Size]byte]time.Time)
+	}
+	if len(d.rejected) >= maxRejected {
+		for key, at := range d.rejected {
+			if time.Since(at) >= rejectedTTL {
+				delete(d.rejected, key)
+			}
+		}
+		if len(d.rejected) >= maxRejected {
+			d.rejected = make(map[[sha256.Size]byte]time.Time)
+		}
+	}
+	d.rejected[attempt] = time.Now()
+}
+
+// hashPassword returns password hashed with a random salt, as
+// pbkdf2-sha256$iterations$salt$key with base64 salt and key
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, passwordKeySize)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s$%d$%s$%s", passwordScheme, passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// verifyPassword reports whether password matches a hash from hashPassword
+func verifyPassword(stored, password string) bool {
+	parts := strings.Split(stored, "$")
+	if len(parts) != 4 || parts[0] != passwordScheme {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(want))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, want) == 1
+}
@@ -0,0 +1,106 @@
+package dns_service
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	maxCacheEntries = 10000
+	maxCacheTTL     = time.Hour
+)
+
+type cacheEntry struct {
+	resp    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+// dnsCache holds upstream responses keyed by question until their TTL expires
+type dnsCache struct {
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+func newDNSCache() *dnsCache {
+	return &dnsCache{entries: make(map[string]cacheEntry)}
+}
+
+// cacheKey identifies a question independent of the query ID
+func cacheKey(q dnsmessage.Question) string {
+	return strings.ToLower(q.Name.String()) + "/" + q.Type.String() + "/" + q.Class.String()
+}
+
+// get returns a copy of the cached response so callers may rewrite its ID.
+// Its TTLs are lowered by the time it spent in the cache.
+func (c *dnsCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	now := time.Now()
+	if ok && now.After(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	return ageResponse(entry.resp, now.Sub(entry.stored)), true
+}
+
+// ageResponse returns a copy of resp with every TTL lowered by age
+func ageResponse(resp []byte, age time.Duration) []byte {
+	elapsed := uint32(age / time.Second)
+	if elapsed == 0 {
+		return append([]byte(nil), resp...)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return append([]byte(nil), resp...)
+	}
+	for _, section := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for i := range section {
+			// The OPT pseudo-record keeps EDNS flags in its TTL
+			if section[i].Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			section[i].Header.TTL -= min(section[i].Header.TTL, elapsed)
+		}
+	}
+	aged, err := msg.Pack()
+	if err != nil {
+		return append([]byte(nil), resp...)
+	}
+	return aged
+}
+
+func (c *dnsCache) put(key string, resp []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= maxCacheEntries {
+		c.evictLocked()
+	}
+	now := time.Now()
+	c.entries[key] = cacheEntry{
+		resp:    append([]byte(nil), resp...),
+		stored:  now,
+		expires: now.Add(min(ttl, maxCacheTTL)),
+	}
+}
+
+// evictLocked removes expired entries, or everything if none have expired
+func (c *dnsCache) evictLocked() {
+	now := time.Now()
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	if len(c.entries) >= maxCacheEntries {
+		c.entries = make(map[string]cacheEntry)
+	}
+}
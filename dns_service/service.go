@@ -0,0 +1,473 @@
+package dns_service
+
+import (
+	"changeme/db_service"
+	"changeme/logging_service"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wailsapp/wails/v3/pkg/application"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// 5353 is taken by mDNS responders on most systems
+	DEFAULT_LISTEN_ADDR = "127.0.0.1:30053"
+	DEFAULT_UPSTREAM    = "1.1.1.1:53"
+)
+
+// Answers given for blocked names
+const (
+	BlockModeNull     = "null"     // 0.0.0.0 for A, :: for AAAA
+	BlockModeNXDomain = "nxdomain" // NXDOMAIN for every type
+)
+
+const (
+	upstreamTimeout = 5 * time.Second
+	tcpIdleTimeout  = 10 * time.Second
+	blockedTTL      = 60
+	maxUDPSize      = 4096
+)
+
+// DNSService is a local DNS sinkhole. Names matched by the DatabaseService
+// rules are answered locally, everything else is forwarded to Upstream and
+// cached. Every query is written to the requests log with the DNS method.
+type DNSService struct {
+	ctx     context.Context
+	options application.ServiceOptions
+
+	// ListenAddr is the address the UDP and TCP listeners bind to.
+	// When empty, the saved DNSSettings decide whether the server runs.
+	ListenAddr string
+	// Upstream is the resolver non-blocked queries are forwarded to.
+	Upstream string
+	// BlockMode selects how blocked names are answered (BlockModeNull or BlockModeNXDomain).
+	BlockMode string
+
+	// DbService and LoggingService are used for policy decisions and query
+	// logging. When nil, the package singletons are used instead.
+	DbService      *db_service.DatabaseService
+	LoggingService *logging_service.LoggingService
+
+	mu          sync.Mutex // guards the listeners across Start, Stop and SetDNSSettings
+	udpConn     net.PacketConn
+	tcpListener net.Listener
+	cache       *dnsCache
+	// wg tracks the serving goroutines and every query handler, so Stop
+	// returns once nothing answers on the old listeners anymore
+	wg sync.WaitGroup
+
+	// tcpConns are the open TCP clients, closed by Stop
+	connMu   sync.Mutex
+	tcpConns map[net.Conn]struct{}
+}
+
+// singleton instance for easy access from other services
+var instance *DNSService
+
+func Instance() *DNSService { return instance }
+
+func (d *DNSService) ServiceName() string { return "dns_service" }
+
+// ServiceStartup starts the DNS listeners when ListenAddr is configured
+func (d *DNSService) ServiceStartup(ctx context.Context, options application.ServiceOptions) error {
+	if instance != nil {
+		log.Printf("DNS Service already started")
+		return nil
+	}
+	instance = d
+	d.ctx = ctx
+	d.options = options
+
+	if d.ListenAddr == "" {
+		settings := d.GetDNSSettings()
+		if !settings.Enabled {
+			return nil
+		}
+		d.ListenAddr = settings.ListenAddr
+	}
+	if err := d.Start(); err != nil {
+		// The proxy keeps working without the sinkhole, so don't abort startup
+		log.Printf("DNS Service init error: %v", err)
+	}
+	return nil
+}
+
+// ServiceShutdown stops the listeners and waits for in-flight queries
+func (d *DNSService) ServiceShutdown() error {
+	d.Stop()
+	return nil
+}
+
+// Start binds the UDP and TCP listeners and begins serving queries.
+func (d *DNSService) Start() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.start()
+}
+
+func (d *DNSService) start() error {
+	if d.udpConn != nil {
+		return fmt.Errorf("DNS sinkhole already listening on %s", d.ListenAddr)
+	}
+	if d.Upstream == "" {
+		d.Upstream = DEFAULT_UPSTREAM
+	}
+	if d.BlockMode == "" {
+		d.BlockMode = BlockModeNull
+	}
+	d.cache = newDNSCache()
+
+	udpConn, err := net.ListenPacket("udp", d.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on udp %s: %w", d.ListenAddr, err)
+	}
+	tcpListener, err := net.Listen("tcp", d.ListenAddr)
+	if err != nil {
+		_ = udpConn.Close()
+		return fmt.Errorf("failed to listen on tcp %s: %w", d.ListenAddr, err)
+	}
+	d.udpConn = udpConn
+	d.tcpListener = tcpListener
+
+	d.wg.Add(2)
+	go d.serveUDP(udpConn)
+	go d.serveTCP(tcpListener)
+
+	log.Printf("DNS sinkhole listening on %s (upstream %s)", d.ListenAddr, d.Upstream)
+	return nil
+}
+
+// Stop closes the listeners and waits for the serving goroutines to exit.
+func (d *DNSService) Stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stop()
+}
+
+func (d *DNSService) stop() {
+	if d.udpConn != nil {
+		_ = d.udpConn.Close()
+	}
+	if d.tcpListener != nil {
+		_ = d.tcpListener.Close()
+	}
+	d.connMu.Lock()
+	for conn := range d.tcpConns {
+		_ = conn.Close()
+	}
+	d.connMu.Unlock()
+	d.wg.Wait()
+	d.udpConn, d.tcpListener = nil, nil
+}
+
+// db returns the DatabaseService used for policy decisions
+func (d *DNSService) db() *db_service.DatabaseService {
+	if d.DbService != nil {
+		return d.DbService
+	}
+	return db_service.Instance()
+}
+
+// logger returns the LoggingService used to record queries
+func (d *DNSService) logger() *logging_service.LoggingService {
+	if d.LoggingService != nil {
+		return d.LoggingService
+	}
+	return logging_service.Instance()
+}
+
+// serveUDP answers queries received on the UDP socket
+func (d *DNSService) serveUDP(udpConn net.PacketConn) {
+	defer d.wg.Done()
+
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, addr, err := udpConn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("DNS udp read error: %v", err)
+			continue
+		}
+		query := append([]byte(nil), buf[:n]...)
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			resp, err := d.handleQuery(query)
+			if err != nil {
+				log.Printf("DNS query from %s failed: %v", addr, err)
+				return
+			}
+			if _, err := udpConn.WriteTo(resp, addr); err != nil {
+				log.Printf("DNS udp write error: %v", err)
+			}
+		}()
+	}
+}
+
+// serveTCP accepts TCP clients and answers length-prefixed queries
+func (d *DNSService) serveTCP(tcpListener net.Listener) {
+	defer d.wg.Done()
+
+	for {
+		conn, err := tcpListener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("DNS tcp accept error: %v", err)
+			continue
+		}
+		d.connMu.Lock()
+		if d.tcpConns == nil {
+			d.tcpConns = make(map[net.Conn]struct{})
+		}
+		d.tcpConns[conn] = struct{}{}
+		d.connMu.Unlock()
+		d.wg.Add(1)
+		go d.handleTCPConn(conn)
+	}
+}
+
+func (d *DNSService) handleTCPConn(conn net.Conn) {
+	defer d.wg.Done()
+	defer func() {
+		d.connMu.Lock()
+		delete(d.tcpConns, conn)
+		d.connMu.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		_ = conn.SetDeadline(time.Now().Add(tcpIdleTimeout))
+		query, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		resp, err := d.handleQuery(query)
+		if err != nil {
+			log.Printf("DNS query from %s failed: %v", conn.RemoteAddr(), err)
+			return
+		}
+		if err := writeTCPMessage(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+// handleQuery answers a single wire-format DNS query
+func (d *DNSService) handleQuery(query []byte) ([]byte, error) {
+	start := time.Now()
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		return nil, fmt.Errorf("malformed query: %w", err)
+	}
+	if len(msg.Questions) == 0 {
+		return d.reply(msg, dnsmessage.RCodeFormatError, nil)
+	}
+
+	q := msg.Questions[0]
+	name := strings.TrimSuffix(strings.ToLower(q.Name.String()), ".")
+
+	target := db_service.MatchTarget{Domain: name}
+	rule, found := d.db().FindRule(target)
+	// A log-only rule only marks the query; the other rules and the policy
+	// still decide it
+	var logRule string
+	if found && rule.Action == db_service.ActionLog {
+		logRule = rule.Domain
+		target.SkipLogOnly = true
+		rule, found = d.db().FindRule(target)
+	}
+	blocked := found && rule.Action == db_service.ActionBlock
+	reason := logging_service.ReasonRule
+	// Candidates are only recorded by the proxy: the lookup before each
+	// proxied connection would count every host twice while learning
+	if !found {
+		blocked, reason = d.db().GetPolicy().BlocksUnknown(), logging_service.ReasonPolicy
+	}
+	if blocked {
+		go d.logger().LogEntry(logging_service.LogRequest{
+			Host:     name,
+			Method:   "DNS",
+			Path:     queryType(q.Type),
+			Port:     53,
+			Duration: time.Since(start).Nanoseconds(),
+			Rule:     rule.Domain,
+			Reason:   reason,
+		})
+		return d.blockedReply(msg)
+	}
+
+	// A log-only rule lets the query through but marks it as would_reject
+	answered := logging_service.LogRequest{Host: name, Method: "DNS", Path: queryType(q.Type), Port: 53, Approved: true}
+	if logRule != "" {
+		answered.WouldReject = true
+		answered.Rule = logRule
+		answered.Reason = logging_service.ReasonRule
+	}
+
+	key := cacheKey(q)
+	if cached, ok := d.cache.get(key); ok {
+		binary.BigEndian.PutUint16(cached, msg.Header.ID)
+		answered.Duration = time.Since(start).Nanoseconds()
+		go d.logger().LogEntry(answered)
+		return cached, nil
+	}
+
+	resp, err := d.forward(query)
+	if err != nil {
+		log.Printf("DNS upstream error for %s: %v", name, err)
+		return d.reply(msg, dnsmessage.RCodeServerFailure, nil)
+	}
+	if ttl, ok := responseTTL(resp); ok {
+		d.cache.put(key, resp, ttl)
+	}
+
+	answered.Duration = time.Since(start).Nanoseconds()
+	go d.logger().LogEntry(answered)
+	return resp, nil
+}
+
+// blockedReply builds the sinkhole answer for a blocked query
+func (d *DNSService) blockedReply(msg dnsmessage.Message) ([]byte, error) {
+	if d.BlockMode == BlockModeNXDomain {
+		return d.reply(msg, dnsmessage.RCodeNameError, nil)
+	}
+
+	q := msg.Questions[0]
+	header := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: blockedTTL}
+	var answers []dnsmessage.Resource
+	switch q.Type {
+	case dnsmessage.TypeA:
+		answers = append(answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{}})
+	case dnsmessage.TypeAAAA:
+		answers = append(answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AAAAResource{}})
+	}
+	return d.reply(msg, dnsmessage.RCodeSuccess, answers)
+}
+
+// reply packs a locally generated response to msg
+func (d *DNSService) reply(msg dnsmessage.Message, rcode dnsmessage.RCode, answers []dnsmessage.Resource) ([]byte, error) {
+	resp := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 msg.Header.ID,
+			Response:           true,
+			OpCode:             msg.Header.OpCode,
+			RecursionDesired:   msg.Header.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Questions: msg.Questions,
+		Answers:   answers,
+	}
+	return resp.Pack()
+}
+
+// forward sends the query upstream over UDP, retrying over TCP when the
+// answer is truncated.
+func (d *DNSService) forward(query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", d.Upstream, upstreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(upstreamTimeout))
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxUDPSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	resp := buf[:n]
+
+	var header dnsmessage.Parser
+	if h, err := header.Start(resp); err == nil && h.Truncated {
+		return d.forwardTCP(query)
+	}
+	return resp, nil
+}
+
+func (d *DNSService) forwardTCP(query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", d.Upstream, upstreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(upstreamTimeout))
+
+	if err := writeTCPMessage(conn, query); err != nil {
+		return nil, err
+	}
+	return readTCPMessage(conn)
+}
+
+// responseTTL returns how long an upstream response may be cached
+func responseTTL(resp []byte) (time.Duration, bool) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return 0, false
+	}
+	if msg.Header.RCode != dnsmessage.RCodeSuccess && msg.Header.RCode != dnsmessage.RCodeNameError {
+		return 0, false
+	}
+
+	ttl := uint32(0)
+	found := false
+	for _, rr := range msg.Answers {
+		if !found || rr.Header.TTL < ttl {
+			ttl = rr.Header.TTL
+			found = true
+		}
+	}
+	// Negative answers are cached for the SOA minimum (RFC 2308)
+	if !found {
+		for _, rr := range msg.Authorities {
+			if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok {
+				ttl = min(rr.Header.TTL, soa.MinTTL)
+				found = true
+			}
+		}
+	}
+	if !found || ttl == 0 {
+		return 0, false
+	}
+	return time.Duration(ttl) * time.Second, true
+}
+
+// queryType returns the record type as it is shown in the request log, e.g. "AAAA"
+func queryType(t dnsmessage.Type) string {
+	return strings.TrimPrefix(t.String(), "Type")
+}
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	buf := binary.BigEndian.AppendUint16(make([]byte, 0, len(msg)+2), uint16(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
@@ -0,0 +1,354 @@
+package dns_service
+
+import (
+	"changeme/db_service"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDNSService_ForwardsAndCaches(t *testing.T) {
+	upstream := startFakeUpstream(t)
+	service := setupTestService(t, upstream.addr)
+
+	resp := queryUDP(t, service, "example.com.", dnsmessage.TypeA)
+	if resp.Header.RCode != dnsmessage.RCodeSuccess {
+		t.Fatalf("expected NOERROR, got %v", resp.Header.RCode)
+	}
+	if got := answerA(t, resp); got != "93.184.216.34" {
+		t.Fatalf("expected upstream answer, got %s", got)
+	}
+
+	// The second lookup should be served from the cache
+	resp = queryUDP(t, service, "EXAMPLE.com.", dnsmessage.TypeA)
+	if got := answerA(t, resp); got != "93.184.216.34" {
+		t.Fatalf("expected cached answer, got %s", got)
+	}
+	if hits := upstream.hits.Load(); hits != 1 {
+		t.Fatalf("expected 1 upstream query, got %d", hits)
+	}
+}
+
+func TestDNSService_CachedAnswersCountDownTTL(t *testing.T) {
+	upstream := startFakeUpstream(t)
+	service := setupTestService(t, upstream.addr)
+	queryUDP(t, service, "example.com.", dnsmessage.TypeA)
+
+	// Pretend the answer was cached 100 seconds ago
+	key := cacheKey(dnsmessage.Question{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	service.cache.mu.Lock()
+	entry := service.cache.entries[key]
+	entry.stored = entry.stored.Add(-100 * time.Second)
+	service.cache.entries[key] = entry
+	service.cache.mu.Unlock()
+
+	resp := queryUDP(t, service, "example.com.", dnsmessage.TypeA)
+	if len(resp.Answers) != 1 || resp.Answers[0].Header.TTL != 200 {
+		t.Fatalf("expected the cached TTL to drop from 300 to 200, got %+v", resp.Answers)
+	}
+	if hits := upstream.hits.Load(); hits != 1 {
+		t.Fatalf("expected 1 upstream query, got %d", hits)
+	}
+}
+
+func TestDNSService_StopClosesTCPClients(t *testing.T) {
+	upstream := startFakeUpstream(t)
+	service := setupTestService(t, upstream.addr)
+
+	conn, err := net.Dial("tcp", service.tcpListener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	if err := writeTCPMessage(conn, buildQuery(t, "example.com.", dnsmessage.TypeA)); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if _, err := readTCPMessage(conn); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+
+	// The idle client would otherwise keep Stop waiting for tcpIdleTimeout
+	stopped := make(chan struct{})
+	go func() {
+		service.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(tcpIdleTimeout / 2):
+		t.Fatal("Stop waited for an idle TCP client")
+	}
+	if _, err := readTCPMessage(conn); err == nil {
+		t.Fatal("expected the client connection to be closed")
+	}
+}
+
+func TestDNSService_BlockedNameReturnsNullAddress(t *testing.T) {
+	upstream := startFakeUpstream(t)
+	service := setupTestService(t, upstream.addr)
+	service.DbService.BlockGlobPattern("*.ads.test")
+
+	resp := queryUDP(t, service, "tracker.ads.test.", dnsmessage.TypeA)
+	if resp.Header.RCode != dnsmessage.RCodeSuccess {
+		t.Fatalf("expected NOERROR, got %v", resp.Header.RCode)
+	}
+	if got := answerA(t, resp); got != "0.0.0.0" {
+		t.Fatalf("expected 0.0.0.0, got %s", got)
+	}
+
+	resp = queryUDP(t, service, "tracker.ads.test.", dnsmessage.TypeAAAA)
+	if len(resp.Answers) != 1 {
+		t.Fatalf("expected one AAAA answer, got %d", len(resp.Answers))
+	}
+	if aaaa, ok := resp.Answers[0].Body.(*dnsmessage.AAAAResource); !ok || !net.IP(aaaa.AAAA[:]).Equal(net.IPv6unspecified) {
+		t.Fatalf("expected ::, got %v", resp.Answers[0].Body)
+	}
+
+	if hits := upstream.hits.Load(); hits != 0 {
+		t.Fatalf("blocked names must not reach upstream, got %d queries", hits)
+	}
+}
+
+func TestDNSService_BlockedNameNXDomain(t *testing.T) {
+	upstream := startFakeUpstream(t)
+	service := setupTestService(t, upstream.addr)
+	service.BlockMode = BlockModeNXDomain
+	service.DbService.BlockDomain("blocked.test")
+
+	resp := queryUDP(t, service, "blocked.test.", dnsmessage.TypeA)
+	if resp.Header.RCode != dnsmessage.RCodeNameError {
+		t.Fatalf("expected NXDOMAIN, got %v", resp.Header.RCode)
+	}
+}
+
+func TestDNSService_DefaultDenyPolicy(t *testing.T) {
+	upstream := startFakeUpstream(t)
+	service := setupTestService(t, upstream.addr)
+	service.BlockMode = BlockModeNXDomain
+	service.DbService.SetPolicy(db_service.Policy{DefaultAction: db_service.ActionBlock})
+	service.DbService.SaveRule(db_service.BlockedDomainInfo{Domain: "allowed.test", Action: db_service.ActionAllow})
+
+	if resp := queryUDP(t, service, "other.test.", dnsmessage.TypeA); resp.Header.RCode != dnsmessage.RCodeNameError {
+		t.Fatalf("expected unknown names to be blocked, got %v", resp.Header.RCode)
+	}
+	if got := answerA(t, queryUDP(t, service, "allowed.test.", dnsmessage.TypeA)); got != "93.184.216.34" {
+		t.Fatalf("expected the allowed name to resolve, got %s", got)
+	}
+
+	// Log-only rules do not let names past the policy
+	service.DbService.SaveRule(db_service.BlockedDomainInfo{Domain: "logged.test", Action: db_service.ActionLog})
+	if resp := queryUDP(t, service, "logged.test.", dnsmessage.TypeA); resp.Header.RCode != dnsmessage.RCodeNameError {
+		t.Fatalf("expected log-only names to be blocked by the policy, got %v", resp.Header.RCode)
+	}
+}
+
+func TestDNSService_LearningLeavesCandidatesToTheProxy(t *testing.T) {
+	upstream := startFakeUpstream(t)
+	service := setupTestService(t, upstream.addr)
+	service.DbService.SetPolicy(db_service.Policy{DefaultAction: db_service.ActionBlock, LearningUntil: time.Now().Add(time.Hour).UnixMilli()})
+
+	if got := answerA(t, queryUDP(t, service, "new.test.", dnsmessage.TypeA)); got != "93.184.216.34" {
+		t.Fatalf("expected unknown names to resolve while learning, got %s", got)
+	}
+	if candidates := service.DbService.ListCandidates(); len(candidates) != 0 {
+		t.Fatalf("expected the lookup not to be recorded, got %+v", candidates)
+	}
+}
+
+func TestDNSService_TCP(t *testing.T) {
+	upstream := startFakeUpstream(t)
+	service := setupTestService(t, upstream.addr)
+
+	conn, err := net.Dial("tcp", service.tcpListener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	if err := writeTCPMessage(conn, buildQuery(t, "example.com.", dnsmessage.TypeA)); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	raw, err := readTCPMessage(conn)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(raw); err != nil {
+		t.Fatalf("unpack failed: %v", err)
+	}
+	if got := answerA(t, &resp); got != "93.184.216.34" {
+		t.Fatalf("expected upstream answer, got %s", got)
+	}
+}
+
+func TestDNSService_UpstreamFailure(t *testing.T) {
+	// Nothing listens on this address, so forwarding fails
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	deadAddr := conn.LocalAddr().String()
+	conn.Close()
+
+	service := setupTestService(t, deadAddr)
+	resp := queryUDP(t, service, "example.com.", dnsmessage.TypeA)
+	if resp.Header.RCode != dnsmessage.RCodeServerFailure {
+		t.Fatalf("expected SERVFAIL, got %v", resp.Header.RCode)
+	}
+}
+
+func TestDNSSettings_OptIn(t *testing.T) {
+	db, err := db_service.NewDBService(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create test db: %v", err)
+	}
+	t.Cleanup(func() { db.ServiceShutdown() })
+	service := &DNSService{DbService: db}
+	t.Cleanup(service.Stop)
+
+	settings := service.GetDNSSettings()
+	if settings.Enabled || settings.ListenAddr != DEFAULT_LISTEN_ADDR {
+		t.Fatalf("expected the sinkhole to be off by default, got %+v", settings)
+	}
+	if err := service.SetDNSSettings(DNSSettings{Enabled: true, ListenAddr: "127.0.0.1"}); err == nil {
+		t.Fatal("expected an address without a port to be rejected")
+	}
+
+	if err := service.SetDNSSettings(DNSSettings{Enabled: true, ListenAddr: "127.0.0.1:0"}); err != nil {
+		t.Fatalf("enable failed: %v", err)
+	}
+	if service.udpConn == nil || service.tcpListener == nil {
+		t.Fatal("expected the listeners to be running")
+	}
+	if got := service.GetDNSSettings(); !got.Enabled || got.ListenAddr != "127.0.0.1:0" {
+		t.Fatalf("settings not saved: %+v", got)
+	}
+
+	if err := service.SetDNSSettings(DNSSettings{Enabled: false, ListenAddr: "127.0.0.1:0"}); err != nil {
+		t.Fatalf("disable failed: %v", err)
+	}
+	if service.udpConn != nil || service.tcpListener != nil {
+		t.Fatal("expected the listeners to be closed")
+	}
+}
+
+type fakeUpstream struct {
+	addr string
+	hits atomic.Int64
+}
+
+// startFakeUpstream answers every A query with 93.184.216.34
+func startFakeUpstream(t *testing.T) *fakeUpstream {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	upstream := &fakeUpstream{addr: conn.LocalAddr().String()}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			upstream.hits.Add(1)
+
+			var query dnsmessage.Message
+			if err := query.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			resp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.Header.ID, Response: true, RecursionAvailable: true},
+				Questions: query.Questions,
+			}
+			if q := query.Questions[0]; q.Type == dnsmessage.TypeA {
+				resp.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 300},
+					Body:   &dnsmessage.AResource{A: [4]byte{93, 184, 216, 34}},
+				}}
+			}
+			packed, _ := resp.Pack()
+			_, _ = conn.WriteTo(packed, addr)
+		}
+	}()
+	return upstream
+}
+
+// Helper function to set up a DNS service backed by an isolated database
+func setupTestService(t *testing.T, upstream string) *DNSService {
+	db, err := db_service.NewDBService(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create test db: %v", err)
+	}
+	t.Cleanup(func() { db.ServiceShutdown() })
+
+	service := &DNSService{
+		ListenAddr: "127.0.0.1:0",
+		Upstream:   upstream,
+		DbService:  db,
+	}
+	if err := service.Start(); err != nil {
+		t.Fatalf("Failed to start DNS service: %v", err)
+	}
+	t.Cleanup(service.Stop)
+	return service
+}
+
+func buildQuery(t *testing.T, name string, qtype dnsmessage.Type) []byte {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 0xbeef, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("pack failed: %v", err)
+	}
+	return packed
+}
+
+func queryUDP(t *testing.T, service *DNSService, name string, qtype dnsmessage.Type) *dnsmessage.Message {
+	conn, err := net.Dial("udp", service.udpConn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if _, err := conn.Write(buildQuery(t, name, qtype)); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	buf := make([]byte, maxUDPSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+
+	var resp dnsmessage.Message
+	if err := resp.Unpack(buf[:n]); err != nil {
+		t.Fatalf("unpack failed: %v", err)
+	}
+	if resp.Header.ID != 0xbeef {
+		t.Fatalf("response ID %#x does not match query", resp.Header.ID)
+	}
+	return &resp
+}
+
+func answerA(t *testing.T, resp *dnsmessage.Message) string {
+	if len(resp.Answers) != 1 {
+		t.Fatalf("expected one answer, got %d", len(resp.Answers))
+	}
+	a, ok := resp.Answers[0].Body.(*dnsmessage.AResource)
+	if !ok {
+		t.Fatalf("expected A record, got %T", resp.Answers[0].Body)
+	}
+	return net.IP(a.A[:]).String()
+}
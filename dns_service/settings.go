@@ -0,0 +1,64 @@
+package dns_service
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+)
+
+const dnsSettingKey = "dns.sinkhole"
+
+// DNSSettings is the saved sinkhole configuration. The sinkhole is opt-in:
+// nothing listens until Enabled is set.
+type DNSSettings struct {
+	Enabled    bool   `json:"enabled"`
+	ListenAddr string `json:"listenAddr"`
+}
+
+// DefaultDNSSettings is used until settings have been saved
+var DefaultDNSSettings = DNSSettings{Enabled: false, ListenAddr: DEFAULT_LISTEN_ADDR}
+
+// GetDNSSettings returns the saved sinkhole settings
+func (d *DNSService) GetDNSSettings() DNSSettings {
+	value, ok := d.db().GetSetting(dnsSettingKey)
+	if !ok {
+		return DefaultDNSSettings
+	}
+	settings := DefaultDNSSettings
+	if err := json.Unmarshal([]byte(value), &settings); err != nil {
+		log.Printf("warning: invalid DNS settings %q: %v", value, err)
+		return DefaultDNSSettings
+	}
+	if settings.ListenAddr == "" {
+		settings.ListenAddr = DEFAULT_LISTEN_ADDR
+	}
+	return settings
+}
+
+// SetDNSSettings stores the sinkhole settings and starts, restarts or stops
+// the listeners to match them.
+func (d *DNSService) SetDNSSettings(settings DNSSettings) error {
+	if settings.ListenAddr == "" {
+		settings.ListenAddr = DEFAULT_LISTEN_ADDR
+	}
+	if _, _, err := net.SplitHostPort(settings.ListenAddr); err != nil {
+		return fmt.Errorf("invalid listen address %q: %w", settings.ListenAddr, err)
+	}
+	value, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	if !d.db().SetSetting(dnsSettingKey, string(value)) {
+		return fmt.Errorf("failed to save DNS settings")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stop()
+	if !settings.Enabled {
+		return nil
+	}
+	d.ListenAddr = settings.ListenAddr
+	return d.start()
+}
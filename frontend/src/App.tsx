@@ -1,11 +1,15 @@
 import { useState } from 'react';
 import { DomainManager } from './components/DomainManager';
+import { CandidateReview } from './components/CandidateReview';
 import { Dashboard } from './components/Dashboard';
-import { Navigation } from './components/Navigation';
+import { Navigation, Tab } from './components/Navigation';
+import { LiveRequests } from './components/LiveRequests';
+import { ActiveConnections } from './components/ActiveConnections';
+import { DecisionPrompts } from './components/DecisionPrompts';
 import { Toaster } from "@/components/ui/sonner"
 
 function App() {
-  const [activeTab, setActiveTab] = useState<'domains' | 'dashboard'>('domains');
+  const [activeTab, setActiveTab] = useState<Tab>('domains');
 
   return (
     <div className="min-h-screen bg-gray-50">
@@ -18,7 +22,10 @@ function App() {
               <h1 className="text-3xl font-bold text-gray-900 mb-2">Local Proxy</h1>
               <p className="text-gray-600">Manage your blocked domains and proxy settings</p>
             </div>
-            <DomainManager />
+            <div className="space-y-6">
+              <DomainManager />
+              <CandidateReview />
+            </div>
           </>
         )}
         
@@ -31,8 +38,22 @@ function App() {
             <Dashboard />
           </>
         )}
+
+        {activeTab === 'live' && (
+          <>
+            <div className="mb-8 text-center">
+              <h1 className="text-3xl font-bold text-gray-900 mb-2">Live Activity</h1>
+              <p className="text-gray-600">Watch open connections and requests as they pass through the proxy</p>
+            </div>
+            <div className="space-y-6">
+              <ActiveConnections />
+              <LiveRequests />
+            </div>
+          </>
+        )}
       </div>
       
+      <DecisionPrompts />
       <Toaster />
     </div>
   );
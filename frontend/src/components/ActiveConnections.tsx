@@ -0,0 +1,123 @@
+import { useQuery, useMutation, useQueryClient } from '@tanstack/react-query';
+import { ProxyService, ActiveConnection } from '../../bindings/changeme/proxy_service';
+import { Card, CardContent, CardDescription, CardHeader, CardTitle } from './ui/card';
+import { Button } from './ui/button';
+import { Badge } from './ui/badge';
+import { Table, TableBody, TableCell, TableHead, TableHeader, TableRow } from './ui/table';
+import { Cable, X } from 'lucide-react';
+import { toast } from "sonner";
+
+// Byte counts grow while tunnels are open, so the list is polled
+const REFRESH_INTERVAL = 2 * 1000;
+
+const formatBytes = (bytes: number) => {
+  if (bytes < 1024) return `${bytes} B`;
+  if (bytes < 1024 * 1024) return `${(bytes / 1024).toFixed(1)} KB`;
+  return `${(bytes / (1024 * 1024)).toFixed(1)} MB`;
+};
+
+const formatAge = (start: number) => {
+  const seconds = Math.max(0, Math.floor((Date.now() - start) / 1000));
+  if (seconds < 60) return `${seconds}s`;
+  if (seconds < 3600) return `${Math.floor(seconds / 60)}m ${seconds % 60}s`;
+  return `${Math.floor(seconds / 3600)}h ${Math.floor((seconds % 3600) / 60)}m`;
+};
+
+// ActiveConnections lists the tunnels and HTTP requests open through the proxy
+export function ActiveConnections() {
+  const queryClient = useQueryClient();
+
+  const { data: connections = [] } = useQuery({
+    queryKey: ['connections'],
+    queryFn: () => ProxyService.ListActiveConnections(),
+    refetchInterval: REFRESH_INTERVAL,
+  });
+
+  const closeMutation = useMutation({
+    mutationFn: (connection: ActiveConnection) => ProxyService.CloseConnection(connection.id),
+    onSuccess: (_, connection) => {
+      toast.success(`Closed connection to ${connection.host}`);
+      queryClient.invalidateQueries({ queryKey: ['connections'] });
+    },
+    onError: (err) => {
+      console.error('Failed to close connection:', err);
+      toast.error('Failed to close connection: it may have ended already');
+      queryClient.invalidateQueries({ queryKey: ['connections'] });
+    },
+  });
+
+  return (
+    <Card>
+      <CardHeader>
+        <CardTitle className="flex items-center space-x-2">
+          <Cable className="h-5 w-5" />
+          <span>Active Connections</span>
+          <Badge variant="outline">{connections.length}</Badge>
+        </CardTitle>
+        <CardDescription>
+          Connections currently open through the proxy
+        </CardDescription>
+      </CardHeader>
+      <CardContent>
+        {connections.length === 0 ? (
+          <div className="text-center py-8 text-gray-500">
+            <Cable className="h-12 w-12 mx-auto mb-4 text-gray-300" />
+            <p>No open connections.</p>
+          </div>
+        ) : (
+          <div className="overflow-x-auto">
+            <Table>
+              <TableHeader>
+                <TableRow>
+                  <TableHead>Host</TableHead>
+                  <TableHead>Method</TableHead>
+                  <TableHead>Client</TableHead>
+                  <TableHead>Application</TableHead>
+                  <TableHead>Open For</TableHead>
+                  <TableHead className="text-right">Sent / Received</TableHead>
+                  <TableHead className="text-center">Actions</TableHead>
+                </TableRow>
+              </TableHeader>
+              <TableBody>
+                {connections.map((connection: ActiveConnection) => (
+                  <TableRow key={connection.id}>
+                    <TableCell className="font-mono text-sm">
+                      {connection.host}:{connection.port}
+                    </TableCell>
+                    <TableCell>
+                      <Badge variant="outline">{connection.method}</Badge>
+                    </TableCell>
+                    <TableCell className="font-mono text-sm text-gray-600">
+                      {connection.user ? `${connection.user}@` : ''}{connection.clientAddr}
+                    </TableCell>
+                    <TableCell className="text-sm" title={connection.processPath}>
+                      {connection.processName || '-'}
+                    </TableCell>
+                    <TableCell className="text-sm text-gray-600">
+                      {formatAge(connection.start)}
+                    </TableCell>
+                    <TableCell className="text-right text-sm">
+                      {formatBytes(connection.bytesUp)} / {formatBytes(connection.bytesDown)}
+                    </TableCell>
+                    <TableCell className="text-center">
+                      <Button
+                        size="sm"
+                        variant="outline"
+                        onClick={() => closeMutation.mutate(connection)}
+                        disabled={closeMutation.isPending}
+                        className="text-red-600 hover:text-red-700 hover:bg-red-50"
+                      >
+                        <X className="h-3 w-3 mr-1" />
+                        Close
+                      </Button>
+                    </TableCell>
+                  </TableRow>
+                ))}
+              </TableBody>
+            </Table>
+          </div>
+        )}
+      </CardContent>
+    </Card>
+  );
+}
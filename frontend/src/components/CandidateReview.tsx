@@ -0,0 +1,233 @@
+import { useState } from 'react';
+import { useQuery, useMutation, useQueryClient } from '@tanstack/react-query';
+import { DatabaseService, Candidate, Policy } from '../../bindings/changeme/db_service';
+import { Card, CardContent, CardDescription, CardHeader, CardTitle } from './ui/card';
+import { Button } from './ui/button';
+import { Badge } from './ui/badge';
+import { Table, TableBody, TableCell, TableHead, TableHeader, TableRow } from './ui/table';
+import { ListChecks, Check, X, GraduationCap, Lock, Unlock } from 'lucide-react';
+import { toast } from "sonner";
+
+// Length of a learning period started from this view
+const LEARNING_HOURS = 24;
+
+// Candidates keep growing while learning, so the list is polled
+const REFRESH_INTERVAL = 10 * 1000;
+
+// CandidateReview switches between the default-allow and allowlist-only
+// policies and lets the hosts recorded while learning be approved in bulk
+export function CandidateReview() {
+  const queryClient = useQueryClient();
+  const [selected, setSelected] = useState<Set<string>>(new Set());
+
+  const { data: policy } = useQuery({
+    queryKey: ['policy'],
+    queryFn: () => DatabaseService.GetPolicy(),
+  });
+
+  const { data: candidates = [] } = useQuery({
+    queryKey: ['candidates'],
+    queryFn: () => DatabaseService.ListCandidates(),
+    refetchInterval: REFRESH_INTERVAL,
+  });
+
+  const learning = !!policy && policy.learningUntil > Date.now();
+  const allowlistOnly = policy?.defaultAction === 'block';
+
+  const policyMutation = useMutation({
+    mutationFn: (changes: Partial<Policy>) => DatabaseService.SetPolicy(new Policy({ ...policy, ...changes })),
+    onSuccess: (success) => {
+      if (success) {
+        queryClient.invalidateQueries({ queryKey: ['policy'] });
+        toast.success('Policy updated');
+      } else {
+        toast.error('Failed to update policy');
+      }
+    },
+    onError: (err) => {
+      console.error('Failed to update policy:', err);
+      toast.error('Failed to update policy');
+    },
+  });
+
+  const approveMutation = useMutation({
+    mutationFn: (hosts: string[]) => DatabaseService.ApproveCandidates(hosts),
+    onSuccess: (approved) => {
+      setSelected(new Set());
+      queryClient.invalidateQueries({ queryKey: ['candidates'] });
+      queryClient.invalidateQueries({ queryKey: ['domains'] });
+      toast.success(`Allowed ${approved} host${approved === 1 ? '' : 's'}`);
+    },
+    onError: (err) => {
+      console.error('Failed to approve candidates:', err);
+      toast.error('Failed to approve candidates');
+    },
+  });
+
+  const dismissMutation = useMutation({
+    mutationFn: (hosts: string[]) => DatabaseService.DismissCandidates(hosts),
+    onSuccess: (success) => {
+      setSelected(new Set());
+      queryClient.invalidateQueries({ queryKey: ['candidates'] });
+      if (!success) {
+        toast.error('Failed to dismiss candidates');
+      }
+    },
+    onError: (err) => {
+      console.error('Failed to dismiss candidates:', err);
+      toast.error('Failed to dismiss candidates');
+    },
+  });
+
+  const toggle = (host: string) => {
+    const next = new Set(selected);
+    if (next.has(host)) {
+      next.delete(host);
+    } else {
+      next.add(host);
+    }
+    setSelected(next);
+  };
+
+  const toggleAll = () => {
+    setSelected(selected.size === candidates.length ? new Set() : new Set(candidates.map(c => c.host)));
+  };
+
+  const busy = approveMutation.isPending || dismissMutation.isPending;
+
+  return (
+    <Card>
+      <CardHeader>
+        <div className="flex items-center justify-between">
+          <div>
+            <CardTitle className="flex items-center space-x-2">
+              <ListChecks className="h-5 w-5" />
+              <span>Allowlist</span>
+              {learning ? (
+                <Badge variant="outline">
+                  Learning until {new Date(policy!.learningUntil).toLocaleString()}
+                </Badge>
+              ) : allowlistOnly ? (
+                <Badge variant="destructive" className="bg-red-100 text-red-800">Allowlist only</Badge>
+              ) : (
+                <Badge variant="outline">Allow by default</Badge>
+              )}
+            </CardTitle>
+            <CardDescription>
+              In allowlist-only mode only hosts with an allow rule pass. While learning, every
+              host passes and is recorded below for review.
+            </CardDescription>
+          </div>
+          <div className="flex items-center space-x-2">
+            {learning ? (
+              <Button
+                variant="outline"
+                size="sm"
+                onClick={() => policyMutation.mutate({ learningUntil: 0 })}
+                disabled={policyMutation.isPending}
+              >
+                Stop Learning
+              </Button>
+            ) : (
+              <Button
+                variant="outline"
+                size="sm"
+                onClick={() => policyMutation.mutate({ learningUntil: Date.now() + LEARNING_HOURS * 60 * 60 * 1000 })}
+                disabled={policyMutation.isPending}
+              >
+                <GraduationCap className="h-4 w-4 mr-1" />
+                Learn for {LEARNING_HOURS}h
+              </Button>
+            )}
+            <Button
+              variant={allowlistOnly ? 'outline' : 'default'}
+              size="sm"
+              onClick={() => policyMutation.mutate({ defaultAction: allowlistOnly ? 'allow' : 'block' })}
+              disabled={policyMutation.isPending}
+            >
+              {allowlistOnly ? <Unlock className="h-4 w-4 mr-1" /> : <Lock className="h-4 w-4 mr-1" />}
+              {allowlistOnly ? 'Allow by Default' : 'Allowlist Only'}
+            </Button>
+          </div>
+        </div>
+      </CardHeader>
+      <CardContent>
+        {candidates.length === 0 ? (
+          <div className="text-center py-8 text-gray-500">
+            <ListChecks className="h-12 w-12 mx-auto mb-4 text-gray-300" />
+            <p>No candidates. Start learning to record the hosts in use.</p>
+          </div>
+        ) : (
+          <>
+            <div className="flex items-center justify-between mb-4">
+              <span className="text-sm text-gray-600">
+                {selected.size} of {candidates.length} selected
+              </span>
+              <div className="flex space-x-2">
+                <Button
+                  size="sm"
+                  onClick={() => approveMutation.mutate([...selected])}
+                  disabled={selected.size === 0 || busy}
+                >
+                  <Check className="h-3 w-3 mr-1" />
+                  Allow Selected
+                </Button>
+                <Button
+                  size="sm"
+                  variant="outline"
+                  onClick={() => dismissMutation.mutate([...selected])}
+                  disabled={selected.size === 0 || busy}
+                >
+                  <X className="h-3 w-3 mr-1" />
+                  Dismiss Selected
+                </Button>
+              </div>
+            </div>
+            <div className="overflow-x-auto">
+              <Table>
+                <TableHeader>
+                  <TableRow>
+                    <TableHead className="w-8">
+                      <input
+                        type="checkbox"
+                        checked={selected.size === candidates.length}
+                        onChange={toggleAll}
+                      />
+                    </TableHead>
+                    <TableHead>Host</TableHead>
+                    <TableHead className="text-center">Hits</TableHead>
+                    <TableHead>First Seen</TableHead>
+                    <TableHead>Last Seen</TableHead>
+                  </TableRow>
+                </TableHeader>
+                <TableBody>
+                  {candidates.map((candidate: Candidate) => (
+                    <TableRow key={candidate.host}>
+                      <TableCell>
+                        <input
+                          type="checkbox"
+                          checked={selected.has(candidate.host)}
+                          onChange={() => toggle(candidate.host)}
+                        />
+                      </TableCell>
+                      <TableCell className="font-mono text-sm font-medium">{candidate.host}</TableCell>
+                      <TableCell className="text-center">
+                        <Badge variant="outline">{candidate.hits}</Badge>
+                      </TableCell>
+                      <TableCell className="text-sm text-gray-600">
+                        {new Date(candidate.firstSeen).toLocaleString()}
+                      </TableCell>
+                      <TableCell className="text-sm text-gray-600">
+                        {new Date(candidate.lastSeen).toLocaleString()}
+                      </TableCell>
+                    </TableRow>
+                  ))}
+                </TableBody>
+              </Table>
+            </div>
+          </>
+        )}
+      </CardContent>
+    </Card>
+  );
+}
@@ -1,6 +1,6 @@
 import { useState } from 'react';
 import { useQuery, useMutation, useQueryClient } from '@tanstack/react-query';
-import { LoggingService } from '../../bindings/changeme/logging_service';
+import { LoggingService, TopQuery } from '../../bindings/changeme/logging_service';
 import { DatabaseService } from '../../bindings/changeme/db_service';
 import { Card, CardContent, CardDescription, CardHeader, CardTitle } from './ui/card';
 import { Button } from './ui/button';
@@ -66,6 +66,17 @@ export function Dashboard({ className }: DashboardProps) {
     refetchInterval: 30 * 1000, // Auto-refresh every 30 seconds
   });
 
+  // Per-domain counts are aggregated by the backend for the same range
+  const { data: topHosts } = useQuery({
+    queryKey: ['dashboard', 'hosts', dashboardData?.start, dashboardData?.end],
+    queryFn: () => LoggingService.TopHosts(new TopQuery({
+      start: dashboardData!.start,
+      end: dashboardData!.end,
+      limit: 100,
+    })),
+    enabled: !!dashboardData,
+  });
+
   // Mutation for blocking a domain
   const blockDomainMutation = useMutation({
     mutationFn: (domain: string) => DatabaseService.BlockDomain(domain),
@@ -102,46 +113,13 @@ export function Dashboard({ className }: DashboardProps) {
     },
   });
 
-  // Group requests by host/domain
-  const domainGroups = dashboardData?.requests?.reduce((groups, request) => {
-    const domain = request.host;
-    if (!groups[domain]) {
-      groups[domain] = {
-        domain,
-        total: 0,
-        approved: 0,
-        rejected: 0,
-        lastActivity: request.timestamp,
-        requests: []
-      };
-    }
-    
-    groups[domain].total++;
-    groups[domain].requests.push(request);
-    
-    if (request.decision === 'approved') {
-      groups[domain].approved++;
-    } else {
-      groups[domain].rejected++;
-    }
-    
-    // Update last activity timestamp
-    if (request.timestamp > groups[domain].lastActivity) {
-      groups[domain].lastActivity = request.timestamp;
-    }
-    
-    return groups;
-  }, {} as Record<string, { 
-    domain: string; 
-    total: number; 
-    approved: number; 
-    rejected: number; 
-    lastActivity: number;
-    requests: any[];
-  }>) || {};
-
-  // Convert to array and sort by total requests (descending)
-  const domainList = Object.values(domainGroups).sort((a, b) => b.total - a.total);
+  const domainList = (topHosts || []).map(entry => ({
+    domain: entry.key,
+    total: entry.count,
+    approved: entry.count - entry.blocked,
+    rejected: entry.blocked,
+    lastActivity: entry.lastSeen,
+  }));
 
   // Filter domains based on decision filter
   const filteredDomains = domainList.filter(domain => {
@@ -352,7 +330,7 @@ export function Dashboard({ className }: DashboardProps) {
                 <span>Domain Activity</span>
               </CardTitle>
               <CardDescription>
-                Grouped view of domains with request counts in the selected time period
+                The busiest domains with request counts in the selected time period
               </CardDescription>
             </div>
             <div className="flex items-center space-x-2">
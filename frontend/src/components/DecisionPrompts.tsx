@@ -0,0 +1,96 @@
+import { useEffect } from 'react';
+import { useQuery, useMutation, useQueryClient } from '@tanstack/react-query';
+import { Events } from '@wailsio/runtime';
+import { ProxyService, DecisionAnswer, PendingDecision } from '../../bindings/changeme/proxy_service';
+import { Card, CardContent, CardDescription, CardHeader, CardTitle } from './ui/card';
+import { Button } from './ui/button';
+import { Badge } from './ui/badge';
+import { ShieldQuestion } from 'lucide-react';
+import { toast } from "sonner";
+
+// Emitted by ProxyService in ask mode, see proxy_service/ask.go
+const DECISION_REQUESTED = 'proxy:decision-requested';
+const DECISION_RESOLVED = 'proxy:decision-resolved';
+
+// Answers offered for each prompt; rules are saved for the host, port and app
+const ANSWERS = [
+  { label: 'Allow once', answer: { allow: true, remember: 'once', minutes: 0 } },
+  { label: 'Allow for 1 hour', answer: { allow: true, remember: 'minutes', minutes: 60 } },
+  { label: 'Always allow', answer: { allow: true, remember: 'forever', minutes: 0 } },
+  { label: 'Deny once', answer: { allow: false, remember: 'once', minutes: 0 } },
+  { label: 'Always deny', answer: { allow: false, remember: 'forever', minutes: 0 } },
+];
+
+// DecisionPrompts shows the connections waiting for an answer in ask mode
+export function DecisionPrompts() {
+  const queryClient = useQueryClient();
+
+  // Prompts raised before this window opened are listed on mount
+  const { data: pending = [] } = useQuery({
+    queryKey: ['decisions'],
+    queryFn: () => ProxyService.ListPendingDecisions(),
+  });
+
+  useEffect(() => {
+    const refresh = () => queryClient.invalidateQueries({ queryKey: ['decisions'] });
+    const offRequested = Events.On(DECISION_REQUESTED, refresh);
+    const offResolved = Events.On(DECISION_RESOLVED, refresh);
+    return () => {
+      offRequested();
+      offResolved();
+    };
+  }, [queryClient]);
+
+  const answerMutation = useMutation({
+    mutationFn: ({ id, answer }: { id: number; answer: typeof ANSWERS[number]['answer'] }) =>
+      ProxyService.AnswerDecision(id, new DecisionAnswer(answer)),
+    onSuccess: () => {
+      queryClient.invalidateQueries({ queryKey: ['decisions'] });
+      queryClient.invalidateQueries({ queryKey: ['domains'] });
+    },
+    onError: (err) => {
+      console.error('Failed to answer decision:', err);
+      toast.error('Failed to answer: the connection may have timed out');
+      queryClient.invalidateQueries({ queryKey: ['decisions'] });
+    },
+  });
+
+  if (pending.length === 0) {
+    return null;
+  }
+
+  return (
+    <div className="fixed bottom-4 right-4 z-50 w-[28rem] space-y-3">
+      {pending.map((decision: PendingDecision) => (
+        <Card key={decision.id} className="shadow-lg">
+          <CardHeader>
+            <CardTitle className="flex items-center gap-2">
+              <ShieldQuestion className="h-5 w-5" />
+              <span className="truncate">{decision.host}:{decision.port}</span>
+            </CardTitle>
+            <CardDescription>
+              {decision.processName || 'An unknown application'} wants to connect
+              {' '}<Badge variant="outline">{decision.method}</Badge>
+              <span className="block text-xs mt-1">
+                Decided automatically at {new Date(decision.deadline).toLocaleTimeString()}
+              </span>
+            </CardDescription>
+          </CardHeader>
+          <CardContent className="flex flex-wrap gap-2">
+            {ANSWERS.map(({ label, answer }) => (
+              <Button
+                key={label}
+                size="sm"
+                variant={answer.allow ? 'default' : 'outline'}
+                disabled={answerMutation.isPending}
+                onClick={() => answerMutation.mutate({ id: decision.id, answer })}
+              >
+                {label}
+              </Button>
+            ))}
+          </CardContent>
+        </Card>
+      ))}
+    </div>
+  );
+}
@@ -0,0 +1,135 @@
+import { useEffect, useState } from 'react';
+import { Events } from '@wailsio/runtime';
+import { RequestDetail, RequestsEventData } from '../../bindings/changeme/logging_service';
+import { Card, CardContent, CardDescription, CardHeader, CardTitle } from './ui/card';
+import { Button } from './ui/button';
+import { Badge } from './ui/badge';
+import { Table, TableBody, TableCell, TableHead, TableHeader, TableRow } from './ui/table';
+import { Radio, Pause, Play, Trash2 } from 'lucide-react';
+
+// Emitted by LoggingService in rate-limited batches, see logging_service/events.go
+const REQUESTS_EVENT = 'logging:requests';
+
+// Number of requests kept on screen; older ones are in the dashboard
+const MAX_ROWS = 200;
+
+const DECISION_FILTERS = [
+  { value: 'all', label: 'All' },
+  { value: 'rejected', label: 'Blocked Only' },
+];
+
+// LiveRequests shows requests as the proxy logs them, newest first
+export function LiveRequests() {
+  const [requests, setRequests] = useState<RequestDetail[]>([]);
+  const [skipped, setSkipped] = useState(0);
+  const [paused, setPaused] = useState(false);
+  const [decisionFilter, setDecisionFilter] = useState('all');
+
+  useEffect(() => {
+    if (paused) {
+      return;
+    }
+    return Events.On(REQUESTS_EVENT, (event: { data: RequestsEventData }) => {
+      const batch = event.data;
+      setRequests(prev => [...(batch.requests || []).slice().reverse(), ...prev].slice(0, MAX_ROWS));
+      if (batch.skipped > 0) {
+        setSkipped(prev => prev + batch.skipped);
+      }
+    });
+  }, [paused]);
+
+  const visible = requests.filter(r => decisionFilter === 'all' || r.decision === decisionFilter);
+
+  const clear = () => {
+    setRequests([]);
+    setSkipped(0);
+  };
+
+  return (
+    <Card>
+      <CardHeader>
+        <div className="flex items-center justify-between">
+          <div>
+            <CardTitle className="flex items-center space-x-2">
+              <Radio className={`h-5 w-5 ${paused ? '' : 'text-green-600'}`} />
+              <span>Live Requests</span>
+            </CardTitle>
+            <CardDescription>
+              Requests as they pass through the proxy
+              {skipped > 0 && ` (${skipped} not shown during bursts, see the dashboard)`}
+            </CardDescription>
+          </div>
+          <div className="flex items-center space-x-2">
+            {DECISION_FILTERS.map((filter) => (
+              <Button
+                key={filter.value}
+                variant={decisionFilter === filter.value ? 'default' : 'outline'}
+                size="sm"
+                onClick={() => setDecisionFilter(filter.value)}
+              >
+                {filter.label}
+              </Button>
+            ))}
+            <Button variant="outline" size="sm" onClick={() => setPaused(!paused)}>
+              {paused ? <Play className="h-4 w-4" /> : <Pause className="h-4 w-4" />}
+            </Button>
+            <Button variant="outline" size="sm" onClick={clear}>
+              <Trash2 className="h-4 w-4" />
+            </Button>
+          </div>
+        </div>
+      </CardHeader>
+      <CardContent>
+        {visible.length === 0 ? (
+          <div className="text-center py-8 text-gray-500">
+            <Radio className="h-12 w-12 mx-auto mb-4 text-gray-300" />
+            <p>{paused ? 'Paused. Resume to see new requests.' : 'Waiting for requests...'}</p>
+          </div>
+        ) : (
+          <div className="overflow-x-auto">
+            <Table>
+              <TableHeader>
+                <TableRow>
+                  <TableHead>Time</TableHead>
+                  <TableHead>Host</TableHead>
+                  <TableHead>Method</TableHead>
+                  <TableHead>Application</TableHead>
+                  <TableHead>Decision</TableHead>
+                </TableRow>
+              </TableHeader>
+              <TableBody>
+                {visible.map((request) => (
+                  <TableRow key={request.id}>
+                    <TableCell className="text-sm text-gray-600">
+                      {new Date(request.timestamp).toLocaleTimeString()}
+                    </TableCell>
+                    <TableCell className="font-mono text-sm">
+                      {request.host}:{request.port}
+                    </TableCell>
+                    <TableCell>
+                      <Badge variant="outline">{request.method}</Badge>
+                    </TableCell>
+                    <TableCell className="text-sm" title={request.processPath}>
+                      {request.processName || '-'}
+                    </TableCell>
+                    <TableCell>
+                      {request.decision === 'rejected' ? (
+                        <Badge variant="destructive" className="bg-red-100 text-red-800" title={request.reason || request.rule}>
+                          Blocked
+                        </Badge>
+                      ) : request.decision === 'would_reject' ? (
+                        <Badge variant="outline" title={request.rule}>Would block</Badge>
+                      ) : (
+                        <Badge variant="default" className="bg-green-100 text-green-800">Allowed</Badge>
+                      )}
+                    </TableCell>
+                  </TableRow>
+                ))}
+              </TableBody>
+            </Table>
+          </div>
+        )}
+      </CardContent>
+    </Card>
+  );
+}
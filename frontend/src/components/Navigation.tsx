@@ -1,9 +1,11 @@
 import { Button } from './ui/button';
-import { Shield, Activity } from 'lucide-react';
+import { Shield, Activity, Radio } from 'lucide-react';
+
+export type Tab = 'domains' | 'dashboard' | 'live';
 
 interface NavigationProps {
-  activeTab: 'domains' | 'dashboard';
-  onTabChange: (tab: 'domains' | 'dashboard') => void;
+  activeTab: Tab;
+  onTabChange: (tab: Tab) => void;
 }
 
 export function Navigation({ activeTab, onTabChange }: NavigationProps) {
@@ -27,6 +29,14 @@ export function Navigation({ activeTab, onTabChange }: NavigationProps) {
             <Activity className="h-4 w-4" />
             <span>Dashboard</span>
           </Button>
+          <Button
+            variant={activeTab === 'live' ? 'default' : 'ghost'}
+            onClick={() => onTabChange('live')}
+            className="flex items-center space-x-2"
+          >
+            <Radio className="h-4 w-4" />
+            <span>Live</span>
+          </Button>
         </div>
       </div>
     </div>
@@ -5,6 +5,8 @@ go 1.24.0
 require (
 	github.com/elazarl/goproxy v1.4.0
 	github.com/wailsapp/wails/v3 v3.0.0-alpha.36
+	golang.org/x/net v0.37.0
+	golang.org/x/sys v0.31.0
 	modernc.org/sqlite v1.36.0
 )
 
@@ -48,8 +50,6 @@ require (
 	github.com/xanzy/ssh-agent v0.3.3 // indirect
 	golang.org/x/crypto v0.36.0 // indirect
 	golang.org/x/exp v0.0.0-20250210185358-939b2ce775ac // indirect
-	golang.org/x/net v0.37.0 // indirect
-	golang.org/x/sys v0.31.0 // indirect
 	golang.org/x/text v0.23.0 // indirect
 	gopkg.in/ini.v1 v1.67.0 // indirect
 	gopkg.in/warnings.v0 v0.1.2 // indirect
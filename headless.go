@@ -0,0 +1,98 @@
+package main
+
+import (
+	"changeme/control_service"
+	"changeme/db_service"
+	"changeme/dns_service"
+	"changeme/logging_service"
+	"changeme/metrics_service"
+	"changeme/proxy_service"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/wailsapp/wails/v3/pkg/application"
+)
+
+// headlessService is the lifecycle every service implements for Wails. The
+// services don't rely on the options, so they can be driven without an app.
+type headlessService interface {
+	ServiceName() string
+	ServiceStartup(ctx context.Context, options application.ServiceOptions) error
+	ServiceShutdown() error
+}
+
+// runHeadless starts the database, logging, proxy, control and (optionally)
+// DNS and metrics services without the Wails GUI and blocks until SIGINT or SIGTERM.
+func runHeadless(args []string) error {
+	flags := flag.NewFlagSet("headless", flag.ContinueOnError)
+	socks := flags.Bool("socks", true, fmt.Sprintf("run the SOCKS5 listener on port %d", proxy_service.SOCKS_PORT))
+	socksAddr := flags.String("socks-addr", "", fmt.Sprintf("listen address for the SOCKS5 listener (default 127.0.0.1:%d; use :%d to accept other machines)", proxy_service.SOCKS_PORT, proxy_service.SOCKS_PORT))
+	usePAC := flags.Bool("pac", false, "point the system at the generated proxy.pac when the proxy is resumed (default: the saved setting)")
+	dnsAddr := flags.String("dns", "", "listen address for the DNS sinkhole, e.g. "+dns_service.DEFAULT_LISTEN_ADDR+" (default: the saved setting, which is off)")
+	controlAddr := flags.String("control", "", fmt.Sprintf("loopback address for the token-protected control API, e.g. 127.0.0.1:%d (disabled when empty)", control_service.CONTROL_PORT))
+	metricsAddr := flags.String("metrics", "", fmt.Sprintf("loopback address for the Prometheus /metrics endpoint, e.g. 127.0.0.1:%d (disabled when empty)", metrics_service.METRICS_PORT))
+	dnsUpstream := flags.String("dns-upstream", dns_service.DEFAULT_UPSTREAM, "upstream resolver for non-blocked DNS queries")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	log.SetOutput(os.Stdout)
+
+	dbService := &db_service.DatabaseService{}
+	loggingService := &logging_service.LoggingService{DbService: dbService}
+	// Rules are enforced right away; the system proxy settings are left untouched.
+	proxyService := &proxy_service.ProxyService{
+		Headless:       true,
+		EnableSocks:    *socks,
+		SocksAddr:      *socksAddr,
+		UsePAC:         *usePAC,
+		DbService:      dbService,
+		LoggingService: loggingService,
+	}
+	dnsService := &dns_service.DNSService{
+		ListenAddr:     *dnsAddr,
+		Upstream:       *dnsUpstream,
+		DbService:      dbService,
+		LoggingService: loggingService,
+	}
+
+	controlService := &control_service.ControlService{
+		HTTPAddr:       *controlAddr,
+		ProxyService:   proxyService,
+		DbService:      dbService,
+		LoggingService: loggingService,
+	}
+
+	metricsService := &metrics_service.MetricsService{Addr: *metricsAddr}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	services := []headlessService{dbService, loggingService, proxyService, dnsService, controlService, metricsService}
+	started := make([]headlessService, 0, len(services))
+	defer func() {
+		// Shut down in reverse order so producers stop before their consumers
+		for i := len(started) - 1; i >= 0; i-- {
+			if err := started[i].ServiceShutdown(); err != nil {
+				log.Printf("Warning: %s shutdown failed: %v", started[i].ServiceName(), err)
+			}
+		}
+	}()
+
+	for _, svc := range services {
+		if err := svc.ServiceStartup(ctx, application.ServiceOptions{}); err != nil {
+			return fmt.Errorf("%s startup failed: %w", svc.ServiceName(), err)
+		}
+		started = append(started, svc)
+	}
+
+	log.Printf("local-proxy running headless on port %d", proxy_service.PROXY_PORT)
+	<-ctx.Done()
+	log.Printf("Shutting down")
+	return nil
+}
@@ -0,0 +1,161 @@
+package logging_service
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	defaultTopN = 10
+	maxTopN     = 100
+)
+
+// TopQuery selects the period for the top-N methods. The previous period is
+// the same length and ends where this one starts.
+type TopQuery struct {
+	Start int64 `json:"start"` // unix milliseconds, inclusive
+	End   int64 `json:"end"`   // unix milliseconds, inclusive; 0 means now
+	Limit int   `json:"limit"`
+}
+
+// TopEntry is one row of a top-N list
+type TopEntry struct {
+	Key           string `json:"key"`
+	Count         int64  `json:"count"`
+	Blocked       int64  `json:"blocked"`
+	PreviousCount int64  `json:"previousCount"`
+	LastSeen      int64  `json:"lastSeen"` // unix milliseconds of the newest request in the period
+	// Change is the relative change against the previous period (0.5 = +50%);
+	// nil when the key was not seen in the previous period.
+	Change *float64 `json:"change"`
+}
+
+// TopHosts returns the hosts with the most requests
+func (l *LoggingService) TopHosts(q TopQuery) ([]TopEntry, error) {
+	return l.top("host", "", q)
+}
+
+// TopBlockedHosts returns the hosts with the most blocked requests
+func (l *LoggingService) TopBlockedHosts(q TopQuery) ([]TopEntry, error) {
+	return l.top("host", "decision = 'rejected'", q)
+}
+
+// TopSites groups requests by registrable domain (e.g. www.example.co.uk and
+// api.example.co.uk both count for example.co.uk)
+func (l *LoggingService) TopSites(q TopQuery) ([]TopEntry, error) {
+	return l.top("site", "", q)
+}
+
+// TopPorts returns the port distribution, busiest first
+func (l *LoggingService) TopPorts(q TopQuery) ([]TopEntry, error) {
+	return l.top("CAST(port AS TEXT)", "", q)
+}
+
+// TopUsers returns the authenticated proxy users with the most requests
+func (l *LoggingService) TopUsers(q TopQuery) ([]TopEntry, error) {
+	return l.top("username", "username <> ''", q)
+}
+
+// top aggregates the current and previous period in a single pass over the
+// timestamp index. key and filter are fixed SQL fragments, never user input.
+func (l *LoggingService) top(key, filter string, q TopQuery) ([]TopEntry, error) {
+	if l == nil || l.DbService.Db == nil {
+		return nil, fmt.Errorf("logging service not ready")
+	}
+	if q.End == 0 {
+		q.End = l.clock().UnixMilli()
+	}
+	if q.Start >= q.End {
+		return nil, fmt.Errorf("start must be before end")
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultTopN
+	}
+	if limit > maxTopN {
+		limit = maxTopN
+	}
+	previousStart := q.Start - (q.End - q.Start)
+
+	where := "timestamp >= ? AND timestamp <= ?"
+	if filter != "" {
+		where += " AND " + filter
+	}
+	rows, err := l.DbService.Db.Query(fmt.Sprintf(`
+		SELECT %s AS key,
+			SUM(timestamp >= ?) AS count,
+			SUM(timestamp >= ? AND decision = 'rejected') AS blocked,
+			SUM(timestamp < ?) AS previous,
+			MAX(timestamp) AS last_seen
+		FROM requests
+		WHERE %s
+		GROUP BY key
+		HAVING count > 0
+		ORDER BY count DESC, key
+		LIMIT ?
+	`, key, where), q.Start, q.Start, q.Start, previousStart, q.End, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query top %s: %w", key, err)
+	}
+	defer rows.Close()
+
+	entries := []TopEntry{}
+	for rows.Next() {
+		var e TopEntry
+		if err := rows.Scan(&e.Key, &e.Count, &e.Blocked, &e.PreviousCount, &e.LastSeen); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		if e.PreviousCount > 0 {
+			change := float64(e.Count-e.PreviousCount) / float64(e.PreviousCount)
+			e.Change = &change
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// siteOf returns the registrable domain (eTLD+1) of host. IP addresses and
+// names without a public suffix are returned unchanged.
+func siteOf(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if net.ParseIP(strings.Trim(host, "[]")) != nil {
+		return host
+	}
+	site, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
+	}
+	return site
+}
+
+// backfillSites fills the site column for rows logged before it existed
+func backfillSites(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT DISTINCT host FROM requests WHERE site = ''`)
+	if err != nil {
+		return fmt.Errorf("failed to backfill sites: %w", err)
+	}
+	var hosts []string
+	for rows.Next() {
+		var host string
+		if err := rows.Scan(&host); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to backfill sites: %w", err)
+		}
+		hosts = append(hosts, host)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to backfill sites: %w", err)
+	}
+
+	for _, host := range hosts {
+		if _, err := tx.Exec(`UPDATE requests SET site = ? WHERE host = ?`, siteOf(host), host); err != nil {
+			return fmt.Errorf("failed to backfill sites: %w", err)
+		}
+	}
+	return nil
+}
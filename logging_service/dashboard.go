@@ -0,0 +1,322 @@
+package logging_service
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// maxDashboardBuckets bounds the chart size so a tiny bucket over a long range
+// can't produce a huge payload
+const maxDashboardBuckets = 5000
+
+// dashboardRecentRequests is how many of the newest raw rows come with the
+// dashboard; older ones are paged through with QueryRequests
+const dashboardRecentRequests = 100
+
+// DashboardQuery selects the dashboard range and how the chart is bucketed
+type DashboardQuery struct {
+	Start int64 `json:"start"` // unix milliseconds, inclusive
+	End   int64 `json:"end"`   // unix milliseconds, inclusive; 0 means now
+
+	// BucketMinutes is the chart bucket size; 0 picks one from the range length.
+	// Buckets are aligned to local midnight, and buckets of whole days follow
+	// calendar days, so they stay correct across DST changes. Edges that fall
+	// inside a UTC hour, as in half-hour offset zones, are counted from minute
+	// rollups and raw rows. Once those are pruned, such an edge counts the
+	// whole hour (or day) around it, in the earlier of its two buckets.
+	BucketMinutes int `json:"bucketMinutes"`
+	// Timezone is an IANA name such as "Europe/Berlin"; empty uses the system timezone.
+	Timezone string `json:"timezone"`
+}
+
+// GetDashboardDataRange retrieves dashboard data for an explicit range. The
+// chart and totals come from the rollups, with the partial buckets at the
+// edges counted from finer levels; Requests only holds the newest raw rows,
+// so the cost does not grow with the range.
+func (l *LoggingService) GetDashboardDataRange(q DashboardQuery) (*DashboardData, error) {
+	if l == nil || l.DbService.Db == nil {
+		return nil, fmt.Errorf("logging service not ready")
+	}
+
+	if q.End == 0 {
+		q.End = l.clock().UnixMilli()
+	}
+	if q.Start >= q.End {
+		return nil, fmt.Errorf("start must be before end")
+	}
+	if q.BucketMinutes < 0 {
+		return nil, fmt.Errorf("bucket size must not be negative")
+	}
+	if q.BucketMinutes == 0 {
+		q.BucketMinutes = autoBucketMinutes(time.Duration(q.End-q.Start) * time.Millisecond)
+	}
+
+	loc := time.Local
+	if q.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(q.Timezone); err != nil {
+			return nil, fmt.Errorf("unknown timezone %q", q.Timezone)
+		}
+	}
+
+	start, end := time.UnixMilli(q.Start), time.UnixMilli(q.End)
+	boundaries := bucketBoundaries(start, end, q.BucketMinutes, loc)
+	if len(boundaries) > maxDashboardBuckets {
+		return nil, fmt.Errorf("range needs %d buckets, the limit is %d", len(boundaries), maxDashboardBuckets)
+	}
+
+	connections, err := l.newRangeCounter(q.Start, q.End+1).bucket(boundaries)
+	if err != nil {
+		return nil, err
+	}
+
+	data := &DashboardData{
+		Start:         q.Start,
+		End:           q.End,
+		BucketMinutes: q.BucketMinutes,
+		Timezone:      loc.String(),
+		Connections:   connections,
+	}
+	for _, c := range connections {
+		data.TotalRequests += c.Count
+		data.ApprovedCount += c.Approved
+		data.RejectedCount += c.Rejected
+		data.WouldRejectCount += c.WouldReject
+	}
+
+	rows, err := l.DbService.Db.Query(`
+		SELECT `+requestColumns+`
+		FROM requests
+		WHERE timestamp >= ? AND timestamp <= ?
+		ORDER BY timestamp DESC
+		LIMIT ?
+	`, q.Start, q.End, dashboardRecentRequests)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query data: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r, err := scanRequest(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		data.Requests = append(data.Requests, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return data, nil
+}
+
+// autoBucketMinutes picks a bucket size giving a readable number of points
+func autoBucketMinutes(span time.Duration) int {
+	switch {
+	case span <= 2*time.Hour:
+		return 5
+	case span <= 12*time.Hour:
+		return 30
+	case span <= 48*time.Hour:
+		return 60
+	case span <= 14*24*time.Hour:
+		return 360
+	case span <= 120*24*time.Hour:
+		return 1440
+	default:
+		return 7 * 1440
+	}
+}
+
+// bucketBoundaries returns the start of every bucket overlapping [start, end].
+// Sub-day buckets restart at each local midnight; whole-day buckets step by
+// calendar days, so a DST day is a 23 or 25 hour bucket.
+func bucketBoundaries(start, end time.Time, bucketMinutes int, loc *time.Location) []time.Time {
+	local := start.In(loc)
+	day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+
+	var all []time.Time
+	if bucketMinutes%1440 == 0 {
+		days := bucketMinutes / 1440
+		for t := day; !t.After(end); t = t.AddDate(0, 0, days) {
+			all = append(all, t)
+		}
+	} else {
+		width := time.Duration(bucketMinutes) * time.Minute
+		for ; !day.After(end); day = day.AddDate(0, 0, 1) {
+			next := day.AddDate(0, 0, 1)
+			for t := day; t.Before(next) && !t.After(end); t = t.Add(width) {
+				all = append(all, t)
+			}
+		}
+	}
+
+	// Drop buckets that end before the range starts
+	first := 0
+	for first+1 < len(all) && !all[first+1].After(start) {
+		first++
+	}
+	return all[first:]
+}
+
+// rangeCounter counts the requests in spans of [start, end). A span is
+// covered by the coarsest rollup buckets that fit inside it, and its edges
+// by finer levels and finally the raw rows, so a bucket straddling the range
+// or a chart bucket edge is never counted in full. Only where the finer data
+// has been pruned does an edge fall back to the whole bucket around it.
+type rangeCounter struct {
+	l          *LoggingService
+	start, end int64 // unix milliseconds, end exclusive
+	levels     []counterLevel
+	rawSince   int64              // raw rows older than this may have been pruned
+	whole      map[rollupKey]bool // buckets already counted in full for an edge
+}
+
+// counterLevel is one rollup resolution, with its buckets in the range
+type counterLevel struct {
+	res     rollupResolution
+	since   int64 // buckets older than this may have been pruned
+	buckets []rollupBucket
+	loaded  bool
+}
+
+func (l *LoggingService) newRangeCounter(start, end int64) *rangeCounter {
+	now := l.clock()
+	c := &rangeCounter{l: l, start: start, end: end, rawSince: math.MinInt64, whole: map[rollupKey]bool{}}
+	if days := l.GetRetentionPolicy().MaxAgeDays; days > 0 {
+		c.rawSince = now.AddDate(0, 0, -days).UnixMilli()
+	}
+	// Coarsest first
+	for i := len(rollupResolutions) - 1; i >= 0; i-- {
+		res := rollupResolutions[i]
+		level := counterLevel{res: res, since: math.MinInt64}
+		if res.keep != 0 {
+			level.since = now.Add(-res.keep).UnixMilli()
+		}
+		c.levels = append(c.levels, level)
+	}
+	return c
+}
+
+// bucket counts the chart buckets starting at boundaries and returns the
+// non-empty ones, oldest first
+func (c *rangeCounter) bucket(boundaries []time.Time) ([]ConnectionData, error) {
+	var connections []ConnectionData
+	for i, b := range boundaries {
+		from, to := max(b.UnixMilli(), c.start), c.end
+		if i+1 < len(boundaries) {
+			to = min(boundaries[i+1].UnixMilli(), to)
+		}
+		counts, err := c.count(from, to, 0)
+		if err != nil {
+			return nil, err
+		}
+		if counts.total == 0 {
+			continue
+		}
+		connections = append(connections, ConnectionData{
+			Timestamp:   b.UnixMilli(),
+			Count:       counts.total,
+			Approved:    counts.approved,
+			Rejected:    counts.rejected,
+			WouldReject: counts.wouldReject,
+		})
+	}
+	return connections, nil
+}
+
+// count returns the requests in [from, to), starting with levels[level]
+func (c *rangeCounter) count(from, to int64, level int) (rollupCounts, error) {
+	var counts rollupCounts
+	if from >= to {
+		return counts, nil
+	}
+	for ; level < len(c.levels); level++ {
+		lv := &c.levels[level]
+		w := lv.res.width
+		lo, hi := (from+w-1)/w*w, to/w*w
+		if lo >= hi || lo < lv.since {
+			continue
+		}
+		inner, err := c.sum(lv, lo, hi)
+		if err != nil {
+			return counts, err
+		}
+		head, err := c.count(from, lo, level+1)
+		if err != nil {
+			return counts, err
+		}
+		tail, err := c.count(hi, to, level+1)
+		if err != nil {
+			return counts, err
+		}
+		counts.add(inner)
+		counts.add(head)
+		counts.add(tail)
+		return counts, nil
+	}
+	if from >= c.rawSince {
+		return c.countRaw(from, to)
+	}
+	return c.wholeBuckets(from, to)
+}
+
+// sum adds up the buckets of lv in [from, to)
+func (c *rangeCounter) sum(lv *counterLevel, from, to int64) (rollupCounts, error) {
+	var counts rollupCounts
+	if !lv.loaded {
+		buckets, err := c.l.readRollups(lv.res, c.start, c.end-1)
+		if err != nil {
+			return counts, err
+		}
+		lv.buckets, lv.loaded = buckets, true
+	}
+	i := sort.Search(len(lv.buckets), func(i int) bool { return lv.buckets[i].bucket >= from })
+	for ; i < len(lv.buckets) && lv.buckets[i].bucket < to; i++ {
+		counts.add(lv.buckets[i].rollupCounts)
+	}
+	return counts, nil
+}
+
+// countRaw counts the raw rows in [from, to)
+func (c *rangeCounter) countRaw(from, to int64) (rollupCounts, error) {
+	var counts rollupCounts
+	err := c.l.DbService.Db.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(decision IN ('approved', 'would_reject')), 0),
+			COALESCE(SUM(decision = 'rejected'), 0), COALESCE(SUM(decision = 'would_reject'), 0)
+		FROM requests
+		WHERE timestamp >= ? AND timestamp < ?
+	`, from, to).Scan(&counts.total, &counts.approved, &counts.rejected, &counts.wouldReject)
+	if err != nil {
+		return counts, fmt.Errorf("failed to count requests: %w", err)
+	}
+	return counts, nil
+}
+
+// wholeBuckets counts the finest remaining buckets overlapping [from, to) in
+// full, each only once, for an edge whose finer data has been pruned
+func (c *rangeCounter) wholeBuckets(from, to int64) (rollupCounts, error) {
+	var counts rollupCounts
+	for level := len(c.levels) - 1; level >= 0; level-- {
+		lv := &c.levels[level]
+		if from < lv.since {
+			continue
+		}
+		w := lv.res.width
+		for b := from / w * w; b < to; b += w {
+			key := rollupKey{lv.res.name, b}
+			if c.whole[key] {
+				continue
+			}
+			c.whole[key] = true
+			bucket, err := c.sum(lv, b, b+w)
+			if err != nil {
+				return counts, err
+			}
+			counts.add(bucket)
+		}
+		return counts, nil
+	}
+	return counts, nil
+}
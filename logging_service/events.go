@@ -0,0 +1,66 @@
+package logging_service
+
+import (
+	"time"
+
+	"github.com/wailsapp/wails/v3/pkg/application"
+)
+
+const (
+	// RequestsEvent carries RequestsEventData with newly logged requests.
+	RequestsEvent = "logging:requests"
+
+	// eventInterval is the minimum time between two RequestsEvent emissions
+	eventInterval = 250 * time.Millisecond
+	// maxEventBatch caps the number of requests sent in one event
+	maxEventBatch = 200
+)
+
+// RequestsEventData is the payload of RequestsEvent
+type RequestsEventData struct {
+	Requests []RequestDetail `json:"requests"`
+	// Skipped counts requests left out because the batch was full; they are
+	// still in the database and visible through GetDashboardData.
+	Skipped int `json:"skipped"`
+}
+
+// eventBatcher collects logged requests and emits them in rate-limited batches.
+// It is only used from the consumer goroutine and needs no locking.
+type eventBatcher struct {
+	pending []RequestDetail
+	skipped int
+	emit    func(RequestsEventData)
+}
+
+func newEventBatcher(emit func(RequestsEventData)) *eventBatcher {
+	return &eventBatcher{emit: emit}
+}
+
+// add queues a request for the next batch
+func (b *eventBatcher) add(r RequestDetail) {
+	if len(b.pending) >= maxEventBatch {
+		b.skipped++
+		return
+	}
+	b.pending = append(b.pending, r)
+}
+
+// flush emits the pending batch, if any
+func (b *eventBatcher) flush() {
+	if len(b.pending) == 0 && b.skipped == 0 {
+		return
+	}
+	b.emit(RequestsEventData{Requests: b.pending, Skipped: b.skipped})
+	b.pending = nil
+	b.skipped = 0
+}
+
+// emitRequestsEvent sends a batch to the frontend. Without a Wails app
+// (headless mode, tests) there is nobody to notify.
+func emitRequestsEvent(data RequestsEventData) {
+	app := application.Get()
+	if app == nil {
+		return
+	}
+	app.Event.Emit(RequestsEvent, data)
+}
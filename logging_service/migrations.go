@@ -0,0 +1,159 @@
+package logging_service
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// schemaName is the row of schema_versions that counts the applied
+// requestMigrations. PRAGMA user_version already belongs to the rules
+// schema of db_service, which shares the database file.
+const schemaName = "requests"
+
+// migration is one step of the request log schema
+type migration struct {
+	sql string
+	// backfill, when set, runs after sql in the same transaction
+	backfill func(tx *sql.Tx) error
+	// marker is a column of a step that shipped before schema versions were
+	// recorded. Databases from that time already have the step when the
+	// column exists, since the columns used to be added on startup.
+	marker [2]string
+}
+
+// requestMigrations create and upgrade the request log. They run in order,
+// each in its own transaction, and schema_versions records how many have
+// been applied. Append new steps; never edit one that has shipped.
+var requestMigrations = []migration{
+	// 1: the request log
+	{sql: `CREATE TABLE IF NOT EXISTS requests (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp INTEGER NOT NULL,
+		host TEXT NOT NULL,
+		method TEXT NOT NULL,
+		path TEXT NOT NULL,
+		port INTEGER NOT NULL,
+		decision TEXT NOT NULL,
+		duration REAL NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_requests_timestamp ON requests(timestamp);
+	CREATE INDEX IF NOT EXISTS idx_requests_decision ON requests(decision);
+	CREATE INDEX IF NOT EXISTS idx_requests_host ON requests(host);`},
+
+	// 2: per-minute, hour and day counts for the dashboard, filled from the
+	// rows logged so far
+	{sql: `CREATE TABLE request_rollups (
+		resolution TEXT NOT NULL,
+		bucket INTEGER NOT NULL,
+		total INTEGER NOT NULL DEFAULT 0,
+		approved INTEGER NOT NULL DEFAULT 0,
+		rejected INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (resolution, bucket)
+	) WITHOUT ROWID;`, backfill: backfillRollups, marker: [2]string{"request_rollups", "resolution"}},
+
+	// 3: the rule that decided a request, and indexes backing the
+	// QueryRequests filters; each ends in (timestamp, id) so filtered pages
+	// can be read in order without sorting
+	{sql: `ALTER TABLE requests ADD COLUMN rule TEXT NOT NULL DEFAULT '';
+	CREATE INDEX IF NOT EXISTS idx_requests_decision_ts ON requests(decision, timestamp, id);
+	CREATE INDEX IF NOT EXISTS idx_requests_method_ts ON requests(method, timestamp, id);
+	CREATE INDEX IF NOT EXISTS idx_requests_port_ts ON requests(port, timestamp, id);
+	CREATE INDEX IF NOT EXISTS idx_requests_rule_ts ON requests(rule, timestamp, id) WHERE rule <> '';`,
+		marker: [2]string{"requests", "rule"}},
+
+	// 4: the registrable domain of the host, for the site analytics
+	{sql: `ALTER TABLE requests ADD COLUMN site TEXT NOT NULL DEFAULT '';`,
+		backfill: backfillSites, marker: [2]string{"requests", "site"}},
+
+	// 5: tunnel measurements
+	{sql: `ALTER TABLE requests ADD COLUMN dial_duration INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE requests ADD COLUMN first_byte_duration INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE requests ADD COLUMN open_duration INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE requests ADD COLUMN bytes_up INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE requests ADD COLUMN bytes_down INTEGER NOT NULL DEFAULT 0;`,
+		marker: [2]string{"requests", "dial_duration"}},
+
+	// 6: the local process that opened the connection
+	{sql: `ALTER TABLE requests ADD COLUMN process_name TEXT NOT NULL DEFAULT '';
+	ALTER TABLE requests ADD COLUMN process_path TEXT NOT NULL DEFAULT '';`,
+		marker: [2]string{"requests", "process_name"}},
+
+	// 7: requests a log-only rule would have rejected
+	{sql: `ALTER TABLE request_rollups ADD COLUMN would_reject INTEGER NOT NULL DEFAULT 0;`,
+		marker: [2]string{"request_rollups", "would_reject"}},
+
+	// 8: why a request was rejected
+	{sql: `ALTER TABLE requests ADD COLUMN reason TEXT NOT NULL DEFAULT '';`,
+		marker: [2]string{"requests", "reason"}},
+
+	// 9: the authenticated proxy user
+	{sql: `ALTER TABLE requests ADD COLUMN username TEXT NOT NULL DEFAULT '';`,
+		marker: [2]string{"requests", "username"}},
+}
+
+// migrate applies the request migrations the database has not seen yet.
+// A database from before schema versions were recorded starts at the first
+// step and skips the ones whose marker column it already has.
+func migrate(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_versions (
+		name TEXT PRIMARY KEY,
+		version INTEGER NOT NULL
+	)`); err != nil {
+		return fmt.Errorf("failed to create schema_versions: %w", err)
+	}
+	var version int
+	err := db.QueryRow(`SELECT version FROM schema_versions WHERE name = ?`, schemaName).Scan(&version)
+	recorded := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	for i := version; i < len(requestMigrations); i++ {
+		if err := applyMigration(db, i, !recorded); err != nil {
+			return fmt.Errorf("request migration %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// applyMigration runs step i and records it in one transaction
+func applyMigration(db *sql.DB, i int, legacy bool) error {
+	m := requestMigrations[i]
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	applied := false
+	if legacy && m.marker[0] != "" {
+		if applied, err = hasColumn(tx, m.marker[0], m.marker[1]); err != nil {
+			return err
+		}
+	}
+	if !applied {
+		if _, err := tx.Exec(m.sql); err != nil {
+			return err
+		}
+		if m.backfill != nil {
+			if err := m.backfill(tx); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_versions (name, version) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET version = excluded.version`, schemaName, i+1); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// hasColumn reports whether table exists and has column
+func hasColumn(tx *sql.Tx, table, column string) (bool, error) {
+	var exists bool
+	err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM pragma_table_info(?) WHERE name = ?)`, table, column).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect %s: %w", table, err)
+	}
+	return exists, nil
+}
@@ -0,0 +1,223 @@
+package logging_service
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// sortColumns maps the sort options accepted by QueryRequests to columns
+var sortColumns = map[string]string{
+	"":          "timestamp",
+	"timestamp": "timestamp",
+	"host":      "host",
+	"port":      "port",
+	"duration":  "duration",
+}
+
+// RequestQuery selects a page of logged requests. Zero values disable a filter.
+type RequestQuery struct {
+	Host     string `json:"host"` // case-insensitive substring
+	Decision string `json:"decision"`
+	Method   string `json:"method"`
+	Port     int    `json:"port"`
+	Rule     string `json:"rule"`
+	Reason   string `json:"reason"`
+	User     string `json:"user"`
+	Start    int64  `json:"start"` // unix milliseconds, inclusive
+	End      int64  `json:"end"`   // unix milliseconds, inclusive
+
+	// SortBy is one of timestamp (default), host, port or duration.
+	SortBy    string `json:"sortBy"`
+	Ascending bool   `json:"ascending"`
+
+	// Cursor is the NextCursor of the previous page; empty for the first page.
+	Cursor string `json:"cursor"`
+	Limit  int    `json:"limit"`
+}
+
+// RequestPage is one page of QueryRequests results
+type RequestPage struct {
+	Requests []RequestDetail `json:"requests"`
+	// NextCursor fetches the following page; empty on the last page.
+	NextCursor string `json:"nextCursor"`
+	// Total is the number of requests matching the filters across all pages.
+	Total int64 `json:"total"`
+}
+
+// pageCursor marks the last row of a page by its sort value and id
+type pageCursor struct {
+	Value any   `json:"v"`
+	ID    int64 `json:"id"`
+}
+
+// QueryRequests returns a filtered, sorted page of the request log. Pages are
+// keyset-paginated on (sort column, id), so they stay stable while new
+// requests are logged.
+func (l *LoggingService) QueryRequests(q RequestQuery) (*RequestPage, error) {
+	if l == nil || l.DbService.Db == nil {
+		return nil, fmt.Errorf("logging service not ready")
+	}
+
+	column, ok := sortColumns[q.SortBy]
+	if !ok {
+		return nil, fmt.Errorf("unsupported sort option %q", q.SortBy)
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	where, args := q.filters()
+
+	page := &RequestPage{Requests: []RequestDetail{}}
+	countSQL := `SELECT COUNT(*) FROM requests` + whereClause(where)
+	if err := l.DbService.Db.QueryRow(countSQL, args...).Scan(&page.Total); err != nil {
+		return nil, fmt.Errorf("failed to count requests: %w", err)
+	}
+
+	order, cmp := "DESC", "<"
+	if q.Ascending {
+		order, cmp = "ASC", ">"
+	}
+	if q.Cursor != "" {
+		cursor, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		where = append(where, fmt.Sprintf("(%s, id) %s (?, ?)", column, cmp))
+		args = append(args, cursor.Value, cursor.ID)
+	}
+
+	// Fetch one extra row to know whether another page follows
+	query := `SELECT ` + requestColumns + ` FROM requests` +
+		whereClause(where) +
+		fmt.Sprintf(` ORDER BY %s %s, id %s LIMIT ?`, column, order, order)
+	rows, err := l.DbService.Db.Query(query, append(args, limit+1)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query requests: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r, err := scanRequest(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		page.Requests = append(page.Requests, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	if len(page.Requests) > limit {
+		page.Requests = page.Requests[:limit]
+		last := page.Requests[limit-1]
+		page.NextCursor = encodeCursor(pageCursor{Value: last.sortValue(column), ID: last.ID})
+	}
+	return page, nil
+}
+
+// filters returns the WHERE conditions and their arguments
+func (q RequestQuery) filters() ([]string, []any) {
+	var where []string
+	var args []any
+	if q.Host != "" {
+		where = append(where, `host LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+likeEscaper.Replace(q.Host)+"%")
+	}
+	if q.Decision != "" {
+		where = append(where, "decision = ?")
+		args = append(args, q.Decision)
+	}
+	if q.Method != "" {
+		where = append(where, "method = ?")
+		args = append(args, strings.ToUpper(q.Method))
+	}
+	if q.Port != 0 {
+		where = append(where, "port = ?")
+		args = append(args, q.Port)
+	}
+	if q.Rule != "" {
+		where = append(where, "rule = ?")
+		args = append(args, q.Rule)
+	}
+	if q.Reason != "" {
+		where = append(where, "reason = ?")
+		args = append(args, q.Reason)
+	}
+	if q.User != "" {
+		where = append(where, "username = ?")
+		args = append(args, q.User)
+	}
+	if q.Start != 0 {
+		where = append(where, "timestamp >= ?")
+		args = append(args, q.Start)
+	}
+	if q.End != 0 {
+		where = append(where, "timestamp <= ?")
+		args = append(args, q.End)
+	}
+	return where, args
+}
+
+// likeEscaper escapes LIKE wildcards so host filters match literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func whereClause(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conditions, " AND ")
+}
+
+// sortValue returns the value of the sort column for cursor encoding
+func (r RequestDetail) sortValue(column string) any {
+	switch column {
+	case "host":
+		return r.Host
+	case "port":
+		return r.Port
+	case "duration":
+		return r.Duration
+	default:
+		return r.Timestamp
+	}
+}
+
+func encodeCursor(c pageCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (pageCursor, error) {
+	var c pageCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, fmt.Errorf("invalid cursor")
+	}
+	// Keep integers exact instead of decoding them as float64
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&c); err != nil {
+		return c, fmt.Errorf("invalid cursor")
+	}
+	if n, ok := c.Value.(json.Number); ok {
+		if i, err := n.Int64(); err == nil {
+			c.Value = i
+		} else if f, err := n.Float64(); err == nil {
+			c.Value = f
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,330 @@
+package logging_service
+
+import (
+	"changeme/metrics_service"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// retentionSettingKey stores the RetentionPolicy as JSON in the settings table
+	retentionSettingKey = "logging.retention"
+
+	// pruneInterval is how often the background job enforces the policy
+	pruneInterval = time.Hour
+	// pruneChunkSize bounds the rows deleted per statement so the writer is never blocked for long
+	pruneChunkSize = 5000
+	// pruneChunkPause lets queued log writes in between two chunks
+	pruneChunkPause = 10 * time.Millisecond
+	// vacuumPages is the number of free pages returned to the OS per prune run
+	vacuumPages = 10000
+)
+
+var prunedRows = metrics_service.NewCounterVec("local_proxy_log_pruned_rows_total",
+	"Request log rows deleted by the retention job, by reason.", "reason")
+
+// RetentionPolicy limits how much request history is kept. Zero disables a limit.
+type RetentionPolicy struct {
+	MaxAgeDays int   `json:"maxAgeDays"`
+	MaxRows    int64 `json:"maxRows"`
+	MaxSizeMB  int64 `json:"maxSizeMB"`
+}
+
+// DefaultRetentionPolicy keeps 90 days, comfortably more than the longest dashboard range.
+var DefaultRetentionPolicy = RetentionPolicy{MaxAgeDays: 90}
+
+// PruneReport describes what a retention run deleted
+type PruneReport struct {
+	StartedAt     int64 `json:"startedAt"`
+	DurationMs    int64 `json:"durationMs"`
+	ByAge         int64 `json:"byAge"`
+	ByRows        int64 `json:"byRows"`
+	BySize        int64 `json:"bySize"`
+	RollupRows    int64 `json:"rollupRows"`
+	RemainingRows int64 `json:"remainingRows"`
+	SizeBytes     int64 `json:"sizeBytes"`
+	FreedPages    int64 `json:"freedPages"`
+	// CompactionNeeded is set when the database predates incremental vacuum,
+	// so pruned pages stay in the file until CompactDatabase is run
+	CompactionNeeded bool `json:"compactionNeeded"`
+}
+
+// Total returns the number of rows deleted for any reason
+func (r PruneReport) Total() int64 { return r.ByAge + r.ByRows + r.BySize }
+
+// GetRetentionPolicy returns the configured policy, or the default when unset.
+func (l *LoggingService) GetRetentionPolicy() RetentionPolicy {
+	value, ok := l.DbService.GetSetting(retentionSettingKey)
+	if !ok {
+		return DefaultRetentionPolicy
+	}
+	var policy RetentionPolicy
+	if err := json.Unmarshal([]byte(value), &policy); err != nil {
+		log.Printf("warning: invalid retention policy %q: %v", value, err)
+		return DefaultRetentionPolicy
+	}
+	return policy
+}
+
+// SetRetentionPolicy stores the policy; it is applied on the next prune run.
+func (l *LoggingService) SetRetentionPolicy(policy RetentionPolicy) error {
+	if policy.MaxAgeDays < 0 || policy.MaxRows < 0 || policy.MaxSizeMB < 0 {
+		return fmt.Errorf("retention limits must not be negative")
+	}
+	value, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	if !l.DbService.SetSetting(retentionSettingKey, string(value)) {
+		return fmt.Errorf("failed to save retention policy")
+	}
+	return nil
+}
+
+// LastPruneReport returns the result of the most recent retention run, if any.
+func (l *LoggingService) LastPruneReport() *PruneReport {
+	l.pruneMu.Lock()
+	defer l.pruneMu.Unlock()
+	return l.lastPrune
+}
+
+// startRetention runs Prune right away and then every pruneInterval until stop is closed.
+func (l *LoggingService) startRetention(stop <-chan struct{}) {
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+
+		ticker := time.NewTicker(pruneInterval)
+		defer ticker.Stop()
+		for {
+			if _, err := l.Prune(); err != nil {
+				log.Printf("warning: log retention failed: %v", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Prune enforces the retention policy: rows older than MaxAgeDays go first,
+// then the oldest rows beyond MaxRows, then the oldest rows until the live
+// data fits in MaxSizeMB. Free pages are then handed back incrementally.
+func (l *LoggingService) Prune() (*PruneReport, error) {
+	db := l.DbService.Db
+	if db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+
+	// Only one run at a time
+	l.pruneMu.Lock()
+	running := l.pruning
+	l.pruning = true
+	l.pruneMu.Unlock()
+	if running {
+		return nil, fmt.Errorf("prune already running")
+	}
+	defer func() {
+		l.pruneMu.Lock()
+		l.pruning = false
+		l.pruneMu.Unlock()
+	}()
+
+	policy := l.GetRetentionPolicy()
+	start := l.clock()
+	report := &PruneReport{StartedAt: start.UnixMilli()}
+	var err error
+
+	if policy.MaxAgeDays > 0 {
+		cutoff := start.Add(-time.Duration(policy.MaxAgeDays) * 24 * time.Hour).UnixMilli()
+		report.ByAge, err = l.deleteChunks(`
+			DELETE FROM requests WHERE id IN (
+				SELECT id FROM requests WHERE timestamp < ? ORDER BY id LIMIT ?
+			)`, -1, cutoff)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if policy.MaxRows > 0 {
+		var rows int64
+		if err := db.QueryRow(`SELECT COUNT(*) FROM requests`).Scan(&rows); err != nil {
+			return nil, fmt.Errorf("failed to count requests: %w", err)
+		}
+		if excess := rows - policy.MaxRows; excess > 0 {
+			report.ByRows, err = l.deleteOldest(excess)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if policy.MaxSizeMB > 0 {
+		limit := policy.MaxSizeMB * 1024 * 1024
+		for {
+			used, err := l.usedBytes()
+			if err != nil {
+				return nil, err
+			}
+			if used <= limit {
+				break
+			}
+			deleted, err := l.deleteOldest(pruneChunkSize)
+			if err != nil {
+				return nil, err
+			}
+			if deleted == 0 {
+				// Nothing left to prune; the rest of the database is not ours
+				break
+			}
+			report.BySize += deleted
+		}
+	}
+
+	// Rollups outlive the raw rows but are thinned out per resolution
+	report.RollupRows, err = l.pruneRollups(start)
+	if err != nil {
+		return nil, err
+	}
+
+	mode, err := l.autoVacuumMode()
+	if err != nil {
+		return nil, err
+	}
+	report.CompactionNeeded = mode != autoVacuumIncremental
+	if !report.CompactionNeeded && (report.Total() > 0 || report.RollupRows > 0) {
+		report.FreedPages = l.incrementalVacuum()
+	}
+
+	if err := db.QueryRow(`SELECT COUNT(*) FROM requests`).Scan(&report.RemainingRows); err != nil {
+		return nil, fmt.Errorf("failed to count requests: %w", err)
+	}
+	if err := db.QueryRow(`SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()`).Scan(&report.SizeBytes); err != nil {
+		return nil, fmt.Errorf("failed to read database size: %w", err)
+	}
+	report.DurationMs = time.Since(start).Milliseconds()
+
+	prunedRows.Add(uint64(report.ByAge), "age")
+	prunedRows.Add(uint64(report.ByRows), "rows")
+	prunedRows.Add(uint64(report.BySize), "size")
+	if report.Total() > 0 {
+		log.Printf("Log retention pruned %d requests (age %d, rows %d, size %d), freed %d pages in %dms",
+			report.Total(), report.ByAge, report.ByRows, report.BySize, report.FreedPages, report.DurationMs)
+	}
+
+	l.pruneMu.Lock()
+	l.lastPrune = report
+	l.pruneMu.Unlock()
+	return report, nil
+}
+
+// deleteOldest removes up to n of the oldest requests in chunks
+func (l *LoggingService) deleteOldest(n int64) (int64, error) {
+	return l.deleteChunks(`
+		DELETE FROM requests WHERE id IN (
+			SELECT id FROM requests ORDER BY id LIMIT ?
+		)`, n)
+}
+
+// deleteChunks runs a chunked DELETE until it affects no rows or max rows are
+// gone (max < 0 means no limit). The statement's last parameter is the chunk
+// size, preceded by args.
+func (l *LoggingService) deleteChunks(query string, max int64, args ...any) (int64, error) {
+	var total int64
+	for max < 0 || total < max {
+		chunk := int64(pruneChunkSize)
+		if max >= 0 && max-total < chunk {
+			chunk = max - total
+		}
+		result, err := l.DbService.Db.Exec(query, append(args, chunk)...)
+		if err != nil {
+			return total, fmt.Errorf("failed to prune requests: %w", err)
+		}
+		deleted, _ := result.RowsAffected()
+		total += deleted
+		if deleted < chunk {
+			break
+		}
+		time.Sleep(pruneChunkPause)
+	}
+	return total, nil
+}
+
+// usedBytes returns the size of the pages holding live data
+func (l *LoggingService) usedBytes() (int64, error) {
+	var used int64
+	err := l.DbService.Db.QueryRow(`
+		SELECT (page_count - freelist_count) * page_size
+		FROM pragma_page_count(), pragma_freelist_count(), pragma_page_size()
+	`).Scan(&used)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read database size: %w", err)
+	}
+	return used, nil
+}
+
+// autoVacuumIncremental is the PRAGMA auto_vacuum value of INCREMENTAL
+const autoVacuumIncremental = 2
+
+// autoVacuumMode returns the database's auto_vacuum setting
+func (l *LoggingService) autoVacuumMode() (int, error) {
+	var mode int
+	if err := l.DbService.Db.QueryRow(`PRAGMA auto_vacuum`).Scan(&mode); err != nil {
+		return 0, fmt.Errorf("failed to read auto_vacuum: %w", err)
+	}
+	return mode, nil
+}
+
+// incrementalVacuum returns free pages to the OS and reports how many were
+// freed. The database must already use incremental auto_vacuum.
+func (l *LoggingService) incrementalVacuum() int64 {
+	db := l.DbService.Db
+
+	var before int64
+	if err := db.QueryRow(`PRAGMA freelist_count`).Scan(&before); err != nil {
+		log.Printf("warning: failed to read freelist: %v", err)
+		return 0
+	}
+	if _, err := db.Exec(fmt.Sprintf(`PRAGMA incremental_vacuum(%d)`, vacuumPages)); err != nil {
+		log.Printf("warning: incremental vacuum failed: %v", err)
+		return 0
+	}
+	var after int64
+	if err := db.QueryRow(`PRAGMA freelist_count`).Scan(&after); err != nil {
+		return 0
+	}
+	return before - after
+}
+
+// CompactDatabase rewrites the database with a full VACUUM, switching
+// databases created before incremental vacuum over to it so later prune runs
+// can give pages back on their own. The rewrite locks the database until it
+// is done, so it only runs when asked for.
+func (l *LoggingService) CompactDatabase() error {
+	db := l.DbService.Db
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	ctx := context.Background()
+	// The new auto_vacuum mode only sticks if VACUUM runs on the same connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get a connection: %w", err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	if _, err := conn.ExecContext(ctx, `PRAGMA auto_vacuum = INCREMENTAL`); err != nil {
+		return fmt.Errorf("failed to enable auto_vacuum: %w", err)
+	}
+	if _, err := conn.ExecContext(ctx, `VACUUM`); err != nil {
+		return fmt.Errorf("VACUUM failed: %w", err)
+	}
+	log.Printf("Compacted the database in %dms", time.Since(start).Milliseconds())
+	return nil
+}
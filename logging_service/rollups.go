@@ -0,0 +1,186 @@
+package logging_service
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// rollupResolution is one level of pre-aggregated request counts
+type rollupResolution struct {
+	name  string
+	width int64         // bucket width in milliseconds
+	keep  time.Duration // how long buckets are kept; 0 keeps them forever
+}
+
+// rollupResolutions are ordered from finest to coarsest. The dashboard reads
+// the coarsest level that fits inside each chart bucket and finer ones for
+// the rest.
+var rollupResolutions = []rollupResolution{
+	{name: "minute", width: time.Minute.Milliseconds(), keep: 7 * 24 * time.Hour},
+	{name: "hour", width: time.Hour.Milliseconds(), keep: 400 * 24 * time.Hour},
+	{name: "day", width: 24 * time.Hour.Milliseconds()},
+}
+
+// backfillRollups fills the new rollup table from the raw rows logged so far
+func backfillRollups(tx *sql.Tx) error {
+	for _, res := range rollupResolutions {
+		_, err := tx.Exec(`
+			INSERT INTO request_rollups (resolution, bucket, total, approved, rejected)
+			SELECT ?, (timestamp / ?) * ? AS bucket, COUNT(*),
+				SUM(decision IN ('approved', 'would_reject')), SUM(decision = 'rejected')
+			FROM requests
+			GROUP BY bucket
+		`, res.name, res.width, res.width)
+		if err != nil {
+			return fmt.Errorf("failed to backfill %s rollups: %w", res.name, err)
+		}
+	}
+	return nil
+}
+
+// rollupCounts accumulates the counts of one bucket
+type rollupCounts struct {
+	total, approved, rejected, wouldReject int64
+}
+
+func (c *rollupCounts) add(o rollupCounts) {
+	c.total += o.total
+	c.approved += o.approved
+	c.rejected += o.rejected
+	c.wouldReject += o.wouldReject
+}
+
+type rollupKey struct {
+	resolution string
+	bucket     int64
+}
+
+// aggregateRollups counts the written requests for every rollup level, so
+// each bucket is written once per batch
+func aggregateRollups(details []RequestDetail) map[rollupKey]*rollupCounts {
+	counts := make(map[rollupKey]*rollupCounts)
+	for _, detail := range details {
+		for _, res := range rollupResolutions {
+			key := rollupKey{res.name, detail.Timestamp / res.width * res.width}
+			c := counts[key]
+			if c == nil {
+				c = &rollupCounts{}
+				counts[key] = c
+			}
+			c.total++
+			switch detail.Decision {
+			case "approved":
+				c.approved++
+			case "rejected":
+				c.rejected++
+			case "would_reject":
+				c.approved++
+				c.wouldReject++
+			}
+		}
+	}
+	return counts
+}
+
+// mergeRollups adds the counts of from to counts
+func mergeRollups(counts, from map[rollupKey]*rollupCounts) {
+	for key, c := range from {
+		if counts[key] == nil {
+			counts[key] = &rollupCounts{}
+		}
+		counts[key].add(*c)
+	}
+}
+
+// updateRollups adds counts to the rollup tables within tx. It runs in a
+// savepoint: when it fails, the rollups are left as they were and the rest
+// of tx can still be committed.
+func updateRollups(tx *sql.Tx, counts map[rollupKey]*rollupCounts) (err error) {
+	if len(counts) == 0 {
+		return nil
+	}
+	if _, err := tx.Exec(`SAVEPOINT rollups`); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if _, rbErr := tx.Exec(`ROLLBACK TO rollups`); rbErr != nil {
+				err = fmt.Errorf("%w; rolling back: %v", err, rbErr)
+			}
+		}
+		if _, relErr := tx.Exec(`RELEASE rollups`); relErr != nil && err == nil {
+			err = relErr
+		}
+	}()
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO request_rollups (resolution, bucket, total, approved, rejected, would_reject)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (resolution, bucket) DO UPDATE SET
+			total = total + excluded.total,
+			approved = approved + excluded.approved,
+			rejected = rejected + excluded.rejected,
+			would_reject = would_reject + excluded.would_reject
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for key, c := range counts {
+		if _, err := stmt.Exec(key.resolution, key.bucket, c.total, c.approved, c.rejected, c.wouldReject); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollupBucket is one stored rollup row
+type rollupBucket struct {
+	bucket int64
+	rollupCounts
+}
+
+// readRollups returns the buckets of res between start and end, oldest first.
+// The first bucket may begin up to one resolution width before start.
+func (l *LoggingService) readRollups(res rollupResolution, start, end int64) ([]rollupBucket, error) {
+	rows, err := l.DbService.Db.Query(`
+		SELECT bucket, total, approved, rejected, would_reject
+		FROM request_rollups
+		WHERE resolution = ? AND bucket >= ? AND bucket <= ?
+		ORDER BY bucket
+	`, res.name, start/res.width*res.width, end)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query rollups: %w", err)
+	}
+	defer rows.Close()
+
+	var buckets []rollupBucket
+	for rows.Next() {
+		var b rollupBucket
+		if err := rows.Scan(&b.bucket, &b.total, &b.approved, &b.rejected, &b.wouldReject); err != nil {
+			return nil, fmt.Errorf("failed to scan rollup: %w", err)
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+// pruneRollups drops buckets older than their resolution keeps them
+func (l *LoggingService) pruneRollups(now time.Time) (int64, error) {
+	var total int64
+	for _, res := range rollupResolutions {
+		if res.keep == 0 {
+			continue
+		}
+		cutoff := now.Add(-res.keep).UnixMilli()
+		result, err := l.DbService.Db.Exec(`DELETE FROM request_rollups WHERE resolution = ? AND bucket < ?`, res.name, cutoff)
+		if err != nil {
+			return total, fmt.Errorf("failed to prune %s rollups: %w", res.name, err)
+		}
+		deleted, _ := result.RowsAffected()
+		total += deleted
+	}
+	return total, nil
+}
@@ -2,11 +2,14 @@ package logging_service
 
 import (
 	"changeme/db_service"
+	"changeme/metrics_service"
 	"context"
+	"database/sql"
 	"fmt"
 	"log"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/wailsapp/wails/v3/pkg/application"
@@ -15,24 +18,102 @@ import (
 
 // LogRequest represents a request to be logged
 type LogRequest struct {
-	Host     string
-	Method   string
-	Path     string
-	Port     int
-	Approved bool
-	Duration int64
+	Timestamp int64
+	Host      string
+	Method    string
+	Path      string
+	Port      int
+	Approved  bool
+	Duration  int64
+	// Rule is the pattern of the rule that decided the request, if any
+	Rule string
+	// WouldReject marks an approved request that a log-only rule matched;
+	// it is logged with the decision "would_reject" and still counts as approved.
+	WouldReject bool
+	// Reason says why the request was rejected, or would have been; one of
+	// the Reason constants, empty for approved requests
+	Reason string
+
+	// Tunnel measurements, all zero for requests that were not relayed.
+	// Durations are in nanoseconds; FirstByteDuration counts from the end
+	// of the dial and OpenDuration from the arrival of the request.
+	DialDuration      int64
+	FirstByteDuration int64
+	OpenDuration      int64
+	BytesUp           int64
+	BytesDown         int64
+
+	// ProcessName and ProcessPath identify the local application, when known
+	ProcessName string
+	ProcessPath string
+	// User is the authenticated proxy user, empty without authentication
+	User string
 }
 
+// Reasons recorded for rejected and would_reject requests
+const (
+	ReasonRule   = "rule"   // a block or log-only rule matched
+	ReasonPolicy = "policy" // no rule matched and the default policy denies
+	ReasonAsk    = "ask"    // the user denied it, or the prompt timed out
+	ReasonPort   = "port"   // the port is not allowed for tunnels
+	// ReasonPrivateNetwork is set when the destination resolved to an
+	// address in a range the network guard blocks
+	ReasonPrivateNetwork = "private_network"
+)
+
+const (
+	// logQueueSize is the number of entries buffered between producers and the writer
+	logQueueSize = 1000
+	// maxBatchSize and batchInterval bound how long entries wait before being written
+	maxBatchSize  = 200
+	batchInterval = 100 * time.Millisecond
+	// enqueueTimeout is how long LogRequest blocks on a full queue before dropping the entry
+	enqueueTimeout = time.Second
+)
+
+var (
+	droppedEntries = metrics_service.NewCounter("local_proxy_log_dropped_total",
+		"Log entries dropped because the log queue stayed full, the service was shutting down or the write failed.")
+	writeDuration = metrics_service.NewHistogram("local_proxy_log_write_duration_seconds",
+		"Time spent writing a batch of log entries to the database.", nil)
+	_ = metrics_service.NewGaugeFunc("local_proxy_log_queue_depth",
+		"Log entries waiting in the log channel.", func() float64 {
+			if l := Instance(); l != nil {
+				return float64(len(l.logChannel))
+			}
+			return 0
+		})
+)
+
 // LoggingService manages SQLite database operations for request logging
 type LoggingService struct {
 	DbService *db_service.DatabaseService
 	ctx       context.Context
 	options   application.ServiceOptions
 
-	// Channel-based logging
+	// Channel-based logging. closeMu guards closed so that logChannel is
+	// only closed once no producer can be sending on it.
 	logChannel chan LogRequest
-	stopChan   chan struct{}
+	closeMu    sync.RWMutex
+	closed     bool
+	dropped    atomic.Uint64
 	wg         sync.WaitGroup
+
+	// events batches processed requests for the frontend
+	events *eventBatcher
+
+	// pendingRollups holds the counts of committed requests whose rollup
+	// update failed; writeBatch retries them with the next batch
+	pendingRollups map[rollupKey]*rollupCounts
+
+	// now returns the current time; tests replace it with a fixed clock
+	now func() time.Time
+
+	// Retention job state
+	retentionStop chan struct{}
+	pruneMu       sync.Mutex
+	pruning       bool
+	lastPrune     *PruneReport
 }
 
 // singleton instance for easy access from other services
@@ -40,6 +121,17 @@ var instance *LoggingService
 
 func Instance() *LoggingService { return instance }
 
+// NewLoggingService creates a LoggingService on top of an open database and
+// makes sure the request tables exist. The returned service can be queried
+// directly; call ServiceStartup to also start the background consumer.
+func NewLoggingService(dbService *db_service.DatabaseService) (*LoggingService, error) {
+	service := &LoggingService{DbService: dbService}
+	if err := service.initDB(); err != nil {
+		return nil, err
+	}
+	return service, nil
+}
+
 func (l *LoggingService) ServiceName() string {
 	return "logging_service"
 }
@@ -54,32 +146,52 @@ func (l *LoggingService) ServiceStartup(ctx context.Context, options application
 	l.ctx = ctx
 	l.options = options
 
-	// Initialize channels
-	l.logChannel = make(chan LogRequest, 1000) // Buffer for 1000 pending requests
-	l.stopChan = make(chan struct{})
-
 	if err := l.initDB(); err != nil {
 		log.Printf("Logging Service init error: %v", err)
 		return err
 	}
 
-	// Start the consumer goroutine
-	l.startConsumer()
+	l.start(emitRequestsEvent)
 
+	l.retentionStop = make(chan struct{})
+	l.startRetention(l.retentionStop)
 	return nil
 }
 
-// ServiceShutdown is called when the app is shutting down
+// start creates the channels and runs the consumer; emit receives the batched live updates.
+func (l *LoggingService) start(emit func(RequestsEventData)) {
+	l.logChannel = make(chan LogRequest, logQueueSize)
+	l.events = newEventBatcher(emit)
+
+	// Start the consumer goroutine
+	l.startConsumer()
+}
+
+// ServiceShutdown is called when the app is shutting down. New entries are
+// refused first, then everything already queued is written and the retention
+// job has stopped before returning.
 func (l *LoggingService) ServiceShutdown() error {
-	// Signal the consumer to stop
-	close(l.stopChan)
+	if l.logChannel == nil {
+		return nil
+	}
 
-	// Wait for the consumer to finish processing
-	l.wg.Wait()
+	// Waits for in-flight LogRequest calls; later calls see closed and drop
+	l.closeMu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.logChannel)
+		if l.retentionStop != nil {
+			close(l.retentionStop)
+		}
+	}
+	l.closeMu.Unlock()
 
-	// Close the log channel
-	close(l.logChannel)
+	// Wait for the consumer to drain the channel
+	l.wg.Wait()
 
+	if n := l.dropped.Load(); n > 0 {
+		log.Printf("warning: %d request log entries were dropped", n)
+	}
 	return nil
 }
 
@@ -90,128 +202,260 @@ func (l *LoggingService) initDB() error {
 		return fmt.Errorf("database not initialized")
 	}
 
-	// Create the requests table if it doesn't exist
-	createTableSQL := `
-	CREATE TABLE IF NOT EXISTS requests (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		timestamp INTEGER NOT NULL,
-		host TEXT NOT NULL,
-		method TEXT NOT NULL,
-		path TEXT NOT NULL,
-		port INTEGER NOT NULL,
-		decision TEXT NOT NULL,
-		duration REAL NOT NULL
-	);
-	
-	CREATE INDEX IF NOT EXISTS idx_requests_timestamp ON requests(timestamp);
-	CREATE INDEX IF NOT EXISTS idx_requests_decision ON requests(decision);
-	CREATE INDEX IF NOT EXISTS idx_requests_host ON requests(host);
-	`
-
-	if _, err := db.Exec(createTableSQL); err != nil {
-		db.Close()
-		return fmt.Errorf("failed to create table: %w", err)
+	if err := migrate(db); err != nil {
+		return fmt.Errorf("failed to migrate request log: %w", err)
 	}
-
 	return nil
 }
 
-// startConsumer starts the background goroutine that processes log requests
+// clock returns the current time from the configured clock
+func (l *LoggingService) clock() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+	return time.Now()
+}
+
+// startConsumer starts the background goroutine that writes queued entries in batches
 func (l *LoggingService) startConsumer() {
 	l.wg.Add(1)
 	go func() {
 		defer l.wg.Done()
 
+		batch := make([]LogRequest, 0, maxBatchSize)
+		flush := func() {
+			if len(batch) > 0 {
+				l.writeBatch(batch)
+				batch = batch[:0]
+			}
+		}
+
+		batchTicker := time.NewTicker(batchInterval)
+		defer batchTicker.Stop()
+		// Live updates for the frontend go out at most once per interval
+		eventTicker := time.NewTicker(eventInterval)
+		defer eventTicker.Stop()
+
 		for {
 			select {
-			case logReq := <-l.logChannel:
-				l.processLogRequest(logReq)
-			case <-l.stopChan:
-				// Process any remaining requests in the channel
-				for {
-					select {
-					case logReq := <-l.logChannel:
-						l.processLogRequest(logReq)
-					default:
-						return
-					}
+			case logReq, ok := <-l.logChannel:
+				if !ok {
+					// Channel closed by ServiceShutdown and fully drained
+					flush()
+					l.events.flush()
+					return
+				}
+				batch = append(batch, logReq)
+				if len(batch) >= maxBatchSize {
+					flush()
 				}
+			case <-batchTicker.C:
+				flush()
+			case <-eventTicker.C:
+				l.events.flush()
 			}
 		}
 	}()
 }
 
-// processLogRequest processes a single log request and writes it to the database
-func (l *LoggingService) processLogRequest(logReq LogRequest) {
-	if l.DbService.Db == nil {
+// writeBatch writes the entries in a single transaction. Entries that could
+// not be written are counted as dropped. The raw rows are committed even
+// when the rollup update fails; its counts are retried with the next batch.
+func (l *LoggingService) writeBatch(batch []LogRequest) {
+	db := l.DbService.Db
+	if db == nil {
 		log.Printf("database not available for logging")
+		l.dropBatch(len(batch))
 		return
 	}
 
-	decision := "rejected"
-	if logReq.Approved {
-		decision = "approved"
+	start := time.Now()
+	defer func() { writeDuration.Observe(time.Since(start).Seconds()) }()
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("warning: failed to write %d request logs: %v", len(batch), err)
+		l.dropBatch(len(batch))
+		return
 	}
+	defer tx.Rollback()
 
-	timestamp := time.Now().UnixMilli()
+	stmt, err := tx.Prepare(`
+		INSERT INTO requests (timestamp, host, method, path, port, decision, duration, rule, site,
+			dial_duration, first_byte_duration, open_duration, bytes_up, bytes_down, process_name, process_path, reason, username)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		log.Printf("warning: failed to write %d request logs: %v", len(batch), err)
+		l.dropBatch(len(batch))
+		return
+	}
+	defer stmt.Close()
+
+	details := make([]RequestDetail, 0, len(batch))
+	for _, logReq := range batch {
+		detail := RequestDetail{
+			Timestamp: logReq.Timestamp,
+			Host:      logReq.Host,
+			Method:    strings.ToUpper(logReq.Method),
+			Path:      logReq.Path,
+			Port:      logReq.Port,
+			Decision:  "rejected",
+			Duration:  float64(logReq.Duration),
+			Rule:      logReq.Rule,
+
+			DialDuration:      logReq.DialDuration,
+			FirstByteDuration: logReq.FirstByteDuration,
+			OpenDuration:      logReq.OpenDuration,
+			BytesUp:           logReq.BytesUp,
+			BytesDown:         logReq.BytesDown,
+			ProcessName:       logReq.ProcessName,
+			ProcessPath:       logReq.ProcessPath,
+			Reason:            logReq.Reason,
+			User:              logReq.User,
+		}
+		if logReq.Approved {
+			detail.Decision = "approved"
+			if logReq.WouldReject {
+				detail.Decision = "would_reject"
+			}
+		}
 
-	_, err := l.DbService.Db.Exec(`
-		INSERT INTO requests (timestamp, host, method, path, port, decision, duration)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`, timestamp, logReq.Host, strings.ToUpper(logReq.Method), logReq.Path, logReq.Port, decision, float64(logReq.Duration))
+		result, err := stmt.Exec(detail.Timestamp, detail.Host, detail.Method, detail.Path, detail.Port, detail.Decision, detail.Duration, detail.Rule, siteOf(detail.Host),
+			detail.DialDuration, detail.FirstByteDuration, detail.OpenDuration, detail.BytesUp, detail.BytesDown,
+			detail.ProcessName, detail.ProcessPath, detail.Reason, detail.User)
+		if err != nil {
+			log.Printf("warning: failed to write request log: %v", err)
+			l.drop()
+			continue
+		}
+		detail.ID, _ = result.LastInsertId()
+		details = append(details, detail)
+	}
 
-	if err != nil {
-		log.Printf("warning: failed to write request log: %v", err)
+	counts := aggregateRollups(details)
+	mergeRollups(counts, l.pendingRollups)
+	rollupErr := updateRollups(tx, counts)
+	if rollupErr != nil {
+		log.Printf("warning: failed to update request rollups, retrying with the next batch: %v", rollupErr)
 	}
-}
 
-// LogRequest sends a request to be logged via the channel (non-blocking)
-func (l *LoggingService) LogRequest(host, method, path string, port int, approved bool, duration int64) {
-	if l == nil || l.logChannel == nil {
-		log.Printf("logging service not ready")
+	if err := tx.Commit(); err != nil {
+		log.Printf("warning: failed to commit %d request logs: %v", len(batch), err)
+		l.dropBatch(len(details))
 		return
 	}
+	if rollupErr != nil {
+		l.pendingRollups = counts
+	} else {
+		l.pendingRollups = nil
+	}
 
-	// Create log request struct
-	logReq := LogRequest{
+	if l.events != nil {
+		for _, detail := range details {
+			l.events.add(detail)
+		}
+	}
+}
+
+// LogRequest queues a request to be logged; see LogEntry.
+func (l *LoggingService) LogRequest(host, method, path string, port int, approved bool, duration int64) {
+	l.LogEntry(LogRequest{
 		Host:     host,
 		Method:   method,
 		Path:     path,
 		Port:     port,
 		Approved: approved,
 		Duration: duration,
+	})
+}
+
+// LogEntry queues a request to be logged. When the queue is full it blocks
+// for up to enqueueTimeout before dropping the entry; entries logged after
+// shutdown has started are dropped right away. Drops are counted.
+func (l *LoggingService) LogEntry(logReq LogRequest) {
+	if l == nil || l.logChannel == nil {
+		log.Printf("logging service not ready")
+		return
+	}
+	if logReq.Timestamp == 0 {
+		logReq.Timestamp = time.Now().UnixMilli()
+	}
+	host := logReq.Host
+
+	l.closeMu.RLock()
+	defer l.closeMu.RUnlock()
+	if l.closed {
+		l.drop()
+		return
 	}
 
-	// Send to channel (non-blocking with buffer)
 	select {
 	case l.logChannel <- logReq:
-		// Successfully queued for processing
+		return
 	default:
-		// Channel is full, log a warning but don't block
-		log.Printf("warning: log channel full, dropping request for %s", host)
+	}
+
+	// Queue is full: apply backpressure instead of dropping immediately
+	timer := time.NewTimer(enqueueTimeout)
+	defer timer.Stop()
+	select {
+	case l.logChannel <- logReq:
+	case <-timer.C:
+		if l.drop() == 1 {
+			log.Printf("warning: log queue full, dropping request for %s", host)
+		}
 	}
 }
 
+// drop counts a dropped entry and returns the total so far
+func (l *LoggingService) drop() uint64 {
+	droppedEntries.Inc()
+	return l.dropped.Add(1)
+}
+
+// dropBatch counts n entries that were lost while writing
+func (l *LoggingService) dropBatch(n int) {
+	if n == 0 {
+		return
+	}
+	droppedEntries.Add(uint64(n))
+	l.dropped.Add(uint64(n))
+}
+
+// DroppedEntries returns how many log entries were dropped since startup
+func (l *LoggingService) DroppedEntries() uint64 {
+	return l.dropped.Load()
+}
+
 // DashboardData represents aggregated data for the dashboard
 type DashboardData struct {
-	TimeRange     string           `json:"timeRange"`
-	TotalRequests int64            `json:"totalRequests"`
-	ApprovedCount int64            `json:"approvedCount"`
-	RejectedCount int64            `json:"rejectedCount"`
-	Connections   []ConnectionData `json:"connections"`
-	Requests      []RequestDetail  `json:"requests"`
+	TimeRange        string           `json:"timeRange"`
+	Start            int64            `json:"start"`
+	End              int64            `json:"end"`
+	BucketMinutes    int              `json:"bucketMinutes"`
+	Timezone         string           `json:"timezone"`
+	TotalRequests    int64            `json:"totalRequests"`
+	ApprovedCount    int64            `json:"approvedCount"`
+	RejectedCount    int64            `json:"rejectedCount"`
+	WouldRejectCount int64            `json:"wouldRejectCount"`
+	Connections      []ConnectionData `json:"connections"`
+	// Requests holds the newest raw rows of the range, at most 100
+	Requests []RequestDetail `json:"requests"`
 }
 
 // ConnectionData represents connection count over time
 type ConnectionData struct {
-	Timestamp int64 `json:"timestamp"`
-	Count     int64 `json:"count"`
-	Approved  int64 `json:"approved"`
-	Rejected  int64 `json:"rejected"`
+	Timestamp   int64 `json:"timestamp"`
+	Count       int64 `json:"count"`
+	Approved    int64 `json:"approved"`
+	Rejected    int64 `json:"rejected"`
+	WouldReject int64 `json:"wouldReject"`
 }
 
 // RequestDetail represents a detailed request entry
 type RequestDetail struct {
+	ID        int64   `json:"id"`
 	Timestamp int64   `json:"timestamp"`
 	Host      string  `json:"host"`
 	Method    string  `json:"method"`
@@ -219,16 +463,45 @@ type RequestDetail struct {
 	Port      int     `json:"port"`
 	Decision  string  `json:"decision"`
 	Duration  float64 `json:"duration"`
+	Rule      string  `json:"rule"`
+	// Reason is why the request was rejected or would have been, if it was
+	Reason string `json:"reason"`
+
+	// Tunnel measurements in nanoseconds and bytes; zero when not relayed
+	DialDuration      int64 `json:"dialDuration"`
+	FirstByteDuration int64 `json:"firstByteDuration"`
+	OpenDuration      int64 `json:"openDuration"`
+	BytesUp           int64 `json:"bytesUp"`
+	BytesDown         int64 `json:"bytesDown"`
+
+	// Local application that opened the connection, when known
+	ProcessName string `json:"processName"`
+	ProcessPath string `json:"processPath"`
+	// User is the authenticated proxy user, if any
+	User string `json:"user"`
+}
+
+// requestColumns are the requests columns read by scanRequest, in order
+const requestColumns = `id, timestamp, host, method, path, port, decision, duration, rule,
+	dial_duration, first_byte_duration, open_duration, bytes_up, bytes_down, process_name, process_path, reason, username`
+
+// scanRequest reads a row selected with requestColumns
+func scanRequest(rows *sql.Rows) (RequestDetail, error) {
+	var r RequestDetail
+	err := rows.Scan(&r.ID, &r.Timestamp, &r.Host, &r.Method, &r.Path, &r.Port, &r.Decision, &r.Duration, &r.Rule,
+		&r.DialDuration, &r.FirstByteDuration, &r.OpenDuration, &r.BytesUp, &r.BytesDown, &r.ProcessName, &r.ProcessPath, &r.Reason, &r.User)
+	return r, err
 }
 
-// GetDashboardData retrieves dashboard data for the specified time range
+// GetDashboardData retrieves dashboard data for one of the preset ranges
+// ("1h", "6h", "24h", "7d", "30d") ending now, bucketed in local time.
 func (l *LoggingService) GetDashboardData(timeRange string) (*DashboardData, error) {
 	if l == nil || l.DbService.Db == nil {
 		return nil, fmt.Errorf("logging service not ready")
 	}
 
 	// Calculate time boundaries based on range
-	now := time.Now()
+	now := l.clock()
 	var startTime time.Time
 
 	switch timeRange {
@@ -246,103 +519,63 @@ func (l *LoggingService) GetDashboardData(timeRange string) (*DashboardData, err
 		startTime = now.Add(-24 * time.Hour) // Default to 24h
 	}
 
-	startTimestamp := startTime.UnixMilli()
-	endTimestamp := now.UnixMilli()
-
-	// Query all requests in the time range
-	rows, err := l.DbService.Db.Query(`
-		SELECT timestamp, host, method, path, port, decision, duration
-		FROM requests
-		WHERE timestamp >= ? AND timestamp <= ?
-		ORDER BY timestamp DESC
-	`, startTimestamp, endTimestamp)
-
+	data, err := l.GetDashboardDataRange(DashboardQuery{
+		Start:         startTime.UnixMilli(),
+		End:           now.UnixMilli(),
+		BucketMinutes: getIntervalMinutes(timeRange),
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to query data: %w", err)
+		return nil, err
 	}
-	defer rows.Close()
-
-	// Process data
-	var connections []ConnectionData
-	var requests []RequestDetail
-	var totalRequests, approvedCount, rejectedCount int64
-
-	// Group by time intervals for connection chart
-	intervalMinutes := getIntervalMinutes(timeRange)
-	timeGroups := make(map[int64]*ConnectionData)
-
-	for rows.Next() {
-		var timestamp int64
-		var host, method, path, decision string
-		var port int
-		var duration float64
-
-		if err := rows.Scan(&timestamp, &host, &method, &path, &port, &decision, &duration); err != nil {
-			log.Printf("warning: failed to scan row: %v", err)
-			continue
-		}
-
-		// Calculate which time interval this point belongs to
-		intervalTime := (timestamp / (int64(intervalMinutes) * 60 * 1000)) * (int64(intervalMinutes) * 60 * 1000)
-
-		if timeGroups[intervalTime] == nil {
-			timeGroups[intervalTime] = &ConnectionData{
-				Timestamp: intervalTime,
-				Count:     0,
-				Approved:  0,
-				Rejected:  0,
-			}
-		}
+	data.TimeRange = timeRange
+	return data, nil
+}
 
-		// Update connection data
-		timeGroups[intervalTime].Count++
-		if decision == "approved" {
-			timeGroups[intervalTime].Approved++
-			approvedCount++
-		} else {
-			timeGroups[intervalTime].Rejected++
-			rejectedCount++
-		}
-		totalRequests++
-
-		// Add to requests detail
-		requests = append(requests, RequestDetail{
-			Timestamp: timestamp,
-			Host:      host,
-			Method:    method,
-			Path:      path,
-			Port:      port,
-			Decision:  decision,
-			Duration:  duration,
-		})
+// RequestsSince returns up to limit requests logged after the given id, oldest first.
+// Pass afterID 0 together with a limit to get the most recent entries.
+func (l *LoggingService) RequestsSince(afterID int64, limit int) ([]RequestDetail, error) {
+	if l == nil || l.DbService.Db == nil {
+		return nil, fmt.Errorf("logging service not ready")
+	}
+	if limit <= 0 {
+		limit = 100
 	}
 
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating rows: %w", err)
+	query := `
+		SELECT ` + requestColumns + `
+		FROM requests
+		WHERE id > ?
+		ORDER BY id ASC
+		LIMIT ?
+	`
+	if afterID == 0 {
+		// Newest rows, returned in chronological order
+		query = `
+			SELECT * FROM (
+				SELECT ` + requestColumns + `
+				FROM requests
+				WHERE id > ?
+				ORDER BY id DESC
+				LIMIT ?
+			) ORDER BY id ASC
+		`
 	}
 
-	// Convert time groups to slice and sort by timestamp
-	for _, conn := range timeGroups {
-		connections = append(connections, *conn)
+	rows, err := l.DbService.Db.Query(query, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query requests: %w", err)
 	}
+	defer rows.Close()
 
-	// Sort connections by timestamp
-	for i := 0; i < len(connections)-1; i++ {
-		for j := i + 1; j < len(connections); j++ {
-			if connections[i].Timestamp > connections[j].Timestamp {
-				connections[i], connections[j] = connections[j], connections[i]
-			}
+	var requests []RequestDetail
+	for rows.Next() {
+		r, err := scanRequest(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
 		}
+		requests = append(requests, r)
 	}
-
-	return &DashboardData{
-		TimeRange:     timeRange,
-		TotalRequests: totalRequests,
-		ApprovedCount: approvedCount,
-		RejectedCount: rejectedCount,
-		Connections:   connections,
-		Requests:      requests,
-	}, nil
+	return requests, rows.Err()
 }
 
 // getIntervalMinutes returns the appropriate interval in minutes for the given time range
@@ -0,0 +1,924 @@
+package logging_service
+
+import (
+	"changeme/db_service"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func setupTestService(t *testing.T) *LoggingService {
+	db, err := db_service.NewDBService(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create test db: %v", err)
+	}
+	t.Cleanup(func() { db.ServiceShutdown() })
+
+	service, err := NewLoggingService(db)
+	if err != nil {
+		t.Fatalf("Failed to create logging service: %v", err)
+	}
+	return service
+}
+
+func TestConsumer_EmitsBatchedEvents(t *testing.T) {
+	service := setupTestService(t)
+
+	var mu sync.Mutex
+	var events []RequestsEventData
+	service.start(func(data RequestsEventData) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, data)
+	})
+
+	service.LogRequest("allowed.com", "CONNECT", "", 443, true, 10)
+	service.LogRequest("blocked.com", "CONNECT", "", 443, false, 20)
+	service.ServiceShutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	var got []RequestDetail
+	for _, e := range events {
+		got = append(got, e.Requests...)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 requests across %d events, got %d", len(events), len(got))
+	}
+	if got[0].Host != "allowed.com" || got[0].Decision != "approved" || got[0].ID == 0 {
+		t.Fatalf("unexpected first request: %+v", got[0])
+	}
+	if got[1].Host != "blocked.com" || got[1].Decision != "rejected" {
+		t.Fatalf("unexpected second request: %+v", got[1])
+	}
+}
+
+func TestEventBatcher_CapsBatchSize(t *testing.T) {
+	var emitted []RequestsEventData
+	b := newEventBatcher(func(data RequestsEventData) { emitted = append(emitted, data) })
+
+	b.flush()
+	if len(emitted) != 0 {
+		t.Fatal("empty batch should not be emitted")
+	}
+
+	for i := 0; i < maxEventBatch+5; i++ {
+		b.add(RequestDetail{ID: int64(i + 1), Timestamp: time.Now().UnixMilli()})
+	}
+	b.flush()
+	if len(emitted) != 1 {
+		t.Fatalf("expected one event, got %d", len(emitted))
+	}
+	if len(emitted[0].Requests) != maxEventBatch || emitted[0].Skipped != 5 {
+		t.Fatalf("expected %d requests and 5 skipped, got %d and %d", maxEventBatch, len(emitted[0].Requests), emitted[0].Skipped)
+	}
+
+	b.flush()
+	if len(emitted) != 1 {
+		t.Fatal("batch should be reset after flushing")
+	}
+}
+
+func TestShutdown_DrainsQueueAndRefusesLateEntries(t *testing.T) {
+	service := setupTestService(t)
+	service.start(func(RequestsEventData) {})
+
+	// Producers keep logging while the service shuts down
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				service.LogRequest("example.com", "CONNECT", "", 443, true, 1)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := service.ServiceShutdown(); err != nil {
+		t.Fatalf("ServiceShutdown failed: %v", err)
+	}
+	wg.Wait()
+
+	service.LogRequest("late.com", "CONNECT", "", 443, true, 1)
+	if err := service.ServiceShutdown(); err != nil {
+		t.Fatalf("second ServiceShutdown failed: %v", err)
+	}
+
+	var written int64
+	if err := service.DbService.Db.QueryRow(`SELECT COUNT(*) FROM requests`).Scan(&written); err != nil {
+		t.Fatalf("count failed: %v", err)
+	}
+	if total := written + int64(service.DroppedEntries()); total != 801 {
+		t.Fatalf("expected every entry to be written or counted as dropped, got %d written + %d dropped",
+			written, service.DroppedEntries())
+	}
+}
+
+func TestWriteBatch_SingleTransaction(t *testing.T) {
+	service := setupTestService(t)
+
+	batch := make([]LogRequest, 50)
+	for i := range batch {
+		batch[i] = LogRequest{Timestamp: int64(i + 1), Host: "batch.com", Method: "connect", Port: 443, Approved: i%2 == 0}
+	}
+	service.writeBatch(batch)
+
+	requests, err := service.RequestsSince(0, 100)
+	if err != nil {
+		t.Fatalf("RequestsSince failed: %v", err)
+	}
+	if len(requests) != 50 {
+		t.Fatalf("expected 50 rows, got %d", len(requests))
+	}
+	if requests[0].Method != "CONNECT" || requests[0].Decision != "approved" || requests[1].Decision != "rejected" {
+		t.Fatalf("unexpected rows: %+v %+v", requests[0], requests[1])
+	}
+}
+
+func TestPrune_ByAgeAndRows(t *testing.T) {
+	service := setupTestService(t)
+
+	now := time.Now()
+	var batch []LogRequest
+	for i := 0; i < 30; i++ {
+		// Ten entries from 100 days ago, twenty recent ones
+		ts := now.Add(-time.Duration(i) * time.Minute)
+		if i < 10 {
+			ts = now.Add(-100 * 24 * time.Hour)
+		}
+		batch = append(batch, LogRequest{Timestamp: ts.UnixMilli(), Host: "h.com", Method: "CONNECT", Port: 443, Approved: true})
+	}
+	service.writeBatch(batch)
+
+	if err := service.SetRetentionPolicy(RetentionPolicy{MaxAgeDays: 90, MaxRows: 15}); err != nil {
+		t.Fatalf("SetRetentionPolicy failed: %v", err)
+	}
+	if got := service.GetRetentionPolicy(); got.MaxRows != 15 || got.MaxAgeDays != 90 {
+		t.Fatalf("policy not persisted: %+v", got)
+	}
+
+	report, err := service.Prune()
+	if err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if report.ByAge != 10 || report.ByRows != 5 || report.RemainingRows != 15 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if service.LastPruneReport() != report {
+		t.Fatal("LastPruneReport should return the latest run")
+	}
+
+	// The newest rows are the ones kept
+	requests, err := service.RequestsSince(0, 100)
+	if err != nil {
+		t.Fatalf("RequestsSince failed: %v", err)
+	}
+	if len(requests) != 15 || requests[0].ID != 16 {
+		t.Fatalf("expected ids 16-30 to remain, got %d rows starting at %d", len(requests), requests[0].ID)
+	}
+}
+
+func TestPrune_BySize(t *testing.T) {
+	service := setupTestService(t)
+
+	batch := make([]LogRequest, 5000)
+	for i := range batch {
+		batch[i] = LogRequest{Timestamp: time.Now().UnixMilli(), Host: fmt.Sprintf("host-%d.example.com", i), Method: "CONNECT", Path: strings.Repeat("x", 400), Port: 443}
+	}
+	service.writeBatch(batch)
+
+	if err := service.SetRetentionPolicy(RetentionPolicy{MaxSizeMB: 1}); err != nil {
+		t.Fatalf("SetRetentionPolicy failed: %v", err)
+	}
+	report, err := service.Prune()
+	if err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if report.BySize == 0 {
+		t.Fatalf("expected rows to be pruned by size: %+v", report)
+	}
+	used, err := service.usedBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used > 1024*1024 {
+		t.Fatalf("live data still %d bytes after pruning", used)
+	}
+}
+
+func TestPrune_LeavesOldDatabasesToCompactDatabase(t *testing.T) {
+	service := setupTestService(t)
+
+	// Databases from before incremental vacuum have auto_vacuum off
+	conn, err := service.DbService.Db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ExecContext(context.Background(), `PRAGMA auto_vacuum = NONE`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ExecContext(context.Background(), `VACUUM`); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	service.writeBatch([]LogRequest{{Timestamp: 1, Host: "old.example.com", Method: "CONNECT", Port: 443}})
+	report, err := service.Prune()
+	if err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if report.ByAge != 1 || !report.CompactionNeeded || report.FreedPages != 0 {
+		t.Fatalf("expected prune to skip vacuuming an old database: %+v", report)
+	}
+
+	if err := service.CompactDatabase(); err != nil {
+		t.Fatalf("CompactDatabase failed: %v", err)
+	}
+	if mode, err := service.autoVacuumMode(); err != nil || mode != autoVacuumIncremental {
+		t.Fatalf("expected incremental auto_vacuum after compacting, got %d (%v)", mode, err)
+	}
+	if report, err := service.Prune(); err != nil || report.CompactionNeeded {
+		t.Fatalf("expected no compaction to be needed, got %+v (%v)", report, err)
+	}
+}
+
+func TestDashboard_UsesRollupsThatSurvivePruning(t *testing.T) {
+	service := setupTestService(t)
+
+	now := time.Now()
+	service.writeBatch([]LogRequest{
+		{Timestamp: now.Add(-3 * time.Hour).UnixMilli(), Host: "a.com", Method: "CONNECT", Port: 443, Approved: true},
+		{Timestamp: now.Add(-3 * time.Hour).UnixMilli(), Host: "b.com", Method: "CONNECT", Port: 443},
+		{Timestamp: now.Add(-time.Minute).UnixMilli(), Host: "a.com", Method: "CONNECT", Port: 443, Approved: true},
+	})
+
+	// Raw rows are gone, e.g. after aggressive retention
+	if _, err := service.DbService.Db.Exec(`DELETE FROM requests`); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := service.GetDashboardData("24h")
+	if err != nil {
+		t.Fatalf("GetDashboardData failed: %v", err)
+	}
+	if data.TotalRequests != 3 || data.ApprovedCount != 2 || data.RejectedCount != 1 {
+		t.Fatalf("unexpected totals: %+v", data)
+	}
+	if len(data.Connections) != 2 || data.Connections[0].Count != 2 || data.Connections[1].Count != 1 {
+		t.Fatalf("expected two hourly buckets in order, got %+v", data.Connections)
+	}
+	if len(data.Requests) != 0 {
+		t.Fatalf("expected no raw requests, got %d", len(data.Requests))
+	}
+}
+
+func TestDashboard_CountsWouldReject(t *testing.T) {
+	service := setupTestService(t)
+
+	now := time.Now().UnixMilli()
+	service.writeBatch([]LogRequest{
+		{Timestamp: now, Host: "a.com", Method: "CONNECT", Port: 443, Approved: true},
+		{Timestamp: now, Host: "ads.com", Method: "CONNECT", Port: 443, Approved: true, WouldReject: true, Rule: "ads.com"},
+		{Timestamp: now, Host: "b.com", Method: "CONNECT", Port: 443},
+	})
+
+	data, err := service.GetDashboardData("1h")
+	if err != nil {
+		t.Fatalf("GetDashboardData failed: %v", err)
+	}
+	if data.TotalRequests != 3 || data.ApprovedCount != 2 || data.RejectedCount != 1 || data.WouldRejectCount != 1 {
+		t.Fatalf("unexpected totals: %+v", data)
+	}
+	page, err := service.QueryRequests(RequestQuery{Decision: "would_reject"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Requests) != 1 || page.Requests[0].Host != "ads.com" {
+		t.Fatalf("expected the would_reject request, got %+v", page.Requests)
+	}
+}
+
+func TestQueryRequests_FiltersByReason(t *testing.T) {
+	service := setupTestService(t)
+
+	now := time.Now().UnixMilli()
+	service.writeBatch([]LogRequest{
+		{Timestamp: now, Host: "a.com", Method: "CONNECT", Port: 22, Reason: ReasonPort},
+		{Timestamp: now, Host: "b.com", Method: "CONNECT", Port: 443, Rule: "b.com", Reason: ReasonRule},
+		{Timestamp: now, Host: "c.com", Method: "CONNECT", Port: 443, Approved: true},
+	})
+
+	page, err := service.QueryRequests(RequestQuery{Reason: ReasonPort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Requests) != 1 || page.Requests[0].Host != "a.com" || page.Requests[0].Reason != ReasonPort {
+		t.Fatalf("expected the port rejection, got %+v", page.Requests)
+	}
+}
+
+func TestTopUsers(t *testing.T) {
+	service := setupTestService(t)
+
+	now := time.Now().UnixMilli()
+	service.writeBatch([]LogRequest{
+		{Timestamp: now, Host: "a.com", Method: "CONNECT", Port: 443, Approved: true, User: "alice"},
+		{Timestamp: now, Host: "b.com", Method: "CONNECT", Port: 443, Approved: true, User: "alice"},
+		{Timestamp: now, Host: "c.com", Method: "CONNECT", Port: 443, User: "bob"},
+		{Timestamp: now, Host: "d.com", Method: "CONNECT", Port: 443, Approved: true},
+	})
+
+	top, err := service.TopUsers(TopQuery{Start: now - 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 2 || top[0].Key != "alice" || top[0].Count != 2 || top[1].Key != "bob" || top[1].Blocked != 1 {
+		t.Fatalf("unexpected top users: %+v", top)
+	}
+	page, err := service.QueryRequests(RequestQuery{User: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Requests) != 1 || page.Requests[0].User != "bob" {
+		t.Fatalf("expected bob's request, got %+v", page.Requests)
+	}
+}
+
+func TestNewLoggingService_MigratesFirstReleaseLog(t *testing.T) {
+	db := setupLegacyLog(t)
+	ts := time.Date(2025, 3, 1, 10, 30, 0, 0, time.UTC).UnixMilli()
+	for i := 0; i < 3; i++ {
+		_, err := db.Db.Exec(`INSERT INTO requests (timestamp, host, method, path, port, decision, duration)
+			VALUES (?, 'www.old.com', 'CONNECT', '', 443, ?, 0)`, ts, map[bool]string{true: "approved", false: "rejected"}[i > 0])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	service, err := NewLoggingService(db)
+	if err != nil {
+		t.Fatalf("NewLoggingService failed: %v", err)
+	}
+	buckets, err := service.readRollups(rollupResolutions[1], ts-time.Hour.Milliseconds(), ts+time.Hour.Milliseconds())
+	if err != nil {
+		t.Fatalf("readRollups failed: %v", err)
+	}
+	if len(buckets) != 1 || buckets[0].total != 3 || buckets[0].approved != 2 || buckets[0].rejected != 1 {
+		t.Fatalf("unexpected backfilled rollups: %+v", buckets)
+	}
+	var sites int
+	if err := db.Db.QueryRow(`SELECT COUNT(*) FROM requests WHERE site = 'old.com'`).Scan(&sites); err != nil || sites != 3 {
+		t.Fatalf("Expected 3 backfilled sites, got %d (%v)", sites, err)
+	}
+	expectSchemaVersion(t, service, len(requestMigrations))
+}
+
+func TestNewLoggingService_MigratesUnversionedLog(t *testing.T) {
+	// A log written by a release that added columns on startup, before
+	// versions were recorded: it has rollups and a rule column but no site
+	db := setupLegacyLog(t)
+	_, err := db.Db.Exec(`ALTER TABLE requests ADD COLUMN rule TEXT NOT NULL DEFAULT '';
+	CREATE TABLE request_rollups (
+		resolution TEXT NOT NULL,
+		bucket INTEGER NOT NULL,
+		total INTEGER NOT NULL DEFAULT 0,
+		approved INTEGER NOT NULL DEFAULT 0,
+		rejected INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (resolution, bucket)
+	) WITHOUT ROWID;
+	INSERT INTO requests (timestamp, host, method, path, port, decision, duration, rule)
+		VALUES (1000, 'ads.tracker.com', 'CONNECT', '', 443, 'rejected', 0, '*.tracker.com');
+	INSERT INTO request_rollups (resolution, bucket, total, approved, rejected) VALUES ('day', 0, 7, 5, 2);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service, err := NewLoggingService(db)
+	if err != nil {
+		t.Fatalf("NewLoggingService failed: %v", err)
+	}
+	// The existing rollups are kept rather than filled again
+	buckets, err := service.readRollups(rollupResolutions[2], 0, 1)
+	if err != nil {
+		t.Fatalf("readRollups failed: %v", err)
+	}
+	if len(buckets) != 1 || buckets[0].total != 7 {
+		t.Fatalf("Existing rollups should be kept, got %+v", buckets)
+	}
+	var rule, site, username string
+	var wouldReject int64
+	err = db.Db.QueryRow(`SELECT rule, site, username FROM requests`).Scan(&rule, &site, &username)
+	if err != nil || rule != "*.tracker.com" || site != "tracker.com" || username != "" {
+		t.Fatalf("Unexpected migrated row: rule %q, site %q, username %q (%v)", rule, site, username, err)
+	}
+	if err := db.Db.QueryRow(`SELECT would_reject FROM request_rollups`).Scan(&wouldReject); err != nil || wouldReject != 0 {
+		t.Fatalf("Expected would_reject to be added, got %d (%v)", wouldReject, err)
+	}
+	expectSchemaVersion(t, service, len(requestMigrations))
+}
+
+func TestNewLoggingService_RunsMigrationsOnce(t *testing.T) {
+	service := setupTestService(t)
+	expectSchemaVersion(t, service, len(requestMigrations))
+
+	// A table dropped after migrating is not recreated, since the recorded
+	// version says every step has run
+	if _, err := service.DbService.Db.Exec(`DROP TABLE request_rollups`); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.initDB(); err != nil {
+		t.Fatalf("initDB failed: %v", err)
+	}
+	var exists bool
+	if err := service.DbService.Db.QueryRow(`SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE name = 'request_rollups')`).Scan(&exists); err != nil || exists {
+		t.Fatalf("Migrations should not run again (exists %v, %v)", exists, err)
+	}
+	expectSchemaVersion(t, service, len(requestMigrations))
+}
+
+// setupLegacyLog creates a database with the request log of the first release
+func setupLegacyLog(t *testing.T) *db_service.DatabaseService {
+	db, err := db_service.NewDBService(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create test db: %v", err)
+	}
+	t.Cleanup(func() { db.ServiceShutdown() })
+
+	_, err = db.Db.Exec(`CREATE TABLE requests (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp INTEGER NOT NULL,
+		host TEXT NOT NULL,
+		method TEXT NOT NULL,
+		path TEXT NOT NULL,
+		port INTEGER NOT NULL,
+		decision TEXT NOT NULL,
+		duration REAL NOT NULL
+	)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func expectSchemaVersion(t *testing.T, service *LoggingService, want int) {
+	t.Helper()
+	var version int
+	err := service.DbService.Db.QueryRow(`SELECT version FROM schema_versions WHERE name = ?`, schemaName).Scan(&version)
+	if err != nil || version != want {
+		t.Fatalf("Expected schema version %d, got %d (%v)", want, version, err)
+	}
+}
+
+func TestQueryRequests_FiltersAndPaginates(t *testing.T) {
+	service := setupTestService(t)
+
+	var batch []LogRequest
+	for i := 0; i < 25; i++ {
+		entry := LogRequest{Timestamp: int64(1000 + i), Host: fmt.Sprintf("site%d.example.com", i), Method: "CONNECT", Port: 443, Approved: true}
+		if i%5 == 0 {
+			entry.Host = "ads_tracker.com"
+			entry.Approved = false
+			entry.Rule = "*.tracker.com"
+		}
+		batch = append(batch, entry)
+	}
+	batch = append(batch, LogRequest{Timestamp: 2000, Host: "adsXtracker.com", Method: "DNS", Port: 53, Approved: true})
+	service.writeBatch(batch)
+
+	// Walk all approved CONNECT requests on 443 in pages of 7
+	query := RequestQuery{Decision: "approved", Method: "connect", Port: 443, Limit: 7}
+	var seen []RequestDetail
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("pagination did not terminate")
+		}
+		page, err := service.QueryRequests(query)
+		if err != nil {
+			t.Fatalf("QueryRequests failed: %v", err)
+		}
+		if page.Total != 20 {
+			t.Fatalf("expected total 20, got %d", page.Total)
+		}
+		seen = append(seen, page.Requests...)
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+	if len(seen) != 20 {
+		t.Fatalf("expected 20 requests across pages, got %d", len(seen))
+	}
+	for i := 1; i < len(seen); i++ {
+		if seen[i].Timestamp >= seen[i-1].Timestamp {
+			t.Fatalf("results not in descending timestamp order at %d", i)
+		}
+	}
+
+	// The underscore in the host filter is literal, not a wildcard
+	page, err := service.QueryRequests(RequestQuery{Host: "ADS_"})
+	if err != nil {
+		t.Fatalf("QueryRequests failed: %v", err)
+	}
+	if page.Total != 5 || page.Requests[0].Rule != "*.tracker.com" {
+		t.Fatalf("unexpected host filter result: %+v", page)
+	}
+	page, err = service.QueryRequests(RequestQuery{Rule: "*.tracker.com"})
+	if err != nil {
+		t.Fatalf("QueryRequests failed: %v", err)
+	}
+	if page.Total != 5 {
+		t.Fatalf("expected 5 requests for the rule, got %d", page.Total)
+	}
+
+	// Sort by host ascending within a time range
+	page, err = service.QueryRequests(RequestQuery{Start: 1001, End: 1003, SortBy: "host", Ascending: true, Limit: 2})
+	if err != nil {
+		t.Fatalf("QueryRequests failed: %v", err)
+	}
+	if page.Total != 3 || page.Requests[0].Host != "site1.example.com" || page.NextCursor == "" {
+		t.Fatalf("unexpected sorted page: %+v", page)
+	}
+	page, err = service.QueryRequests(RequestQuery{Start: 1001, End: 1003, SortBy: "host", Ascending: true, Limit: 2, Cursor: page.NextCursor})
+	if err != nil {
+		t.Fatalf("QueryRequests failed: %v", err)
+	}
+	if len(page.Requests) != 1 || page.Requests[0].Host != "site3.example.com" || page.NextCursor != "" {
+		t.Fatalf("unexpected second sorted page: %+v", page)
+	}
+
+	if _, err := service.QueryRequests(RequestQuery{SortBy: "bogus"}); err == nil {
+		t.Fatal("expected an error for an unknown sort option")
+	}
+}
+
+func TestDashboardRange_BucketsByLocalDay(t *testing.T) {
+	service := setupTestService(t)
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("timezone data unavailable: %v", err)
+	}
+	// Fixed clock shortly after the 2025 DST change in Berlin (30 March)
+	now := time.Date(2025, 4, 1, 12, 0, 0, 0, berlin)
+	service.now = func() time.Time { return now }
+
+	at := func(day, hour, min int) int64 {
+		return time.Date(2025, 3, day, hour, min, 0, 0, berlin).UnixMilli()
+	}
+	service.writeBatch([]LogRequest{
+		// 00:30 Berlin is still the previous day in UTC; it must count for the 29th
+		{Timestamp: at(29, 0, 30), Host: "a.com", Method: "CONNECT", Port: 443, Approved: true},
+		{Timestamp: at(29, 23, 30), Host: "a.com", Method: "CONNECT", Port: 443, Approved: true},
+		// The 30th only has 23 hours
+		{Timestamp: at(30, 23, 59), Host: "b.com", Method: "CONNECT", Port: 443},
+		{Timestamp: at(31, 0, 0), Host: "c.com", Method: "CONNECT", Port: 443, Approved: true},
+	})
+
+	data, err := service.GetDashboardDataRange(DashboardQuery{
+		Start:         at(29, 0, 0),
+		End:           now.UnixMilli(),
+		BucketMinutes: 1440,
+		Timezone:      "Europe/Berlin",
+	})
+	if err != nil {
+		t.Fatalf("GetDashboardDataRange failed: %v", err)
+	}
+
+	want := []ConnectionData{
+		{Timestamp: at(29, 0, 0), Count: 2, Approved: 2},
+		{Timestamp: at(30, 0, 0), Count: 1, Rejected: 1},
+		{Timestamp: at(31, 0, 0), Count: 1, Approved: 1},
+	}
+	if len(data.Connections) != len(want) {
+		t.Fatalf("expected %d buckets, got %+v", len(want), data.Connections)
+	}
+	for i := range want {
+		if data.Connections[i] != want[i] {
+			t.Errorf("bucket %d: got %+v, want %+v", i, data.Connections[i], want[i])
+		}
+	}
+	if data.TotalRequests != 4 || data.Timezone != "Europe/Berlin" {
+		t.Fatalf("unexpected summary: total %d, timezone %q", data.TotalRequests, data.Timezone)
+	}
+}
+
+func TestDashboardRange_Validation(t *testing.T) {
+	service := setupTestService(t)
+	service.now = func() time.Time { return time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC) }
+
+	if _, err := service.GetDashboardDataRange(DashboardQuery{Start: 2000, End: 1000}); err == nil {
+		t.Fatal("expected an error when start is after end")
+	}
+	if _, err := service.GetDashboardDataRange(DashboardQuery{Start: 1000, End: 2000, Timezone: "Mars/Olympus"}); err == nil {
+		t.Fatal("expected an error for an unknown timezone")
+	}
+
+	// End defaults to the clock, and the bucket size to one suited to the range
+	data, err := service.GetDashboardDataRange(DashboardQuery{Start: service.clock().Add(-6 * time.Hour).UnixMilli()})
+	if err != nil {
+		t.Fatalf("GetDashboardDataRange failed: %v", err)
+	}
+	if data.End != service.clock().UnixMilli() || data.BucketMinutes != 30 {
+		t.Fatalf("unexpected defaults: end %d, bucket %d", data.End, data.BucketMinutes)
+	}
+}
+
+func TestDashboardRange_LongRangesStayBounded(t *testing.T) {
+	service := setupTestService(t)
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	service.now = func() time.Time { return now }
+
+	batch := make([]LogRequest, 150)
+	for i := range batch {
+		batch[i] = LogRequest{Timestamp: now.Add(-time.Duration(i) * time.Hour).UnixMilli(), Host: "a.com", Method: "CONNECT", Port: 443, Approved: true}
+	}
+	service.writeBatch(batch)
+
+	data, err := service.GetDashboardDataRange(DashboardQuery{Start: now.AddDate(0, 0, -30).UnixMilli(), BucketMinutes: 1440, Timezone: "UTC"})
+	if err != nil {
+		t.Fatalf("GetDashboardDataRange failed: %v", err)
+	}
+	if data.TotalRequests != 150 || len(data.Requests) != dashboardRecentRequests || data.Requests[0].Timestamp != now.UnixMilli() {
+		t.Fatalf("expected all requests counted and only the newest returned: total %d, %d rows", data.TotalRequests, len(data.Requests))
+	}
+
+}
+
+func TestDashboardRange_ClipsPartialBuckets(t *testing.T) {
+	service := setupTestService(t)
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	service.now = func() time.Time { return now }
+
+	at := func(day, hour, min, sec int) int64 {
+		return time.Date(2025, 5, day, hour, min, sec, 0, time.UTC).UnixMilli()
+	}
+	entry := func(ts int64) LogRequest {
+		return LogRequest{Timestamp: ts, Host: "a.com", Method: "CONNECT", Port: 443, Approved: true}
+	}
+	service.writeBatch([]LogRequest{
+		// Same hour and minute rollups as the range start, but before it
+		entry(at(31, 10, 10, 0)),
+		entry(at(31, 10, 30, 5)),
+		// Inside
+		entry(at(31, 10, 30, 45)),
+		entry(at(31, 10, 40, 0)),
+		entry(at(31, 11, 15, 0)),
+		// Same hour as the range end, but after it
+		entry(at(31, 11, 50, 0)),
+	})
+
+	data, err := service.GetDashboardDataRange(DashboardQuery{
+		Start:         at(31, 10, 30, 30),
+		End:           at(31, 11, 45, 0),
+		BucketMinutes: 60,
+		Timezone:      "UTC",
+	})
+	if err != nil {
+		t.Fatalf("GetDashboardDataRange failed: %v", err)
+	}
+	want := []ConnectionData{
+		{Timestamp: at(31, 10, 0, 0), Count: 2, Approved: 2},
+		{Timestamp: at(31, 11, 0, 0), Count: 1, Approved: 1},
+	}
+	if len(data.Connections) != len(want) || data.Connections[0] != want[0] || data.Connections[1] != want[1] || data.TotalRequests != 3 {
+		t.Fatalf("expected only the requests inside the range, got total %d, %+v", data.TotalRequests, data.Connections)
+	}
+
+	// Day rollups over a long range leave out the part of the first day before the start
+	service.writeBatch([]LogRequest{entry(at(2, 6, 0, 0)), entry(at(2, 18, 0, 0))})
+	data, err = service.GetDashboardDataRange(DashboardQuery{Start: at(2, 12, 0, 0), BucketMinutes: 1440, Timezone: "UTC"})
+	if err != nil {
+		t.Fatalf("GetDashboardDataRange failed: %v", err)
+	}
+	if data.TotalRequests != 7 || data.Connections[0].Timestamp != at(2, 0, 0, 0) || data.Connections[0].Count != 1 {
+		t.Fatalf("expected the morning of the first day to be left out, got total %d, %+v", data.TotalRequests, data.Connections)
+	}
+}
+
+func TestDashboardRange_HalfHourZoneSplitsUTCHours(t *testing.T) {
+	service := setupTestService(t)
+	kolkata := time.FixedZone("IST", 5*3600+1800)
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	service.now = func() time.Time { return now }
+
+	entry := func(ts time.Time) LogRequest {
+		return LogRequest{Timestamp: ts.UnixMilli(), Host: "a.com", Method: "CONNECT", Port: 443, Approved: true}
+	}
+	utc := func(day, hour, min int) time.Time { return time.Date(2025, 5, day, hour, min, 0, 0, time.UTC) }
+	// Hourly IST buckets from 15:00 to 17:00 local time
+	counts := func(day int) ([]ConnectionData, error) {
+		start, end := utc(day, 9, 30), utc(day, 11, 29)
+		return service.newRangeCounter(start.UnixMilli(), end.UnixMilli()+1).bucket(bucketBoundaries(start, end, 60, kolkata))
+	}
+	// 10:10 and 10:40 UTC share an hour rollup but fall into the IST hours
+	// starting 09:30 and 10:30 UTC
+	service.writeBatch([]LogRequest{entry(utc(31, 10, 10)), entry(utc(31, 10, 40))})
+
+	connections, err := counts(31)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(connections) != 2 || connections[0].Count != 1 || connections[1].Count != 1 ||
+		connections[0].Timestamp != utc(31, 9, 30).UnixMilli() || connections[1].Timestamp != utc(31, 10, 30).UnixMilli() {
+		t.Fatalf("expected one request in each IST hour, got %+v", connections)
+	}
+
+	// Ten days back the minute rollups are gone; with the raw rows pruned too,
+	// the shared hour is counted in full, once, in the earlier bucket
+	service.writeBatch([]LogRequest{entry(utc(21, 10, 10)), entry(utc(21, 10, 40))})
+	if _, err := service.pruneRollups(now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.DbService.Db.Exec(`DELETE FROM requests WHERE timestamp < ?`, utc(22, 0, 0).UnixMilli()); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.SetRetentionPolicy(RetentionPolicy{MaxAgeDays: 5}); err != nil {
+		t.Fatal(err)
+	}
+	connections, err = counts(21)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(connections) != 1 || connections[0].Count != 2 || connections[0].Timestamp != utc(21, 9, 30).UnixMilli() {
+		t.Fatalf("expected the pruned hour in the earlier bucket, got %+v", connections)
+	}
+}
+
+func TestBucketBoundaries_SubDayAlignsToLocalMidnight(t *testing.T) {
+	kolkata := time.FixedZone("IST", 5*3600+1800)
+	start := time.Date(2025, 1, 1, 22, 10, 0, 0, kolkata)
+	end := time.Date(2025, 1, 2, 1, 0, 0, 0, kolkata)
+
+	got := bucketBoundaries(start, end, 60, kolkata)
+	want := []int{22, 23, 0, 1}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d boundaries, got %v", len(want), got)
+	}
+	for i, hour := range want {
+		if got[i].Hour() != hour || got[i].Minute() != 0 {
+			t.Errorf("boundary %d: got %v, want %02d:00 local", i, got[i], hour)
+		}
+	}
+}
+
+func TestTopN_WithPeriodOverPeriodChange(t *testing.T) {
+	service := setupTestService(t)
+
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	service.now = func() time.Time { return now }
+	current := now.Add(-30 * time.Minute).UnixMilli()
+	previous := now.Add(-90 * time.Minute).UnixMilli()
+
+	entry := func(ts int64, host string, port int, approved bool) LogRequest {
+		return LogRequest{Timestamp: ts, Host: host, Method: "CONNECT", Port: port, Approved: approved}
+	}
+	var batch []LogRequest
+	for i := 0; i < 4; i++ {
+		batch = append(batch, entry(current, "www.example.co.uk", 443, true))
+	}
+	for i := 0; i < 2; i++ {
+		batch = append(batch, entry(current, "api.example.co.uk", 8443, true))
+		batch = append(batch, entry(previous, "www.example.co.uk", 443, true))
+	}
+	for i := 0; i < 3; i++ {
+		batch = append(batch, entry(current, "ads.tracker.com", 443, false))
+	}
+	batch = append(batch, entry(current, "10.0.0.1", 22, true))
+	service.writeBatch(batch)
+
+	q := TopQuery{Start: now.Add(-time.Hour).UnixMilli()}
+
+	hosts, err := service.TopHosts(q)
+	if err != nil {
+		t.Fatalf("TopHosts failed: %v", err)
+	}
+	if len(hosts) != 4 || hosts[0].Key != "www.example.co.uk" || hosts[0].Count != 4 || hosts[0].PreviousCount != 2 {
+		t.Fatalf("unexpected top hosts: %+v", hosts)
+	}
+	if hosts[0].Change == nil || *hosts[0].Change != 1 {
+		t.Fatalf("expected +100%% change for www.example.co.uk, got %v", hosts[0].Change)
+	}
+	if hosts[1].Key != "ads.tracker.com" || hosts[1].Change != nil {
+		t.Fatalf("expected ads.tracker.com second with no previous data: %+v", hosts[1])
+	}
+
+	blocked, err := service.TopBlockedHosts(q)
+	if err != nil {
+		t.Fatalf("TopBlockedHosts failed: %v", err)
+	}
+	if len(blocked) != 1 || blocked[0].Key != "ads.tracker.com" || blocked[0].Blocked != 3 {
+		t.Fatalf("unexpected top blocked hosts: %+v", blocked)
+	}
+
+	sites, err := service.TopSites(TopQuery{Start: q.Start, Limit: 2})
+	if err != nil {
+		t.Fatalf("TopSites failed: %v", err)
+	}
+	if len(sites) != 2 || sites[0].Key != "example.co.uk" || sites[0].Count != 6 || sites[1].Key != "tracker.com" {
+		t.Fatalf("unexpected top sites: %+v", sites)
+	}
+
+	ports, err := service.TopPorts(q)
+	if err != nil {
+		t.Fatalf("TopPorts failed: %v", err)
+	}
+	if len(ports) != 3 || ports[0].Key != "443" || ports[0].Count != 7 {
+		t.Fatalf("unexpected port distribution: %+v", ports)
+	}
+}
+
+func TestSiteOf(t *testing.T) {
+	tests := map[string]string{
+		"www.example.com":    "example.com",
+		"a.b.example.co.uk.": "example.co.uk",
+		"example.com":        "example.com",
+		"192.168.1.1":        "192.168.1.1",
+		"[::1]":              "[::1]",
+		"localhost":          "localhost",
+	}
+	for host, want := range tests {
+		if got := siteOf(host); got != want {
+			t.Errorf("siteOf(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestWriteBatch_StoresTunnelMeasurements(t *testing.T) {
+	service := setupTestService(t)
+
+	service.writeBatch([]LogRequest{{
+		Host: "a.com", Method: "CONNECT", Port: 443, Approved: true,
+		DialDuration: 1500, FirstByteDuration: 2500, OpenDuration: 90000,
+		BytesUp: 517, BytesDown: 4096,
+		ProcessName: "curl", ProcessPath: "/usr/bin/curl",
+	}})
+
+	requests, err := service.RequestsSince(0, 10)
+	if err != nil {
+		t.Fatalf("RequestsSince failed: %v", err)
+	}
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(requests))
+	}
+	r := requests[0]
+	if r.DialDuration != 1500 || r.FirstByteDuration != 2500 || r.OpenDuration != 90000 || r.BytesUp != 517 || r.BytesDown != 4096 {
+		t.Fatalf("tunnel measurements not stored: %+v", r)
+	}
+	if r.ProcessName != "curl" || r.ProcessPath != "/usr/bin/curl" {
+		t.Fatalf("process not stored: %+v", r)
+	}
+}
+
+func TestWriteBatch_KeepsRowsWhenRollupsFail(t *testing.T) {
+	service := setupTestService(t)
+	db := service.DbService.Db
+	minute := rollupResolutions[0]
+	total := func() int64 {
+		buckets, err := service.readRollups(minute, 0, 10*minute.width)
+		if err != nil {
+			t.Fatalf("readRollups failed: %v", err)
+		}
+		var sum int64
+		for _, b := range buckets {
+			sum += b.total
+		}
+		return sum
+	}
+
+	if _, err := db.Exec(`ALTER TABLE request_rollups RENAME TO request_rollups_away`); err != nil {
+		t.Fatal(err)
+	}
+	service.writeBatch([]LogRequest{{Timestamp: 1000, Host: "a.com", Method: "CONNECT", Port: 443, Approved: true}})
+	if _, err := db.Exec(`ALTER TABLE request_rollups_away RENAME TO request_rollups`); err != nil {
+		t.Fatal(err)
+	}
+	if requests, _ := service.RequestsSince(0, 10); len(requests) != 1 {
+		t.Fatalf("expected the row to be committed without its rollup, got %d rows", len(requests))
+	}
+	if got := total(); got != 0 {
+		t.Fatalf("expected no rollup yet, got %d", got)
+	}
+
+	// The next batch catches the rollups up
+	service.writeBatch([]LogRequest{{Timestamp: 2000, Host: "b.com", Method: "CONNECT", Port: 443}})
+	if got := total(); got != 2 {
+		t.Fatalf("expected both requests in the rollups, got %d", got)
+	}
+	if service.pendingRollups != nil {
+		t.Fatal("expected no pending rollups after a successful update")
+	}
+}
+
+func TestWriteBatch_CountsLostEntriesAsDropped(t *testing.T) {
+	service := setupTestService(t)
+	if _, err := service.DbService.Db.Exec(`DROP TABLE requests`); err != nil {
+		t.Fatal(err)
+	}
+	service.writeBatch([]LogRequest{{Host: "a.com"}, {Host: "b.com"}})
+	if got := service.DroppedEntries(); got != 2 {
+		t.Fatalf("expected 2 dropped entries, got %d", got)
+	}
+}
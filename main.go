@@ -1,12 +1,18 @@
 package main
 
 import (
+	"changeme/cli"
+	"changeme/control_service"
 	"changeme/db_service"
+	"changeme/dns_service"
 	"changeme/logging_service"
+	"changeme/metrics_service"
 	"changeme/proxy_service"
 	"embed"
+	"fmt"
 
 	"log"
+	"os"
 	"time"
 
 	"github.com/wailsapp/wails/v3/pkg/application"
@@ -28,10 +34,43 @@ var iconFS embed.FS
 // and starts a goroutine that emits a time-based event every second. It subsequently runs the application and
 // logs any error that might occur.
 func main() {
+	if cli.IsCommandLine(os.Args[1:]) {
+		os.Exit(cli.Run(os.Args[1:], os.Stdout, os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "--headless" {
+		if err := runHeadless(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	dbService := &db_service.DatabaseService{}
 	loggingService := &logging_service.LoggingService{DbService: dbService}
-	proxyService := &proxy_service.ProxyService{IsPaused: true}
+	proxyService := &proxy_service.ProxyService{
+		StartPaused:    true,
+		EnableSocks:    true,
+		DbService:      dbService,
+		LoggingService: loggingService,
+	}
+	// The sinkhole only listens once it is enabled from the tray
+	dnsService := &dns_service.DNSService{
+		Upstream:       dns_service.DEFAULT_UPSTREAM,
+		DbService:      dbService,
+		LoggingService: loggingService,
+	}
+	metricsService := &metrics_service.MetricsService{
+		Addr: fmt.Sprintf("127.0.0.1:%d", metrics_service.METRICS_PORT),
+	}
+	controlService := &control_service.ControlService{
+		HTTPAddr:       fmt.Sprintf("127.0.0.1:%d", control_service.CONTROL_PORT),
+		ProxyService:   proxyService,
+		DbService:      dbService,
+		LoggingService: loggingService,
+	}
+
+	// showMainWindow opens (or focuses) the main window. It is assigned once the
+	// app exists so the single-instance handler can use it too.
+	var showMainWindow func()
 
 	// Create a new Wails application by providing the necessary options.
 	// Variables 'Name' and 'Description' are for application metadata.
@@ -45,6 +84,7 @@ func main() {
 			application.NewService(dbService),
 			application.NewService(loggingService),
 			application.NewService(proxyService),
+			application.NewService(dnsService),
 		},
 		Assets: application.AssetOptions{
 			Handler: application.AssetFileServerFS(assets),
@@ -59,6 +99,7 @@ func main() {
 				log.Printf("Second instance launched with args: %v", data.Args)
 				log.Printf("Working directory: %s", data.WorkingDir)
 				log.Printf("Additional data: %v", data.AdditionalData)
+				handleSecondInstance(showMainWindow)
 			},
 			// Optional: Pass additional data to second instance
 			AdditionalData: map[string]string{
@@ -67,6 +108,26 @@ func main() {
 		},
 	})
 
+	// The control API and metrics endpoint are not Wails services: every
+	// exported method of a service is bound to the webview, and these hold the
+	// API token and unrestricted rule editing. They start once the database is
+	// up and stop before it.
+	backgroundServices := []headlessService{controlService, metricsService}
+	app.Event.OnApplicationEvent(events.Common.ApplicationStarted, func(*application.ApplicationEvent) {
+		for _, svc := range backgroundServices {
+			if err := svc.ServiceStartup(app.Context(), application.ServiceOptions{}); err != nil {
+				log.Printf("Warning: %s startup failed: %v", svc.ServiceName(), err)
+			}
+		}
+	})
+	app.OnShutdown(func() {
+		for i := len(backgroundServices) - 1; i >= 0; i-- {
+			if err := backgroundServices[i].ServiceShutdown(); err != nil {
+				log.Printf("Warning: %s shutdown failed: %v", backgroundServices[i].ServiceName(), err)
+			}
+		}
+	})
+
 	iconBytes, _ := iconFS.ReadFile("build/appicon.png")
 
 	systray := app.SystemTray.New()
@@ -77,7 +138,7 @@ func main() {
 
 	var mainWindow *application.WebviewWindow
 
-	trayMenu.Add("Open Window").OnClick(func(ctx *application.Context) {
+	showMainWindow = func() {
 		if mainWindow == nil {
 			mainWindow = app.Window.NewWithOptions(application.WebviewWindowOptions{
 				Title:  "local-proxy",
@@ -93,6 +154,15 @@ func main() {
 		// Show and focus the existing/new window
 		mainWindow.Show()
 		mainWindow.Focus()
+	}
+
+	trayMenu.Add("Open Window").OnClick(func(ctx *application.Context) {
+		showMainWindow()
+	})
+
+	// Ask mode prompts are answered in the main window
+	app.Event.On(proxy_service.DecisionRequestedEvent, func(*application.CustomEvent) {
+		application.InvokeAsync(showMainWindow)
 	})
 
 	trayMenu.AddSeparator()
@@ -106,7 +176,7 @@ func main() {
 
 	// Function to update menu state based on proxy status
 	updateMenuState := func() {
-		if proxyService.IsPaused {
+		if proxyService.IsPaused() {
 			pauseMenuItem.SetEnabled(false)
 			resumeMenuItem.SetEnabled(true)
 		} else {
@@ -118,6 +188,34 @@ func main() {
 	// Set initial state
 	updateMenuState()
 
+	// Route only hosts with rules through the proxy via proxy.pac
+	pacMenuItem := trayMenu.AddCheckbox("Use Auto-Config (PAC)", false)
+	pacMenuItem.OnClick(func(ctx *application.Context) {
+		settings := proxy_service.SystemProxySettings{UsePAC: pacMenuItem.Checked()}
+		if err := proxyService.SetSystemProxySettings(settings); err != nil {
+			log.Printf("Failed to change system proxy settings: %v", err)
+		}
+	})
+	// Answer DNS queries for blocked names locally on DEFAULT_LISTEN_ADDR
+	dnsMenuItem := trayMenu.AddCheckbox("DNS Sinkhole", false)
+	dnsMenuItem.OnClick(func(ctx *application.Context) {
+		settings := dnsService.GetDNSSettings()
+		settings.Enabled = dnsMenuItem.Checked()
+		if err := dnsService.SetDNSSettings(settings); err != nil {
+			log.Printf("Failed to change DNS settings: %v", err)
+			dnsMenuItem.SetChecked(false)
+		}
+	})
+	// The saved settings are only readable once the database service has started
+	app.Event.OnApplicationEvent(events.Common.ApplicationStarted, func(*application.ApplicationEvent) {
+		updateMenuState()
+		pacMenuItem.SetChecked(proxyService.GetSystemProxySettings().UsePAC)
+		dnsMenuItem.SetChecked(dnsService.GetDNSSettings().Enabled)
+	})
+
+	// Keep the menu in sync when the proxy is paused or resumed from the CLI
+	proxyService.OnPauseChanged(func(bool) { updateMenuState() })
+
 	pauseMenuItem.OnClick(func(ctx *application.Context) {
 
 		if err := proxyService.PauseProxy(); err != nil {
@@ -156,3 +254,12 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+// handleSecondInstance opens the main window when the app is launched again.
+// Commands never get here: main runs them before the app is created, through
+// the control socket of the running instance.
+func handleSecondInstance(showMainWindow func()) {
+	if showMainWindow != nil {
+		application.InvokeAsync(showMainWindow)
+	}
+}
@@ -0,0 +1,62 @@
+package metrics_service
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry_WriteText(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounterVec("test_requests_total", "Requests by decision.", "decision")
+	active := r.NewGauge("test_active", "Active things.")
+	latency := r.NewHistogram("test_latency_seconds", "Latency.", []float64{0.1, 1})
+	r.NewGaugeFunc("test_depth", "Queue depth.", func() float64 { return 7 })
+
+	requests.Inc("approved")
+	requests.Add(2, "rejected")
+	requests.Inc("say \"hi\"")
+	active.Inc()
+	active.Inc()
+	active.Dec()
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(5)
+
+	var b strings.Builder
+	r.WriteText(&b)
+	out := b.String()
+
+	for _, want := range []string{
+		"# TYPE test_requests_total counter\n",
+		`test_requests_total{decision="approved"} 1` + "\n",
+		`test_requests_total{decision="rejected"} 2` + "\n",
+		`test_requests_total{decision="say \"hi\""} 1` + "\n",
+		"# TYPE test_active gauge\ntest_active 1\n",
+		`test_latency_seconds_bucket{le="0.1"} 1` + "\n",
+		`test_latency_seconds_bucket{le="1"} 2` + "\n",
+		`test_latency_seconds_bucket{le="+Inf"} 3` + "\n",
+		"test_latency_seconds_sum 5.55\n",
+		"test_latency_seconds_count 3\n",
+		"test_depth 7\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "A counter.").Add(3)
+
+	rec := httptest.NewRecorder()
+	Handler(r).ServeHTTP(rec, httptest.NewRequest("GET", METRICS_PATH, nil))
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	if !strings.Contains(rec.Body.String(), "test_total 3\n") {
+		t.Fatalf("unexpected body:\n%s", rec.Body.String())
+	}
+}
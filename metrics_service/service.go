@@ -0,0 +1,104 @@
+package metrics_service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/wailsapp/wails/v3/pkg/application"
+)
+
+const (
+	METRICS_PORT = 30005
+	METRICS_PATH = "/metrics"
+)
+
+// MetricsService serves the Default registry for Prometheus on a loopback
+// listener. The metrics themselves are recorded by the other services whether
+// or not this service runs.
+type MetricsService struct {
+	ctx     context.Context
+	options application.ServiceOptions
+
+	// Addr is the listen address, e.g. "127.0.0.1:30005". Nothing is served when empty.
+	Addr string
+
+	server *http.Server
+}
+
+// singleton instance for easy access from other services
+var instance *MetricsService
+
+func Instance() *MetricsService { return instance }
+
+func (m *MetricsService) ServiceName() string { return "metrics_service" }
+
+// ServiceStartup starts the metrics listener if an address is configured
+func (m *MetricsService) ServiceStartup(ctx context.Context, options application.ServiceOptions) error {
+	if instance != nil {
+		log.Printf("Metrics Service already started")
+		return nil
+	}
+	instance = m
+	m.ctx = ctx
+	m.options = options
+
+	if m.Addr == "" {
+		return nil
+	}
+	if err := m.Start(); err != nil {
+		// Metrics are optional; keep the app running
+		log.Printf("Metrics Service init error: %v", err)
+	}
+	return nil
+}
+
+// ServiceShutdown stops the listener
+func (m *MetricsService) ServiceShutdown() error {
+	m.Stop()
+	return nil
+}
+
+// Start binds Addr and serves METRICS_PATH in the background.
+func (m *MetricsService) Start() error {
+	ln, err := net.Listen("tcp", m.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", m.Addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET "+METRICS_PATH, Handler(Default))
+	m.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := m.server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Metrics server error: %v", err)
+		}
+	}()
+	log.Printf("Metrics available at http://%s%s", ln.Addr(), METRICS_PATH)
+	return nil
+}
+
+// Stop shuts the listener down.
+func (m *MetricsService) Stop() {
+	if m.server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.server.Shutdown(ctx); err != nil {
+		log.Printf("Warning: metrics server shutdown: %v", err)
+	}
+	m.server = nil
+}
+
+// Handler returns an http.Handler rendering the registry in the text exposition format.
+func Handler(r *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteText(w)
+	})
+}
@@ -0,0 +1,225 @@
+package proxy_service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessSettingKey stores the AccessSettings as JSON in the settings table
+const accessSettingKey = "proxy.access"
+
+// AccessSettings controls which clients may use the proxy, for when it is
+// reachable from the LAN or shared between users of one machine.
+type AccessSettings struct {
+	// RequireAuth makes clients log in as a proxy user, with basic
+	// Proxy-Authorization for HTTP or username/password for SOCKS5
+	RequireAuth bool `json:"requireAuth"`
+	// AllowedClients lists the addresses and CIDR ranges clients may connect
+	// from; empty allows every client. This machine is always allowed.
+	AllowedClients []string `json:"allowedClients"`
+}
+
+// proxyAuthRealm is announced to clients that need to authenticate
+const proxyAuthRealm = "local-proxy"
+
+const (
+	// authFailureLimit is how many failed logins a client address gets per
+	// authFailureWindow before its logins are refused unchecked
+	authFailureLimit  = 10
+	authFailureWindow = time.Minute
+)
+
+// GetAccessSettings returns the configured access settings; the zero value when unset.
+func (p *ProxyService) GetAccessSettings() AccessSettings {
+	value, ok := p.db().GetSetting(accessSettingKey)
+	if !ok {
+		return AccessSettings{}
+	}
+	var settings AccessSettings
+	if err := json.Unmarshal([]byte(value), &settings); err != nil {
+		log.Printf("warning: invalid access settings %q: %v", value, err)
+		return AccessSettings{}
+	}
+	return settings
+}
+
+// SetAccessSettings stores the access settings; they apply to the next connection.
+func (p *ProxyService) SetAccessSettings(settings AccessSettings) error {
+	if _, err := parseRanges(settings.AllowedClients); err != nil {
+		return err
+	}
+	if settings.RequireAuth && len(p.db().ListProxyUsers()) == 0 {
+		return fmt.Errorf("add a proxy user before requiring authentication")
+	}
+	value, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	if !p.db().SetSetting(accessSettingKey, string(value)) {
+		return fmt.Errorf("failed to save access settings")
+	}
+	return nil
+}
+
+// clientAllowed reports whether a client connecting from addr may use the proxy
+func clientAllowed(addr net.Addr, settings AccessSettings) bool {
+	if len(settings.AllowedClients) == 0 || isLoopback(addr) {
+		return true
+	}
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok || tcp == nil {
+		return false
+	}
+	ranges, err := parseRanges(settings.AllowedClients)
+	if err != nil {
+		log.Printf("warning: %v", err)
+		return false
+	}
+	for _, network := range ranges {
+		if network.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// userContextKey carries the authenticated user of a proxy request
+type userContextKey struct{}
+
+// requestUser returns the proxy user authenticated for r, if any
+func requestUser(r *http.Request) string {
+	user, _ := r.Context().Value(userContextKey{}).(string)
+	return user
+}
+
+// authorize enforces the access settings. Clients outside the allowed
+// addresses are refused; proxy requests must carry the credentials of a
+// proxy user when authentication is required. The proxy.pac script stays
+// reachable without credentials since browsers fetch it on their own.
+func (p *ProxyService) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		settings := p.GetAccessSettings()
+		client, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+		if !clientAllowed(client, settings) {
+			log.Printf("Refused proxy client %s: address not allowed", r.RemoteAddr)
+			clientRejections.Inc("address")
+			http.Error(w, "client address not allowed", http.StatusForbidden)
+			return
+		}
+		if !settings.RequireAuth || (r.Method != http.MethodConnect && !r.URL.IsAbs()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, password, ok := parseProxyAuth(r.Header.Get("Proxy-Authorization"))
+		if !ok {
+			clientRejections.Inc("auth")
+			w.Header().Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", proxyAuthRealm))
+			http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+		if ok, limited := p.checkCredentials(r.RemoteAddr, user, password); !ok {
+			if limited {
+				log.Printf("Refused proxy client %s: too many failed logins", r.RemoteAddr)
+				http.Error(w, "too many failed logins", http.StatusTooManyRequests)
+				return
+			}
+			log.Printf("Refused proxy client %s: invalid credentials for %q", r.RemoteAddr, user)
+			w.Header().Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", proxyAuthRealm))
+			http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+		// Credentials are for this proxy only
+		r.Header.Del("Proxy-Authorization")
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, user)))
+	})
+}
+
+// authLimiter counts failed logins per client address, so a client guessing
+// passwords is refused before each guess costs a key derivation
+type authLimiter struct {
+	mu       sync.Mutex
+	failures map[string]*authFailures
+}
+
+// authFailures are the failed logins of one address since the window opened
+type authFailures struct {
+	count int
+	since time.Time
+}
+
+// clientHost returns the address a client is rate-limited by
+func clientHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// blocked reports whether host used up its failed logins for this window
+func (l *authLimiter) blocked(host string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.failures[host]
+	return ok && time.Since(f.since) < authFailureWindow && f.count >= authFailureLimit
+}
+
+// failed records a failed login from host
+func (l *authLimiter) failed(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.failures == nil {
+		l.failures = make(map[string]*authFailures)
+	}
+	now := time.Now()
+	f, ok := l.failures[host]
+	if !ok || now.Sub(f.since) >= authFailureWindow {
+		// Drop the windows that ran out before the map grows
+		for key, old := range l.failures {
+			if now.Sub(old.since) >= authFailureWindow {
+				delete(l.failures, key)
+			}
+		}
+		f = &authFailures{since: now}
+		l.failures[host] = f
+	}
+	f.count++
+}
+
+// checkCredentials checks a login from the client at addr. Clients that
+// failed too often recently are refused without checking, reported by limited.
+func (p *ProxyService) checkCredentials(addr, user, password string) (ok, limited bool) {
+	host := clientHost(addr)
+	if p.authLimit.blocked(host) {
+		clientRejections.Inc("auth_rate")
+		return false, true
+	}
+	if !p.db().CheckProxyUser(user, password) {
+		p.authLimit.failed(host)
+		clientRejections.Inc("auth")
+		return false, false
+	}
+	return true, false
+}
+
+// parseProxyAuth decodes a basic Proxy-Authorization header
+func parseProxyAuth(header string) (user, password string, ok bool) {
+	scheme, encoded, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
@@ -0,0 +1,136 @@
+package proxy_service
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorize(t *testing.T) {
+	proxy := setupTestProxy(t)
+	if err := proxy.SetAccessSettings(AccessSettings{RequireAuth: true}); err == nil {
+		t.Fatal("expected requiring authentication without users to fail")
+	}
+	proxy.DbService.SetProxyUser("alice", "secret")
+	if err := proxy.SetAccessSettings(AccessSettings{RequireAuth: true, AllowedClients: []string{"192.168.1.0/24"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var gotUser, gotHeader string
+	handler := proxy.authorize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUser, gotHeader = requestUser(r), r.Header.Get("Proxy-Authorization")
+	}))
+	serve := func(remoteAddr, credentials string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = remoteAddr
+		if credentials != "" {
+			req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := serve("10.0.0.5:4000", "alice:secret"); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected clients outside the allowlist to be refused, got %d", rec.Code)
+	}
+	rec := serve("192.168.1.5:4000", "")
+	if rec.Code != http.StatusProxyAuthRequired || rec.Header().Get("Proxy-Authenticate") == "" {
+		t.Fatalf("expected a 407 challenge, got %d %v", rec.Code, rec.Header())
+	}
+	if rec := serve("192.168.1.5:4000", "alice:wrong"); rec.Code != http.StatusProxyAuthRequired {
+		t.Fatalf("expected wrong passwords to be refused, got %d", rec.Code)
+	}
+	if rec := serve("127.0.0.1:4000", "alice:secret"); rec.Code != http.StatusOK || gotUser != "alice" || gotHeader != "" {
+		t.Fatalf("expected alice to pass without forwarding her credentials, got %d %q %q", rec.Code, gotUser, gotHeader)
+	}
+}
+
+func TestAuthorize_LimitsFailedLoginsPerClient(t *testing.T) {
+	proxy := setupTestProxy(t)
+	proxy.DbService.SetProxyUser("alice", "secret")
+	if err := proxy.SetAccessSettings(AccessSettings{RequireAuth: true}); err != nil {
+		t.Fatal(err)
+	}
+	handler := proxy.authorize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(remoteAddr, credentials string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for i := 0; i < authFailureLimit; i++ {
+		if code := serve("127.0.0.1:4000", "alice:wrong"); code != http.StatusProxyAuthRequired {
+			t.Fatalf("expected wrong passwords to be challenged, got %d", code)
+		}
+	}
+	// The limit is per address, not per connection
+	if code := serve("127.0.0.1:4001", "alice:secret"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected the client to be limited after %d failures, got %d", authFailureLimit, code)
+	}
+	if code := serve("[::1]:4000", "alice:secret"); code != http.StatusOK {
+		t.Fatalf("expected other clients to log in, got %d", code)
+	}
+}
+
+func TestSocks_PasswordAuthentication(t *testing.T) {
+	proxy := setupTestProxy(t)
+	proxy.DbService.SetProxyUser("alice", "secret")
+	if err := proxy.SetAccessSettings(AccessSettings{RequireAuth: true}); err != nil {
+		t.Fatal(err)
+	}
+	echoAddr := startEchoServer(t)
+	socksAddr := startTestSocks(t, proxy)
+
+	login := func(user, password string) (net.Conn, byte) {
+		conn, err := net.Dial("tcp", socksAddr)
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		if _, err := conn.Write([]byte{socksVersion, 2, socksAuthNone, socksAuthPassword}); err != nil {
+			t.Fatal(err)
+		}
+		method := make([]byte, 2)
+		if _, err := io.ReadFull(conn, method); err != nil || method[1] != socksAuthPassword {
+			t.Fatalf("expected username/password to be selected, got %v (%v)", method, err)
+		}
+		req := append([]byte{socksAuthPasswordVersion, byte(len(user))}, user...)
+		req = append(append(req, byte(len(password))), password...)
+		if _, err := conn.Write(req); err != nil {
+			t.Fatal(err)
+		}
+		status := make([]byte, 2)
+		if _, err := io.ReadFull(conn, status); err != nil {
+			t.Fatalf("reading authentication status failed: %v", err)
+		}
+		return conn, status[1]
+	}
+
+	conn, status := login("alice", "wrong")
+	conn.Close()
+	if status != socksAuthFailed {
+		t.Fatalf("expected wrong passwords to fail, got status %d", status)
+	}
+
+	conn, status = login("alice", "secret")
+	defer conn.Close()
+	if status != socksAuthSucceeded {
+		t.Fatalf("expected alice to log in, got status %d", status)
+	}
+	req := []byte{socksVersion, socksCmdConnect, 0x00, socksAddrIPv4, 127, 0, 0, 1, byte(echoAddr.Port >> 8), byte(echoAddr.Port)}
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	if reply := readSocksReply(t, conn); reply != socksReplySucceeded {
+		t.Fatalf("expected success reply, got %d", reply)
+	}
+	if conns := proxy.ListActiveConnections(); len(conns) != 1 || conns[0].User != "alice" {
+		t.Fatalf("expected the tunnel to be attributed to alice, got %+v", conns)
+	}
+}
@@ -0,0 +1,275 @@
+package proxy_service
+
+import (
+	"changeme/db_service"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wailsapp/wails/v3/pkg/application"
+)
+
+const (
+	// DecisionRequestedEvent carries a PendingDecision the user should answer
+	DecisionRequestedEvent = "proxy:decision-requested"
+	// DecisionResolvedEvent carries DecisionResolvedData once a prompt is
+	// answered or has timed out, so other windows can dismiss it
+	DecisionResolvedEvent = "proxy:decision-resolved"
+
+	// askSettingKey stores the AskSettings as JSON in the settings table
+	askSettingKey = "proxy.ask"
+)
+
+// AskSettings configures ask mode, where a connection to a host without a
+// matching rule waits until the user allows or denies it.
+type AskSettings struct {
+	Enabled bool `json:"enabled"`
+	// TimeoutSeconds is how long a connection waits for an answer
+	TimeoutSeconds int `json:"timeoutSeconds"`
+	// DefaultAction is db_service.ActionAllow or ActionBlock, applied on timeout
+	DefaultAction string `json:"defaultAction"`
+}
+
+// DefaultAskSettings keeps ask mode off and denies unanswered prompts after 30 seconds.
+var DefaultAskSettings = AskSettings{TimeoutSeconds: 30, DefaultAction: db_service.ActionBlock}
+
+// How long an answer is remembered
+const (
+	RememberOnce    = "once"    // only the waiting connections
+	RememberForever = "forever" // saved as a rule
+	RememberMinutes = "minutes" // saved as a rule expiring after Minutes
+)
+
+// DecisionAnswer is the user's reply to a PendingDecision
+type DecisionAnswer struct {
+	Allow    bool   `json:"allow"`
+	Remember string `json:"remember"`
+	Minutes  int    `json:"minutes"`
+}
+
+// PendingDecision is a connection held until the user answers
+type PendingDecision struct {
+	ID          int64  `json:"id"`
+	Host        string `json:"host"`
+	Port        int    `json:"port"`
+	Method      string `json:"method"`
+	ProcessName string `json:"processName"`
+	ProcessPath string `json:"processPath"`
+	Created     int64  `json:"created"`  // unix milliseconds
+	Deadline    int64  `json:"deadline"` // unix milliseconds; the default action applies after it
+}
+
+// DecisionResolvedData is the payload of DecisionResolvedEvent
+type DecisionResolvedData struct {
+	ID       int64 `json:"id"`
+	Allowed  bool  `json:"allowed"`
+	TimedOut bool  `json:"timedOut"`
+}
+
+// pendingDecision is shared by every connection to the same host and port
+// from the same application, so the user is asked once.
+type pendingDecision struct {
+	PendingDecision
+	done    chan struct{} // closed once allowed is set
+	allowed bool
+}
+
+// GetAskSettings returns the configured ask mode settings, or the defaults when unset.
+func (p *ProxyService) GetAskSettings() AskSettings {
+	value, ok := p.db().GetSetting(askSettingKey)
+	if !ok {
+		return DefaultAskSettings
+	}
+	var settings AskSettings
+	if err := json.Unmarshal([]byte(value), &settings); err != nil {
+		log.Printf("warning: invalid ask settings %q: %v", value, err)
+		return DefaultAskSettings
+	}
+	return settings
+}
+
+// SetAskSettings stores the ask mode settings; they apply to the next connection.
+func (p *ProxyService) SetAskSettings(settings AskSettings) error {
+	if settings.TimeoutSeconds <= 0 {
+		return fmt.Errorf("timeout must be positive")
+	}
+	if settings.DefaultAction != db_service.ActionAllow && settings.DefaultAction != db_service.ActionBlock {
+		return fmt.Errorf("default action must be %q or %q", db_service.ActionAllow, db_service.ActionBlock)
+	}
+	value, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	if !p.db().SetSetting(askSettingKey, string(value)) {
+		return fmt.Errorf("failed to save ask settings")
+	}
+	return nil
+}
+
+// ListPendingDecisions returns the prompts waiting for an answer, oldest first.
+func (p *ProxyService) ListPendingDecisions() []PendingDecision {
+	p.askMu.Lock()
+	defer p.askMu.Unlock()
+
+	list := make([]PendingDecision, 0, len(p.pending))
+	for _, d := range p.pending {
+		list = append(list, d.PendingDecision)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// AnswerDecision releases the connections waiting on the prompt with the
+// given id. Unless the answer is for this time only, it is saved as a rule
+// for the host and port, scoped to the application when it is known.
+func (p *ProxyService) AnswerDecision(id int64, answer DecisionAnswer) error {
+	p.askMu.Lock()
+	d, ok := p.pending[id]
+	p.askMu.Unlock()
+	if !ok {
+		return fmt.Errorf("decision %d not found", id)
+	}
+
+	var expires int64
+	switch answer.Remember {
+	case "", RememberOnce, RememberForever:
+	case RememberMinutes:
+		if answer.Minutes <= 0 {
+			return fmt.Errorf("minutes must be positive")
+		}
+		expires = time.Now().Add(time.Duration(answer.Minutes) * time.Minute).UnixMilli()
+	default:
+		return fmt.Errorf("unknown remember option %q", answer.Remember)
+	}
+
+	if answer.Remember == RememberForever || answer.Remember == RememberMinutes {
+		action := db_service.ActionBlock
+		if answer.Allow {
+			action = db_service.ActionAllow
+		}
+		// Saved before releasing the waiters so new connections see the rule
+		rule := db_service.BlockedDomainInfo{
+			Domain:     d.Host,
+			FilterType: "exact",
+			App:        d.ProcessPath,
+			Action:     action,
+			Ports:      strconv.Itoa(d.Port),
+			ExpiresAt:  expires,
+		}
+		if !p.db().SaveRule(rule) {
+			return fmt.Errorf("failed to save rule for %q", d.Host)
+		}
+	}
+
+	p.resolve(d, answer.Allow, false)
+	return nil
+}
+
+// ask holds the calling connection until the user answers or the timeout
+// passes, and reports whether it may proceed.
+func (p *ProxyService) ask(host string, port int, method string, proc processInfo, settings AskSettings) bool {
+	host = strings.ToLower(host)
+	timeout := time.Duration(settings.TimeoutSeconds) * time.Second
+
+	p.askMu.Lock()
+	var d *pendingDecision
+	for _, pending := range p.pending {
+		if pending.Host == host && pending.Port == port && pending.ProcessPath == proc.Path {
+			d = pending
+			break
+		}
+	}
+	created := d == nil
+	if created {
+		now := time.Now()
+		p.nextDecisionID++
+		d = &pendingDecision{
+			PendingDecision: PendingDecision{
+				ID:          p.nextDecisionID,
+				Host:        host,
+				Port:        port,
+				Method:      method,
+				ProcessName: proc.Name,
+				ProcessPath: proc.Path,
+				Created:     now.UnixMilli(),
+				Deadline:    now.Add(timeout).UnixMilli(),
+			},
+			done: make(chan struct{}),
+		}
+		if p.pending == nil {
+			p.pending = make(map[int64]*pendingDecision)
+		}
+		p.pending[d.ID] = d
+	}
+	p.askMu.Unlock()
+
+	if created {
+		log.Printf("Asking whether %s may connect to %s:%d", processLabel(proc), host, port)
+		p.emit(DecisionRequestedEvent, d.PendingDecision)
+	}
+
+	timer := time.NewTimer(time.Until(time.UnixMilli(d.Deadline)))
+	defer timer.Stop()
+	select {
+	case <-d.done:
+	case <-timer.C:
+		p.resolve(d, settings.DefaultAction == db_service.ActionAllow, true)
+	}
+	<-d.done
+	return d.allowed
+}
+
+// resolve releases the connections waiting on d unless it was already resolved
+func (p *ProxyService) resolve(d *pendingDecision, allowed, timedOut bool) {
+	p.askMu.Lock()
+	if _, ok := p.pending[d.ID]; !ok {
+		p.askMu.Unlock()
+		return
+	}
+	delete(p.pending, d.ID)
+	d.allowed = allowed
+	close(d.done)
+	p.askMu.Unlock()
+
+	p.emit(DecisionResolvedEvent, DecisionResolvedData{ID: d.ID, Allowed: allowed, TimedOut: timedOut})
+}
+
+// resolveAllPending applies the default action to every open prompt
+func (p *ProxyService) resolveAllPending() {
+	allow := p.GetAskSettings().DefaultAction == db_service.ActionAllow
+	p.askMu.Lock()
+	pending := make([]*pendingDecision, 0, len(p.pending))
+	for _, d := range p.pending {
+		pending = append(pending, d)
+	}
+	p.askMu.Unlock()
+
+	for _, d := range pending {
+		p.resolve(d, allow, true)
+	}
+}
+
+// emit sends an event to the frontend
+func (p *ProxyService) emit(name string, data any) {
+	if p.emitEvent != nil {
+		p.emitEvent(name, data)
+		return
+	}
+	app := application.Get()
+	if app == nil {
+		return
+	}
+	app.Event.Emit(name, data)
+}
+
+// processLabel names a process for log messages
+func processLabel(proc processInfo) string {
+	if proc.Path != "" {
+		return proc.Path
+	}
+	return "a client"
+}
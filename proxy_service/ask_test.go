@@ -0,0 +1,129 @@
+package proxy_service
+
+import (
+	"changeme/db_service"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAsk_AnswerForeverSavesRule(t *testing.T) {
+	proxy := setupTestProxy(t)
+	requested := make(chan PendingDecision, 1)
+	proxy.emitEvent = func(name string, data any) {
+		if name == DecisionRequestedEvent {
+			requested <- data.(PendingDecision)
+		}
+	}
+	if err := proxy.SetAskSettings(AskSettings{Enabled: true, TimeoutSeconds: 10, DefaultAction: db_service.ActionBlock}); err != nil {
+		t.Fatalf("SetAskSettings failed: %v", err)
+	}
+	echoAddr := startEchoServer(t)
+	socksAddr := startTestSocks(t, proxy)
+
+	conn := socksDial(t, socksAddr, "localhost", echoAddr.Port)
+	defer conn.Close()
+
+	var decision PendingDecision
+	select {
+	case decision = <-requested:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no decision was requested")
+	}
+	if decision.Host != "localhost" || decision.Method != "SOCKS5" {
+		t.Fatalf("unexpected decision: %+v", decision)
+	}
+	if pending := proxy.ListPendingDecisions(); len(pending) != 1 || pending[0].ID != decision.ID {
+		t.Fatalf("expected the decision to be pending, got %+v", pending)
+	}
+
+	if err := proxy.AnswerDecision(decision.ID, DecisionAnswer{Allow: true, Remember: RememberForever}); err != nil {
+		t.Fatalf("AnswerDecision failed: %v", err)
+	}
+	if reply := readSocksReply(t, conn); reply != socksReplySucceeded {
+		t.Fatalf("expected the connection to be allowed, got reply %d", reply)
+	}
+
+	rule, found := proxy.DbService.FindRule(db_service.MatchTarget{Domain: "localhost", Port: echoAddr.Port})
+	if !found || rule.Action != db_service.ActionAllow || rule.Ports != strconv.Itoa(echoAddr.Port) {
+		t.Fatalf("expected a saved allow rule for the port, got %+v (found %v)", rule, found)
+	}
+
+	// The rule answers the next connection without asking
+	again := socksDial(t, socksAddr, "localhost", echoAddr.Port)
+	defer again.Close()
+	if reply := readSocksReply(t, again); reply != socksReplySucceeded {
+		t.Fatalf("expected the saved rule to allow, got reply %d", reply)
+	}
+	if len(requested) != 0 {
+		t.Fatal("expected no second prompt")
+	}
+
+	// Another port of the same host is asked about separately
+	other := socksDial(t, socksAddr, "localhost", echoAddr.Port+1)
+	defer other.Close()
+	select {
+	case decision = <-requested:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no decision was requested for the other port")
+	}
+	if decision.Port != echoAddr.Port+1 {
+		t.Fatalf("unexpected decision: %+v", decision)
+	}
+	if err := proxy.AnswerDecision(decision.ID, DecisionAnswer{Allow: false}); err != nil {
+		t.Fatalf("AnswerDecision failed: %v", err)
+	}
+	if reply := readSocksReply(t, other); reply != socksReplyNotAllowed {
+		t.Fatalf("expected the other port to be denied, got reply %d", reply)
+	}
+}
+
+func TestAsk_TimeoutAppliesDefault(t *testing.T) {
+	proxy := setupTestProxy(t)
+	resolved := make(chan DecisionResolvedData, 1)
+	proxy.emitEvent = func(name string, data any) {
+		if name == DecisionResolvedEvent {
+			resolved <- data.(DecisionResolvedData)
+		}
+	}
+	if err := proxy.SetAskSettings(AskSettings{Enabled: true, TimeoutSeconds: 1, DefaultAction: db_service.ActionBlock}); err != nil {
+		t.Fatalf("SetAskSettings failed: %v", err)
+	}
+	socksAddr := startTestSocks(t, proxy)
+
+	conn := socksDial(t, socksAddr, "unknown.test", 443)
+	defer conn.Close()
+	if reply := readSocksReply(t, conn); reply != socksReplyNotAllowed {
+		t.Fatalf("expected the default action to deny, got reply %d", reply)
+	}
+	if r := <-resolved; r.Allowed || !r.TimedOut {
+		t.Fatalf("unexpected resolution: %+v", r)
+	}
+	if rules := proxy.DbService.ListBlockedDomainsWithInfo(); len(rules) != 0 {
+		t.Fatalf("a timeout should not save rules, got %+v", rules)
+	}
+}
+
+func TestDecideUnknown_LearningBeforeAsk(t *testing.T) {
+	proxy := setupTestProxy(t)
+	proxy.emitEvent = func(name string, data any) {
+		t.Errorf("unexpected event %s while learning", name)
+	}
+	proxy.SetAskSettings(AskSettings{Enabled: true, TimeoutSeconds: 1, DefaultAction: db_service.ActionBlock})
+	proxy.DbService.SetPolicy(db_service.Policy{
+		DefaultAction: db_service.ActionBlock,
+		LearningUntil: time.Now().Add(time.Hour).UnixMilli(),
+		AllowedPorts:  "1-65535",
+	})
+	echoAddr := startEchoServer(t)
+	socksAddr := startTestSocks(t, proxy)
+
+	conn := socksDial(t, socksAddr, "localhost", echoAddr.Port)
+	defer conn.Close()
+	if reply := readSocksReply(t, conn); reply != socksReplySucceeded {
+		t.Fatalf("expected learning to allow, got reply %d", reply)
+	}
+	if candidates := proxy.DbService.ListCandidates(); len(candidates) != 1 || candidates[0].Host != "localhost" {
+		t.Fatalf("expected localhost to be recorded, got %+v", candidates)
+	}
+}
@@ -0,0 +1,259 @@
+package proxy_service
+
+import (
+	"bufio"
+	"changeme/db_service"
+	"changeme/logging_service"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// ActiveConnection describes a tunnel or HTTP request currently open through the proxy
+type ActiveConnection struct {
+	ID         int64  `json:"id"`
+	Host       string `json:"host"`
+	Port       int    `json:"port"`
+	Method     string `json:"method"`
+	ClientAddr string `json:"clientAddr"`
+	// ProcessName and ProcessPath identify the local application, when known
+	ProcessName string `json:"processName"`
+	ProcessPath string `json:"processPath"`
+	// User is the authenticated proxy user, if any
+	User      string `json:"user"`
+	Start     int64  `json:"start"` // unix milliseconds
+	BytesUp   int64  `json:"bytesUp"`
+	BytesDown int64  `json:"bytesDown"`
+}
+
+// activeConn is a registry entry; close tears the connection down
+type activeConn struct {
+	id         int64
+	host       string
+	port       int
+	method     string
+	clientAddr string
+	process    processInfo
+	user       string
+	start      time.Time
+	up, down   *atomic.Int64
+	close      func()
+
+	// tunnel is the policy decision of a plain HTTP request, set by
+	// filterHTTP and logged once the response has been sent
+	tunnel *tunnel
+}
+
+// connContextKey carries the registry entry of a plain HTTP request
+type connContextKey struct{}
+
+// track adds c to the connection registry and returns a function removing it again
+func (p *ProxyService) track(c *activeConn) func() {
+	p.connMu.Lock()
+	p.nextConnID++
+	c.id = p.nextConnID
+	if p.conns == nil {
+		p.conns = make(map[int64]*activeConn)
+	}
+	p.conns[c.id] = c
+	p.connMu.Unlock()
+
+	return func() {
+		p.connMu.Lock()
+		delete(p.conns, c.id)
+		p.connMu.Unlock()
+	}
+}
+
+// ListActiveConnections returns the open tunnels and in-flight HTTP requests, oldest first.
+func (p *ProxyService) ListActiveConnections() []ActiveConnection {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+
+	list := make([]ActiveConnection, 0, len(p.conns))
+	for _, c := range p.conns {
+		list = append(list, ActiveConnection{
+			ID:          c.id,
+			Host:        c.host,
+			Port:        c.port,
+			Method:      c.method,
+			ClientAddr:  c.clientAddr,
+			ProcessName: c.process.Name,
+			ProcessPath: c.process.Path,
+			User:        c.user,
+			Start:       c.start.UnixMilli(),
+			BytesUp:     c.up.Load(),
+			BytesDown:   c.down.Load(),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// CloseConnection tears down the active connection with the given id
+func (p *ProxyService) CloseConnection(id int64) error {
+	p.connMu.Lock()
+	c, ok := p.conns[id]
+	p.connMu.Unlock()
+	if !ok {
+		return fmt.Errorf("connection %d not found", id)
+	}
+	log.Printf("Closing %s connection to %s:%d", c.method, c.host, c.port)
+	c.close()
+	return nil
+}
+
+// recheckDelay batches rule changes, e.g. from an import, into a single
+// pass over the open connections
+const recheckDelay = 250 * time.Millisecond
+
+// scheduleRecheck is registered as a rules listener. It returns right away
+// and runs closeBlockedConnections once the rules have stopped changing for
+// recheckDelay, so a new block rule, or a deleted allow rule under
+// default-deny, also cuts connections approved before.
+func (p *ProxyService) scheduleRecheck() {
+	p.recheckMu.Lock()
+	defer p.recheckMu.Unlock()
+	if p.recheckTimer != nil {
+		p.recheckTimer.Reset(recheckDelay)
+		return
+	}
+	p.recheckTimer = time.AfterFunc(recheckDelay, func() {
+		p.recheckMu.Lock()
+		p.recheckTimer = nil
+		p.recheckMu.Unlock()
+		p.closeBlockedConnections()
+	})
+}
+
+// closeBlockedConnections decides every open connection again and tears
+// down the ones that are no longer allowed. Connections no rule decides are
+// only cut under default-deny: while learning or in ask mode they were let
+// through by a decision that is not kept per connection.
+func (p *ProxyService) closeBlockedConnections() {
+	if p.IsPaused() {
+		return
+	}
+
+	p.connMu.Lock()
+	conns := make([]*activeConn, 0, len(p.conns))
+	for _, c := range p.conns {
+		conns = append(conns, c)
+	}
+	p.connMu.Unlock()
+	if len(conns) == 0 {
+		return
+	}
+
+	policy := p.db().GetPolicy()
+	denyUnknown := policy.DefaultAction == db_service.ActionBlock && !policy.Learning() && !p.GetAskSettings().Enabled
+	for _, c := range conns {
+		v := p.evaluate(c.host, c.port, c.method, c.process, policy)
+		if v.unknown && denyUnknown {
+			v.blocked, v.reason = true, logging_service.ReasonPolicy
+		}
+		if v.blocked {
+			log.Printf("Closing %s connection to %s:%d, now blocked (%s)", c.method, c.host, c.port, v.reason)
+			c.close()
+		}
+	}
+}
+
+// trackHTTP registers plain HTTP proxy requests while they are served so they
+// are listed as active connections and can be cancelled. The sending process
+// is looked up here, before the entry is listed, and reused by filterHTTP.
+// CONNECT requests are registered by relay once the tunnel is up.
+func (p *ProxyService) trackHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect || !r.URL.IsAbs() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		host, port := httpTarget(r.URL)
+		c := &activeConn{
+			host:       host,
+			port:       port,
+			method:     r.Method,
+			clientAddr: r.RemoteAddr,
+			process:    p.requestProcess(r),
+			user:       requestUser(r),
+			start:      time.Now(),
+			up:         new(atomic.Int64),
+			down:       new(atomic.Int64),
+			close:      cancel,
+		}
+		untrack := p.track(c)
+
+		r = r.WithContext(context.WithValue(ctx, connContextKey{}, c))
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &countingBody{ReadCloser: r.Body, n: c.up}
+		}
+		next.ServeHTTP(&countingWriter{ResponseWriter: w, n: c.down}, r)
+		untrack()
+
+		if t := c.tunnel; t != nil {
+			t.up.Store(c.up.Load())
+			t.down.Store(c.down.Load())
+			p.finishTunnel(t)
+		}
+	})
+}
+
+// httpTarget returns the host and port a plain HTTP proxy request is sent to
+func httpTarget(u *url.URL) (string, int) {
+	port := 80
+	if u.Scheme == "https" {
+		port = 443
+	}
+	if pnum, err := strconv.Atoi(u.Port()); err == nil {
+		port = pnum
+	}
+	return u.Hostname(), port
+}
+
+// countingBody counts the request body bytes sent upstream
+type countingBody struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
+
+// countingWriter counts the response bytes written to the client. It keeps
+// flushing and hijacking available for streamed responses and websockets.
+type countingWriter struct {
+	http.ResponseWriter
+	n *atomic.Int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n.Add(int64(n))
+	return n, err
+}
+
+func (w *countingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *countingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
@@ -0,0 +1,163 @@
+package proxy_service
+
+import (
+	"changeme/db_service"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestConnections_BlockRuleClosesTunnel(t *testing.T) {
+	proxy := setupTestProxy(t)
+	proxy.DbService.OnRulesChanged(proxy.scheduleRecheck)
+	echoAddr := startEchoServer(t)
+	socksAddr := startTestSocks(t, proxy)
+
+	conn := socksDial(t, socksAddr, "localhost", echoAddr.Port)
+	defer conn.Close()
+	if reply := readSocksReply(t, conn); reply != socksReplySucceeded {
+		t.Fatalf("expected success reply, got %d", reply)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+
+	active := proxy.ListActiveConnections()
+	if len(active) != 1 {
+		t.Fatalf("expected 1 active connection, got %d", len(active))
+	}
+	if c := active[0]; c.Host != "localhost" || c.Method != "SOCKS5" || c.BytesUp != 4 || c.BytesDown != 4 || c.ClientAddr != conn.LocalAddr().String() {
+		t.Fatalf("unexpected connection: %+v", c)
+	}
+
+	proxy.DbService.BlockDomain("localhost")
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expected the tunnel to be closed, read %d bytes", n)
+	}
+	waitForConnections(t, proxy, 0)
+}
+
+func TestConnections_DeletedAllowRuleClosesTunnelUnderDefaultDeny(t *testing.T) {
+	proxy := setupTestProxy(t)
+	proxy.DbService.OnRulesChanged(proxy.scheduleRecheck)
+	proxy.DbService.SetPolicy(db_service.Policy{DefaultAction: db_service.ActionBlock, AllowedPorts: "1-65535"})
+	proxy.DbService.SaveRule(db_service.BlockedDomainInfo{Domain: "localhost", FilterType: "exact", Action: db_service.ActionAllow})
+	echoAddr := startEchoServer(t)
+	socksAddr := startTestSocks(t, proxy)
+
+	conn := socksDial(t, socksAddr, "localhost", echoAddr.Port)
+	defer conn.Close()
+	if reply := readSocksReply(t, conn); reply != socksReplySucceeded {
+		t.Fatalf("expected success reply, got %d", reply)
+	}
+	waitForConnections(t, proxy, 1)
+
+	// Unrelated rule changes leave the tunnel alone
+	proxy.DbService.BlockDomain("other.test")
+	time.Sleep(2 * recheckDelay)
+	if got := len(proxy.ListActiveConnections()); got != 1 {
+		t.Fatalf("expected the tunnel to stay open, got %d connections", got)
+	}
+
+	proxy.DbService.UnblockDomain("localhost")
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expected the tunnel to be closed, read %d bytes", n)
+	}
+	waitForConnections(t, proxy, 0)
+}
+
+func TestConnections_CloseHTTPRequest(t *testing.T) {
+	proxy := setupTestProxy(t)
+	started := make(chan struct{})
+	handler := proxy.trackHTTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest(http.MethodGet, "http://example.com:8080/slow", nil)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	<-started
+
+	active := proxy.ListActiveConnections()
+	if len(active) != 1 || active[0].Host != "example.com" || active[0].Port != 8080 || active[0].Method != http.MethodGet {
+		t.Fatalf("unexpected active connections: %+v", active)
+	}
+	if err := proxy.CloseConnection(active[0].ID); err != nil {
+		t.Fatalf("CloseConnection failed: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("request was not cancelled")
+	}
+	if got := proxy.ListActiveConnections(); len(got) != 0 {
+		t.Fatalf("expected no active connections, got %+v", got)
+	}
+	if err := proxy.CloseConnection(active[0].ID); err == nil {
+		t.Fatal("expected an error closing an unknown connection")
+	}
+}
+
+func TestHTTP_PolicyAppliesToPlainRequests(t *testing.T) {
+	proxy := setupTestProxy(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer backend.Close()
+	server := httptest.NewServer(proxy.handler())
+	defer server.Close()
+	proxyURL, _ := url.Parse(server.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	get := func() int {
+		resp, err := client.Get(backend.URL)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode
+	}
+
+	if code := get(); code != http.StatusOK {
+		t.Fatalf("expected the request to pass, got %d", code)
+	}
+
+	proxy.DbService.SetPolicy(db_service.Policy{DefaultAction: db_service.ActionBlock, AllowedPorts: "1-65535"})
+	if code := get(); code != http.StatusForbidden {
+		t.Fatalf("expected default-deny to refuse the request, got %d", code)
+	}
+
+	// Learning lets the host pass and records it as a candidate
+	proxy.DbService.SetPolicy(db_service.Policy{DefaultAction: db_service.ActionBlock, AllowedPorts: "1-65535", LearningUntil: time.Now().Add(time.Hour).UnixMilli()})
+	if code := get(); code != http.StatusOK {
+		t.Fatalf("expected the request to pass while learning, got %d", code)
+	}
+	if candidates := proxy.DbService.ListCandidates(); len(candidates) != 1 || candidates[0].Host != "127.0.0.1" {
+		t.Fatalf("expected the host to be recorded, got %+v", candidates)
+	}
+}
+
+func waitForConnections(t *testing.T, p *ProxyService, want int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for len(p.ListActiveConnections()) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d active connections, got %d", want, len(p.ListActiveConnections()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,225 @@
+package proxy_service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// guardSettingKey stores the NetworkGuardSettings as JSON in the settings table
+const guardSettingKey = "proxy.network_guard"
+
+// errPrivateNetwork is returned for dials refused by the network guard
+var errPrivateNetwork = errors.New("destination is in a blocked network range")
+
+// NetworkGuardSettings configures the private-network guard. It checks the
+// address a tunnel or HTTP request actually connects to, after DNS
+// resolution, so public names pointed at private addresses are caught too.
+type NetworkGuardSettings struct {
+	Enabled bool `json:"enabled"`
+	// LocalClients also guards connections from this machine. By default
+	// only clients on other machines are kept out of the blocked ranges.
+	LocalClients bool `json:"localClients"`
+	// BlockedRanges are the CIDR ranges the proxy refuses to connect to
+	BlockedRanges []string `json:"blockedRanges"`
+}
+
+// DefaultBlockedRanges are the loopback, private, link-local and other
+// reserved ranges, including the cloud metadata address 169.254.169.254.
+var DefaultBlockedRanges = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// DefaultNetworkGuardSettings keep clients on other machines out of the default ranges.
+var DefaultNetworkGuardSettings = NetworkGuardSettings{Enabled: true, BlockedRanges: DefaultBlockedRanges}
+
+// GetNetworkGuardSettings returns the configured guard settings, or the defaults when unset.
+func (p *ProxyService) GetNetworkGuardSettings() NetworkGuardSettings {
+	value, ok := p.db().GetSetting(guardSettingKey)
+	if !ok {
+		return DefaultNetworkGuardSettings
+	}
+	var settings NetworkGuardSettings
+	if err := json.Unmarshal([]byte(value), &settings); err != nil {
+		log.Printf("warning: invalid network guard settings %q: %v", value, err)
+		return DefaultNetworkGuardSettings
+	}
+	return settings
+}
+
+// SetNetworkGuardSettings stores the guard settings; they apply to the next connection.
+func (p *ProxyService) SetNetworkGuardSettings(settings NetworkGuardSettings) error {
+	if _, err := parseRanges(settings.BlockedRanges); err != nil {
+		return err
+	}
+	value, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	if !p.db().SetSetting(guardSettingKey, string(value)) {
+		return fmt.Errorf("failed to save network guard settings")
+	}
+	return nil
+}
+
+// parseRanges parses CIDR ranges; a bare address is a range of one
+func parseRanges(ranges []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(ranges))
+	for _, r := range ranges {
+		if ip := net.ParseIP(r); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %q: %w", r, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// networkGuard refuses connections to blocked ranges at dial time. A nil
+// guard allows everything.
+type networkGuard struct {
+	ranges []*net.IPNet
+}
+
+// guardFor returns the guard for connections from client, or nil when the
+// guard is off or does not apply to the client.
+func (p *ProxyService) guardFor(client net.Addr) *networkGuard {
+	settings := p.GetNetworkGuardSettings()
+	if !settings.Enabled {
+		return nil
+	}
+	if !settings.LocalClients && isLoopback(client) {
+		return nil
+	}
+	ranges, err := parseRanges(settings.BlockedRanges)
+	if err != nil {
+		log.Printf("warning: %v; using the default blocked ranges", err)
+		ranges, _ = parseRanges(DefaultBlockedRanges)
+	}
+	return &networkGuard{ranges: ranges}
+}
+
+// isLoopback reports whether addr is a loopback TCP address
+func isLoopback(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	return ok && tcp != nil && tcp.IP.IsLoopback()
+}
+
+// check refuses ip when it is in a blocked range
+func (g *networkGuard) check(ip net.IP) error {
+	for _, network := range g.ranges {
+		if network.Contains(ip) {
+			return fmt.Errorf("%w: %s is in %s", errPrivateNetwork, ip, network)
+		}
+	}
+	return nil
+}
+
+// control runs after name resolution, right before each connection attempt,
+// so it sees the address really dialed
+func (g *networkGuard) control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%w: unexpected address %q", errPrivateNetwork, address)
+	}
+	return g.check(ip)
+}
+
+// dialer returns a dialer with the given timeout that enforces the guard
+func (g *networkGuard) dialer(timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+	if g != nil {
+		d.Control = g.control
+	}
+	return d
+}
+
+// guardContextKey carries the network guard of a plain HTTP request to the transport
+type guardContextKey struct{}
+
+// guardHTTP attaches the client's network guard to plain HTTP proxy requests.
+// The transport enforces it through dialHTTP. Requests sent on to an
+// upstream proxy are left alone, since the upstream picks the address.
+func (p *ProxyService) guardHTTP(tr *http.Transport, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect || !r.URL.IsAbs() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if tr.Proxy != nil {
+			if upstream, err := tr.Proxy(r); err != nil || upstream != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		client, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+		if guard := p.guardFor(client); guard != nil {
+			r = r.WithContext(context.WithValue(r.Context(), guardContextKey{}, guard))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// guardTransport sends guarded plain HTTP requests through their own
+// transport. Connections in the shared pool may have been dialed for a
+// client the guard does not apply to, so reusing one would skip the check;
+// the guarded transport keeps none, so every guarded request is dialed anew.
+func guardTransport(proxy *goproxy.ProxyHttpServer) {
+	guarded := proxy.Tr.Clone()
+	guarded.DisableKeepAlives = true
+	roundTrip := goproxy.RoundTripperFunc(func(req *http.Request, _ *goproxy.ProxyCtx) (*http.Response, error) {
+		return guarded.RoundTrip(req)
+	})
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if req.Context().Value(guardContextKey{}) != nil {
+			ctx.RoundTripper = roundTrip
+		}
+		return req, nil
+	})
+}
+
+// dialHTTP is the transport's DialContext; it applies the guard set by guardHTTP
+func dialHTTP(ctx context.Context, network, addr string) (net.Conn, error) {
+	guard, _ := ctx.Value(guardContextKey{}).(*networkGuard)
+	conn, err := guard.dialer(tunnelDialTimeout).DialContext(ctx, network, addr)
+	if errors.Is(err, errPrivateNetwork) {
+		log.Printf("Refused HTTP request to %s: %v", addr, err)
+		privateNetworkBlocks.Inc("HTTP")
+	}
+	return conn, err
+}
@@ -0,0 +1,159 @@
+package proxy_service
+
+import (
+	"changeme/logging_service"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestNetworkGuard_Check(t *testing.T) {
+	ranges, err := parseRanges(DefaultBlockedRanges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	guard := &networkGuard{ranges: ranges}
+
+	for addr, blocked := range map[string]bool{
+		"127.0.0.1":        true,
+		"::ffff:127.0.0.1": true,
+		"::1":              true,
+		"169.254.169.254":  true,
+		"10.1.2.3":         true,
+		"192.168.1.1":      true,
+		"fd00::1":          true,
+		"93.184.216.34":    false,
+		"2606:4700::1111":  false,
+	} {
+		if err := guard.check(net.ParseIP(addr)); (err != nil) != blocked {
+			t.Errorf("check(%s) = %v, want blocked %v", addr, err, blocked)
+		}
+	}
+}
+
+func TestNetworkGuardSettings(t *testing.T) {
+	proxy := setupTestProxy(t)
+	if got := proxy.GetNetworkGuardSettings(); !got.Enabled || got.LocalClients || len(got.BlockedRanges) != len(DefaultBlockedRanges) {
+		t.Fatalf("unexpected defaults: %+v", got)
+	}
+	if err := proxy.SetNetworkGuardSettings(NetworkGuardSettings{Enabled: true, BlockedRanges: []string{"10.0.0.0/33"}}); err == nil {
+		t.Fatal("expected invalid ranges to be rejected")
+	}
+
+	// Loopback clients are only guarded when asked to
+	loopback := &net.TCPAddr{IP: net.IPv6loopback, Port: 5000}
+	if proxy.guardFor(loopback) != nil {
+		t.Fatal("loopback clients should not be guarded by default")
+	}
+	if proxy.guardFor(&net.TCPAddr{IP: net.ParseIP("192.168.1.20"), Port: 5000}) == nil {
+		t.Fatal("remote clients should be guarded")
+	}
+	if err := proxy.SetNetworkGuardSettings(NetworkGuardSettings{Enabled: true, LocalClients: true, BlockedRanges: []string{"203.0.113.7"}}); err != nil {
+		t.Fatal(err)
+	}
+	guard := proxy.guardFor(loopback)
+	if guard == nil || guard.check(net.ParseIP("203.0.113.7")) == nil || guard.check(net.ParseIP("203.0.113.8")) != nil {
+		t.Fatalf("expected a guard for the single address, got %+v", guard)
+	}
+}
+
+func TestSocks_NetworkGuard(t *testing.T) {
+	proxy := setupTestProxy(t)
+	proxy.SetNetworkGuardSettings(NetworkGuardSettings{Enabled: true, LocalClients: true, BlockedRanges: DefaultBlockedRanges})
+	echoAddr := startEchoServer(t)
+	socksAddr := startTestSocks(t, proxy)
+	blocksBefore := privateNetworkBlocks.Value("SOCKS5")
+
+	// localhost passes the rules but resolves to a loopback address
+	conn := socksDial(t, socksAddr, "localhost", echoAddr.Port)
+	defer conn.Close()
+	if reply := readSocksReply(t, conn); reply != socksReplyNotAllowed {
+		t.Fatalf("expected not-allowed reply, got %d", reply)
+	}
+	if got := privateNetworkBlocks.Value("SOCKS5") - blocksBefore; got != 1 {
+		t.Fatalf("expected 1 guard block in metrics, got %d", got)
+	}
+}
+
+func TestDialHTTP_AppliesGuardFromContext(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	ranges, _ := parseRanges([]string{"127.0.0.0/8"})
+	ctx := context.WithValue(context.Background(), guardContextKey{}, &networkGuard{ranges: ranges})
+
+	if _, err := dialHTTP(ctx, "tcp", echoAddr.String()); !errors.Is(err, errPrivateNetwork) {
+		t.Fatalf("expected the guard to refuse, got %v", err)
+	}
+	conn, err := dialHTTP(context.Background(), "tcp", echoAddr.String())
+	if err != nil {
+		t.Fatalf("expected an unguarded dial to succeed: %v", err)
+	}
+	conn.Close()
+}
+
+func TestHTTP_NetworkGuardRefusalIsLogged(t *testing.T) {
+	proxy := setupTestProxy(t)
+	proxy.SetNetworkGuardSettings(NetworkGuardSettings{Enabled: true, LocalClients: true, BlockedRanges: DefaultBlockedRanges})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	server := httptest.NewServer(proxy.handler())
+	defer server.Close()
+	proxyURL, _ := url.Parse(server.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	resp, err := client.Get(backend.URL)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected the guard to refuse with 403, got %d", resp.StatusCode)
+	}
+
+	// The refused request is logged as rejected with its own reason
+	tun := proxy.allowConnect("127.0.0.1", 80, http.MethodGet, processInfo{}, "")
+	ctx := &goproxy.ProxyCtx{Req: httptest.NewRequest(http.MethodGet, "http://127.0.0.1/", nil), UserData: tun, Error: fmt.Errorf("dial: %w", errPrivateNetwork)}
+	if resp := proxy.finishHTTP(nil, ctx); resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected a 403 response, got %+v", resp)
+	}
+	if entry := tun.logEntry(); entry.Approved || entry.Reason != logging_service.ReasonPrivateNetwork {
+		t.Fatalf("unexpected entry: %+v", entry)
+	}
+}
+
+func TestHTTP_GuardedRequestsDoNotReusePooledConnections(t *testing.T) {
+	proxy := setupTestProxy(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	server := httptest.NewServer(proxy.handler())
+	defer server.Close()
+	proxyURL, _ := url.Parse(server.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	// An unguarded loopback client leaves an idle connection to the backend
+	proxy.SetNetworkGuardSettings(NetworkGuardSettings{Enabled: true, LocalClients: false, BlockedRanges: DefaultBlockedRanges})
+	resp, err := client.Get(backend.URL)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the unguarded request to pass, got %d", resp.StatusCode)
+	}
+
+	proxy.SetNetworkGuardSettings(NetworkGuardSettings{Enabled: true, LocalClients: true, BlockedRanges: DefaultBlockedRanges})
+	resp, err = client.Get(backend.URL)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected the guarded request to be refused despite the pooled connection, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,20 @@
+package proxy_service
+
+import "changeme/metrics_service"
+
+var (
+	connectRequests = metrics_service.NewCounterVec("local_proxy_connect_requests_total",
+		"Tunnel requests by protocol (CONNECT or SOCKS5) and decision (approved, rejected, would_reject or paused).", "method", "decision")
+	ruleMatches = metrics_service.NewCounterVec("local_proxy_rule_matches_total",
+		"Requests blocked by a rule, or let through by a log-only rule, by rule filter type.", "filter_type")
+	matchDuration = metrics_service.NewHistogram("local_proxy_rule_match_duration_seconds",
+		"Time spent evaluating the rules for a request.", nil)
+	activeTunnels = metrics_service.NewGauge("local_proxy_active_tunnels",
+		"Tunnels currently open to an upstream host.")
+	tunnelBytes = metrics_service.NewCounterVec("local_proxy_tunnel_bytes_total",
+		"Bytes relayed through tunnels; up is client to upstream.", "direction")
+	clientRejections = metrics_service.NewCounterVec("local_proxy_client_rejections_total",
+		"Clients refused by the access settings, by reason (address, auth or auth_rate).", "reason")
+	privateNetworkBlocks = metrics_service.NewCounterVec("local_proxy_private_network_blocks_total",
+		"Connections refused by the network guard, by protocol (CONNECT, SOCKS5 or HTTP).", "method")
+)
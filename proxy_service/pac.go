@@ -0,0 +1,280 @@
+package proxy_service
+
+import (
+	"changeme/db_service"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const PAC_PATH = "/proxy.pac"
+
+// systemProxySettingKey stores the SystemProxySettings as JSON in the settings table
+const systemProxySettingKey = "proxy.system"
+
+// SystemProxySettings configures how ResumeProxy points the system at the proxy
+type SystemProxySettings struct {
+	// UsePAC sets the auto-config URL of the generated proxy.pac instead of
+	// static web proxies, so only hosts with rules go through the proxy
+	UsePAC bool `json:"usePAC"`
+}
+
+// GetSystemProxySettings returns the saved system proxy settings; the zero value when unset.
+func (p *ProxyService) GetSystemProxySettings() SystemProxySettings {
+	value, ok := p.db().GetSetting(systemProxySettingKey)
+	if !ok {
+		return SystemProxySettings{}
+	}
+	var settings SystemProxySettings
+	if err := json.Unmarshal([]byte(value), &settings); err != nil {
+		log.Printf("warning: invalid system proxy settings %q: %v", value, err)
+		return SystemProxySettings{}
+	}
+	return settings
+}
+
+// SetSystemProxySettings saves the system proxy settings and applies them
+// right away when the proxy is running.
+func (p *ProxyService) SetSystemProxySettings(settings SystemProxySettings) error {
+	value, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	if !p.db().SetSetting(systemProxySettingKey, string(value)) {
+		return fmt.Errorf("failed to save system proxy settings")
+	}
+	p.UsePAC = settings.UsePAC
+	if p.IsPaused() {
+		return nil
+	}
+	return p.applySystemProxy()
+}
+
+// PACURL returns the URL the proxy auto-config script is served from
+func (p *ProxyService) PACURL() string {
+	return fmt.Sprintf("http://127.0.0.1:%d%s", PROXY_PORT, PAC_PATH)
+}
+
+// serveNonProxy handles plain (non-proxy) requests made to the proxy listener.
+// It serves the PAC script and rejects everything else.
+func (p *ProxyService) serveNonProxy(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != PAC_PATH {
+		http.Error(w, "This is a proxy server. Does not respond to non-proxy requests.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write([]byte(p.pacFile()))
+}
+
+// pacFile returns the current PAC script, regenerating it after rule
+// changes and once the first temporary rule in it has expired
+func (p *ProxyService) pacFile() string {
+	// The learning period ends on its own, so this is checked every time
+	policy := p.db().GetPolicy()
+	proxyUnknown := policy.DefaultAction == db_service.ActionBlock || policy.Learning() || p.GetAskSettings().Enabled
+	now := time.Now().UnixMilli()
+
+	p.pacMu.Lock()
+	defer p.pacMu.Unlock()
+	expired := p.pacExpires != 0 && now >= p.pacExpires
+	if p.pacScript == "" || p.pacProxyUnknown != proxyUnknown || expired {
+		rules := p.db().ListBlockedDomainsWithInfo()
+		p.pacScript = generatePAC(rules, fmt.Sprintf("127.0.0.1:%d", PROXY_PORT), proxyUnknown)
+		p.pacProxyUnknown = proxyUnknown
+		p.pacExpires = soonestExpiry(rules)
+	}
+	return p.pacScript
+}
+
+// soonestExpiry returns when the first temporary rule expires; 0 if none do
+func soonestExpiry(rules []db_service.BlockedDomainInfo) int64 {
+	var soonest int64
+	for _, rule := range rules {
+		if rule.ExpiresAt != 0 && (soonest == 0 || rule.ExpiresAt < soonest) {
+			soonest = rule.ExpiresAt
+		}
+	}
+	return soonest
+}
+
+// invalidatePAC drops the cached PAC script so the next request rebuilds it
+func (p *ProxyService) invalidatePAC() {
+	p.pacMu.Lock()
+	p.pacScript = ""
+	p.pacMu.Unlock()
+}
+
+// generatePAC builds a proxy auto-config script that sends hosts matching a
+// block or log-only rule through proxyAddr. Hosts without a rule go DIRECT,
+// unless proxyUnknown is set because the proxy has to decide them (default
+// deny, learning or ask mode); then only hosts with an allow rule go DIRECT.
+func generatePAC(rules []db_service.BlockedDomainInfo, proxyAddr string, proxyUnknown bool) string {
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("\thost = host.toLowerCase();\n")
+
+	proxy := "PROXY " + proxyAddr
+	// Blocks win over allow rules, so they are tested first
+	for _, rule := range rules {
+		if rule.Action != db_service.ActionAllow {
+			writePACRule(&b, rule, proxy)
+		}
+	}
+	if proxyUnknown {
+		for _, rule := range rules {
+			// The PAC cannot tell the application or port a rule is limited to
+			if rule.Action == db_service.ActionAllow && rule.App == "" && rule.Ports == "" {
+				writePACRule(&b, rule, "DIRECT")
+			}
+		}
+		fmt.Fprintf(&b, "\treturn %q;\n", proxy)
+	} else {
+		b.WriteString("\treturn \"DIRECT\";\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// writePACRule writes a PAC condition returning result for hosts matching rule
+func writePACRule(b *strings.Builder, rule db_service.BlockedDomainInfo, result string) {
+	pattern := jsString(rule.Domain)
+	switch rule.FilterType {
+	case "exact":
+		fmt.Fprintf(b, "\tif (host === %s) return %q;\n", pattern, result)
+	case "glob":
+		fmt.Fprintf(b, "\tif (shExpMatch(host, %s)) return %q;\n", pattern, result)
+	case "regex":
+		source, flags, ok := jsRegex(rule.Domain)
+		if !ok {
+			log.Printf("Leaving regex rule %q out of the PAC: no JavaScript equivalent", rule.Domain)
+			return
+		}
+		// A pattern the browser still rejects only skips its own rule
+		fmt.Fprintf(b, "\ttry { if (new RegExp(%s, %q).test(host)) return %q; } catch (e) {}\n", jsString(source), flags, result)
+	case "ip":
+		fmt.Fprintf(b, "\tif (host === %s) return %q;\n", pattern, result)
+	case "cidr":
+		// isInNet resolves hostnames, so only test IPv4 literals
+		_, network, err := net.ParseCIDR(rule.Domain)
+		if err != nil || network.IP.To4() == nil {
+			return
+		}
+		fmt.Fprintf(b, "\tif (/^\\d+\\.\\d+\\.\\d+\\.\\d+$/.test(host) && isInNet(host, %q, %q)) return %q;\n",
+			network.IP.String(), net.IP(network.Mask).String(), result)
+	}
+}
+
+// jsRegex translates a Go regular expression into the source and flags of a
+// JavaScript RegExp. Leading flag groups, \A, \z and (?P<name> groups are
+// rewritten; other RE2-only syntax, such as inline flag groups, POSIX
+// classes, \p and \Q, has no JavaScript equivalent and is reported as not ok.
+func jsRegex(pattern string) (source, flags string, ok bool) {
+	if _, err := regexp.Compile(pattern); err != nil {
+		return "", "", false
+	}
+	if m := leadingRegexFlags.FindStringSubmatch(pattern); m != nil {
+		flags = m[1]
+		pattern = pattern[len(m[0]):]
+	}
+
+	var b strings.Builder
+	inClass := false
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			switch next := pattern[i]; {
+			case next == 'A' && !inClass:
+				b.WriteByte('^')
+			case next == 'z' && !inClass:
+				b.WriteByte('$')
+			case strings.IndexByte("QECpP", next) >= 0,
+				next == 'x' && strings.HasPrefix(pattern[i+1:], "{"):
+				return "", "", false
+			default:
+				b.WriteByte('\\')
+				b.WriteByte(next)
+			}
+		case inClass:
+			if strings.HasPrefix(pattern[i:], "[:") {
+				return "", "", false
+			}
+			if c == ']' {
+				inClass = false
+			}
+			b.WriteByte(c)
+		case c == '[':
+			inClass = true
+			b.WriteByte(c)
+			if strings.HasPrefix(pattern[i+1:], "^") {
+				b.WriteByte('^')
+				i++
+			}
+			// A leading ] is literal in Go but closes an empty class in JavaScript
+			if strings.HasPrefix(pattern[i+1:], "]") {
+				b.WriteString("\\]")
+				i++
+			}
+		case strings.HasPrefix(pattern[i:], "(?P<"):
+			b.WriteString("(?<")
+			i += 3
+		case strings.HasPrefix(pattern[i:], "(?") && !strings.HasPrefix(pattern[i:], "(?:") && !strings.HasPrefix(pattern[i:], "(?<"):
+			return "", "", false
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), flags, true
+}
+
+// leadingRegexFlags matches a flag group at the start of a Go regular
+// expression whose flags JavaScript supports as RegExp flags
+var leadingRegexFlags = regexp.MustCompile(`^\(\?([ims]+)\)`)
+
+// jsString quotes s as a JavaScript string literal
+func jsString(s string) string {
+	encoded, _ := json.Marshal(s)
+	return string(encoded)
+}
+
+// setMacAutoProxy points all network services on macOS at the given PAC URL
+// and disables the static web proxies.
+func setMacAutoProxy(pacURL string) error {
+	services, err := listMacNetworkServices()
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	for _, svc := range services {
+		// Set auto-config URL
+		if out, err := exec.Command("networksetup", "-setautoproxyurl", svc, pacURL).CombinedOutput(); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("setautoproxyurl failed for %q: %w; output: %s", svc, err, strings.TrimSpace(string(out)))
+			}
+		}
+		// Enable auto-config
+		if out, err := exec.Command("networksetup", "-setautoproxystate", svc, "on").CombinedOutput(); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("setautoproxystate failed for %q: %w; output: %s", svc, err, strings.TrimSpace(string(out)))
+			}
+		}
+		// Static proxies would override the PAC for every host
+		for _, flag := range []string{"-setwebproxystate", "-setsecurewebproxystate"} {
+			if out, err := exec.Command("networksetup", flag, svc, "off").CombinedOutput(); err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("%s(off) failed for %q: %w; output: %s", strings.TrimPrefix(flag, "-"), svc, err, strings.TrimSpace(string(out)))
+				}
+			}
+		}
+	}
+	return firstErr
+}
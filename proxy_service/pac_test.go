@@ -0,0 +1,167 @@
+package proxy_service
+
+import (
+	"changeme/db_service"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGeneratePAC(t *testing.T) {
+	proxy := setupTestProxy(t)
+	proxy.DbService.BlockDomainWithType("exact.com", "exact")
+	proxy.DbService.BlockDomainWithType("*.glob.com", "glob")
+	proxy.DbService.BlockDomainWithType(`^ads\d+\.example\.com$`, "regex")
+	proxy.DbService.BlockDomainWithType("10.1.2.3", "ip")
+	proxy.DbService.BlockDomainWithType("192.168.0.0/16", "cidr")
+
+	pac := generatePAC(proxy.DbService.ListBlockedDomainsWithInfo(), "127.0.0.1:30002", false)
+
+	expected := []string{
+		`if (host === "exact.com") return "PROXY 127.0.0.1:30002";`,
+		`if (shExpMatch(host, "*.glob.com")) return "PROXY 127.0.0.1:30002";`,
+		`try { if (new RegExp("^ads\\d+\\.example\\.com$", "").test(host)) return "PROXY 127.0.0.1:30002"; } catch (e) {}`,
+		`if (host === "10.1.2.3") return "PROXY 127.0.0.1:30002";`,
+		`isInNet(host, "192.168.0.0", "255.255.0.0")) return "PROXY 127.0.0.1:30002";`,
+		`return "DIRECT";`,
+	}
+	for _, want := range expected {
+		if !strings.Contains(pac, want) {
+			t.Errorf("PAC script missing %q:\n%s", want, pac)
+		}
+	}
+}
+
+func TestJSRegex(t *testing.T) {
+	tests := []struct {
+		in, source, flags string
+		ok                bool
+	}{
+		{`^ads\d+\.example\.com$`, `^ads\d+\.example\.com$`, "", true},
+		{`(?i)\Atracker\.`, `^tracker\.`, "i", true},
+		{`\.example\.com\z`, `\.example\.com$`, "", true},
+		{`^(?P<sub>\w+)\.test$`, `^(?<sub>\w+)\.test$`, "", true},
+		{`[]a]\.test`, `[\]a]\.test`, "", true},
+		{`^[\d.]+$`, `^[\d.]+$`, "", true},
+		{`^a(?i:b)`, "", "", false},
+		{`(?U)a+`, "", "", false},
+		{`[[:digit:]]+`, "", "", false},
+		{`\pL+`, "", "", false},
+		{`\Qa.b\E`, "", "", false},
+		{`(`, "", "", false},
+	}
+	for _, tt := range tests {
+		source, flags, ok := jsRegex(tt.in)
+		if source != tt.source || flags != tt.flags || ok != tt.ok {
+			t.Errorf("jsRegex(%q) = %q, %q, %v; want %q, %q, %v", tt.in, source, flags, ok, tt.source, tt.flags, tt.ok)
+		}
+	}
+}
+
+func TestPACFile_DefaultDenyProxiesUnknownHosts(t *testing.T) {
+	proxy := setupTestProxy(t)
+	proxy.DbService.SaveRule(db_service.BlockedDomainInfo{Domain: "allowed.com", FilterType: "exact", Action: db_service.ActionAllow})
+	proxy.DbService.SaveRule(db_service.BlockedDomainInfo{Domain: "app.com", FilterType: "exact", Action: db_service.ActionAllow, App: "curl"})
+	proxy.DbService.BlockDomain("blocked.com")
+
+	if pac := proxy.pacFile(); !strings.HasSuffix(pac, "\treturn \"DIRECT\";\n}\n") || strings.Contains(pac, "allowed.com") {
+		t.Fatalf("expected unknown hosts to go DIRECT by default:\n%s", pac)
+	}
+
+	proxy.DbService.SetPolicy(db_service.Policy{DefaultAction: db_service.ActionBlock})
+	pac := proxy.pacFile()
+	for _, want := range []string{
+		`if (host === "blocked.com") return "PROXY 127.0.0.1:30002";`,
+		`if (host === "allowed.com") return "DIRECT";`,
+		"\treturn \"PROXY 127.0.0.1:30002\";\n}",
+	} {
+		if !strings.Contains(pac, want) {
+			t.Errorf("PAC script missing %q:\n%s", want, pac)
+		}
+	}
+	if strings.Contains(pac, "app.com") {
+		t.Errorf("app-scoped allow rules must not go DIRECT:\n%s", pac)
+	}
+	if strings.Index(pac, "blocked.com") > strings.Index(pac, "allowed.com") {
+		t.Errorf("block rules must be tested before allow rules:\n%s", pac)
+	}
+
+	// Ask mode has the proxy decide unknown hosts as well
+	proxy.DbService.SetPolicy(db_service.Policy{DefaultAction: db_service.ActionAllow})
+	proxy.SetAskSettings(AskSettings{Enabled: true, TimeoutSeconds: 30, DefaultAction: db_service.ActionBlock})
+	if pac := proxy.pacFile(); !strings.Contains(pac, "\treturn \"PROXY 127.0.0.1:30002\";\n}") {
+		t.Fatalf("expected unknown hosts to be proxied in ask mode:\n%s", pac)
+	}
+}
+
+func TestServeNonProxy_RegeneratesOnRuleChange(t *testing.T) {
+	proxy := setupTestProxy(t)
+	proxy.DbService.OnRulesChanged(proxy.invalidatePAC)
+
+	fetch := func() string {
+		rec := httptest.NewRecorder()
+		proxy.serveNonProxy(rec, httptest.NewRequest(http.MethodGet, PAC_PATH, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/x-ns-proxy-autoconfig" {
+			t.Fatalf("unexpected content type %q", ct)
+		}
+		body, _ := io.ReadAll(rec.Body)
+		return string(body)
+	}
+
+	if strings.Contains(fetch(), "example.com") {
+		t.Fatal("PAC should not reference unblocked domains")
+	}
+
+	proxy.DbService.BlockDomain("example.com")
+	if !strings.Contains(fetch(), `"example.com"`) {
+		t.Fatal("PAC should be regenerated after blocking a domain")
+	}
+
+	proxy.DbService.UnblockDomain("example.com")
+	if strings.Contains(fetch(), "example.com") {
+		t.Fatal("PAC should be regenerated after unblocking a domain")
+	}
+
+	rec := httptest.NewRecorder()
+	proxy.serveNonProxy(rec, httptest.NewRequest(http.MethodGet, "/other", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500 for non-PAC path, got %d", rec.Code)
+	}
+}
+
+func TestPACFile_DropsExpiredTemporaryRules(t *testing.T) {
+	proxy := setupTestProxy(t)
+	proxy.DbService.OnRulesChanged(proxy.invalidatePAC)
+	expires := time.Now().Add(200 * time.Millisecond).UnixMilli()
+	proxy.DbService.SaveRule(db_service.BlockedDomainInfo{Domain: "temp.example", FilterType: "exact", Action: db_service.ActionBlock, ExpiresAt: expires})
+	proxy.DbService.BlockDomain("kept.example")
+
+	if pac := proxy.pacFile(); !strings.Contains(pac, `"temp.example"`) {
+		t.Fatalf("expected the temporary rule in the PAC:\n%s", pac)
+	}
+	// Nothing changes the rules when a temporary one runs out
+	time.Sleep(time.Until(time.UnixMilli(expires)) + 10*time.Millisecond)
+	pac := proxy.pacFile()
+	if strings.Contains(pac, "temp.example") || !strings.Contains(pac, `"kept.example"`) {
+		t.Fatalf("expected the PAC to be rebuilt without the expired rule:\n%s", pac)
+	}
+}
+
+func TestSystemProxySettings(t *testing.T) {
+	proxy := setupTestProxy(t)
+	if proxy.GetSystemProxySettings().UsePAC {
+		t.Fatal("expected static proxies by default")
+	}
+	if err := proxy.SetSystemProxySettings(SystemProxySettings{UsePAC: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !proxy.GetSystemProxySettings().UsePAC || !proxy.UsePAC {
+		t.Fatal("expected the auto-config setting to be saved and applied")
+	}
+}
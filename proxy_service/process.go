@@ -0,0 +1,117 @@
+package proxy_service
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultProcRoot is where procfs is mounted on Linux
+const defaultProcRoot = "/proc"
+
+const (
+	// processLookupTimeout bounds the procfs walk for one connection; the
+	// connection goes on as from an unknown process when it runs out
+	processLookupTimeout = 100 * time.Millisecond
+	// processCacheTTL is how long the owner of a socket is remembered, for
+	// keep-alive connections that send many requests over one socket
+	processCacheTTL = 10 * time.Second
+)
+
+// processInfo identifies the local program that opened a connection
+type processInfo struct {
+	PID  int
+	Name string // short name, e.g. "curl"
+	Path string // executable path, e.g. "/usr/bin/curl"
+}
+
+// processCache remembers socket owners by socket inode
+type processCache struct {
+	mu     sync.Mutex
+	owners map[string]cachedProcess
+}
+
+type cachedProcess struct {
+	info processInfo
+	at   time.Time
+}
+
+// get returns the remembered owner of the socket inode
+func (c *processCache) get(inode string) (processInfo, bool) {
+	if c == nil {
+		return processInfo{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.owners[inode]
+	if !ok || time.Since(cached.at) >= processCacheTTL {
+		return processInfo{}, false
+	}
+	return cached.info, true
+}
+
+// put remembers the owner of the socket inode and forgets stale owners
+func (c *processCache) put(inode string, info processInfo) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if c.owners == nil {
+		c.owners = make(map[string]cachedProcess)
+	}
+	for key, cached := range c.owners {
+		if now.Sub(cached.at) >= processCacheTTL {
+			delete(c.owners, key)
+		}
+	}
+	c.owners[inode] = cachedProcess{info: info, at: now}
+}
+
+// needsProcess reports whether connections are worth attributing to their
+// process: the request log records it, ask mode shows it in the prompt, and
+// app-scoped rules match on it.
+func (p *ProxyService) needsProcess() bool {
+	return p.logger() != nil || p.GetAskSettings().Enabled || p.db().HasAppRules()
+}
+
+// lookupProcess returns the local process owning the client end of the
+// connection from client to server (the proxy's listening address). Only
+// loopback clients are looked up, and only when needsProcess; the zero
+// value means unknown.
+func (p *ProxyService) lookupProcess(client, server net.Addr) processInfo {
+	c, ok := client.(*net.TCPAddr)
+	if !ok || c == nil || !c.IP.IsLoopback() {
+		return processInfo{}
+	}
+	s, ok := server.(*net.TCPAddr)
+	if !ok || s == nil {
+		return processInfo{}
+	}
+
+	if !p.needsProcess() {
+		return processInfo{}
+	}
+
+	root := p.procRoot
+	if root == "" {
+		root = defaultProcRoot
+	}
+	info, err := findProcess(root, c, s, &p.processes, time.Now().Add(processLookupTimeout))
+	if err != nil {
+		return processInfo{}
+	}
+	return info
+}
+
+// requestProcess looks up the process that sent the proxy request r
+func (p *ProxyService) requestProcess(r *http.Request) processInfo {
+	client, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return processInfo{}
+	}
+	server, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return p.lookupProcess(client, server)
+}
@@ -0,0 +1,131 @@
+//go:build linux
+
+package proxy_service
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// findProcess maps the socket with the given local and remote address to
+// its owner: the socket inode comes from /proc/net/tcp{,6}, and the process
+// is the one holding that inode among its file descriptors. Owners are
+// remembered in cache, and the search gives up once deadline passes.
+func findProcess(root string, local, remote *net.TCPAddr, cache *processCache, deadline time.Time) (processInfo, error) {
+	inode, err := findSocketInode(root, local, remote)
+	if err != nil {
+		return processInfo{}, err
+	}
+	if info, ok := cache.get(inode); ok {
+		return info, nil
+	}
+	pid, err := findSocketOwner(root, inode, deadline)
+	if err != nil {
+		return processInfo{}, err
+	}
+
+	info := processInfo{PID: pid}
+	dir := filepath.Join(root, strconv.Itoa(pid))
+	info.Path, _ = os.Readlink(filepath.Join(dir, "exe"))
+	if comm, err := os.ReadFile(filepath.Join(dir, "comm")); err == nil {
+		info.Name = strings.TrimSpace(string(comm))
+	}
+	if info.Name == "" && info.Path != "" {
+		info.Name = filepath.Base(info.Path)
+	}
+	cache.put(inode, info)
+	return info, nil
+}
+
+// findSocketInode searches the TCP tables for the socket local -> remote
+func findSocketInode(root string, local, remote *net.TCPAddr) (string, error) {
+	for _, table := range []string{"tcp", "tcp6"} {
+		f, err := os.Open(filepath.Join(root, "net", table))
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // header
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 {
+				continue
+			}
+			l, err := parseProcAddr(fields[1])
+			if err != nil || !sameAddr(l, local) {
+				continue
+			}
+			r, err := parseProcAddr(fields[2])
+			if err != nil || !sameAddr(r, remote) {
+				continue
+			}
+			f.Close()
+			return fields[9], nil
+		}
+		f.Close()
+	}
+	return "", fmt.Errorf("no socket for %s -> %s", local, remote)
+}
+
+// findSocketOwner returns the pid holding a descriptor for the socket inode
+func findSocketOwner(root, inode string, deadline time.Time) (int, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return 0, err
+	}
+	target := "socket:[" + inode + "]"
+	for _, entry := range entries {
+		if time.Now().After(deadline) {
+			return 0, fmt.Errorf("timed out looking for the owner of socket %s", inode)
+		}
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join(root, entry.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			// Other users' processes are not readable
+			continue
+		}
+		for _, fd := range fds {
+			if link, err := os.Readlink(filepath.Join(fdDir, fd.Name())); err == nil && link == target {
+				return pid, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no process owns socket %s", inode)
+}
+
+// parseProcAddr decodes an address such as "0100007F:1F90". The IP is
+// printed as 32-bit words in host (little-endian) byte order.
+func parseProcAddr(s string) (*net.TCPAddr, error) {
+	ipHex, portHex, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	ip, err := hex.DecodeString(ipHex)
+	if err != nil || (len(ip) != net.IPv4len && len(ip) != net.IPv6len) {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	for i := 0; i < len(ip); i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = ip[i+3], ip[i+2], ip[i+1], ip[i]
+	}
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	return &net.TCPAddr{IP: net.IP(ip), Port: int(port)}, nil
+}
+
+// sameAddr compares addresses, treating IPv4 and IPv4-mapped IPv6 as equal
+func sameAddr(a, b *net.TCPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
@@ -0,0 +1,183 @@
+package proxy_service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFindProcess_FakeProcfs(t *testing.T) {
+	root := t.TempDir()
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 48271}
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: PROXY_PORT}
+	writeFakeProc(t, root, local, remote, 4242, "/usr/bin/curl", "curl")
+
+	info, err := findProcess(root, local, remote, nil, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("findProcess failed: %v", err)
+	}
+	if info.PID != 4242 || info.Name != "curl" || info.Path != "/usr/bin/curl" {
+		t.Fatalf("unexpected process: %+v", info)
+	}
+
+	// The proxy's own end of the connection has the addresses swapped
+	if _, err := findProcess(root, remote, local, nil, time.Now().Add(time.Second)); err == nil {
+		t.Fatal("expected no process for the reversed connection")
+	}
+
+	if _, err := findProcess(root, local, remote, nil, time.Now()); err == nil {
+		t.Fatal("expected the lookup to give up after its deadline")
+	}
+}
+
+func TestFindProcess_RemembersOwners(t *testing.T) {
+	root := t.TempDir()
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 48271}
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: PROXY_PORT}
+	writeFakeProc(t, root, local, remote, 4242, "/usr/bin/curl", "curl")
+
+	var cache processCache
+	if _, err := findProcess(root, local, remote, &cache, time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("findProcess failed: %v", err)
+	}
+	// Later requests on the same socket skip the walk over the processes
+	if err := os.RemoveAll(filepath.Join(root, "4242")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := findProcess(root, local, remote, &cache, time.Now())
+	if err != nil || info.Name != "curl" {
+		t.Fatalf("expected the remembered owner, got %+v, %v", info, err)
+	}
+}
+
+func TestLookupProcess_OnlyWhenNeeded(t *testing.T) {
+	proxy := setupTestProxy(t)
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 48271}
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: PROXY_PORT}
+	writeFakeProc(t, proxy.procRoot, local, remote, 4242, "/usr/bin/curl", "curl")
+
+	// Nothing logs, asks or matches on the process
+	if info := proxy.lookupProcess(local, remote); info.PID != 0 {
+		t.Fatalf("expected no lookup without a use for it, got %+v", info)
+	}
+	proxy.DbService.BlockDomainForApp("example.com", "exact", "firefox")
+	if info := proxy.lookupProcess(local, remote); info.PID != 4242 {
+		t.Fatalf("expected app rules to need the process, got %+v", info)
+	}
+}
+
+func TestParseProcAddr_IPv6(t *testing.T) {
+	addr, err := parseProcAddr("00000000000000000000000001000000:1F90")
+	if err != nil {
+		t.Fatalf("parseProcAddr failed: %v", err)
+	}
+	if !addr.IP.Equal(net.IPv6loopback) || addr.Port != 8080 {
+		t.Fatalf("expected [::1]:8080, got %v", addr)
+	}
+
+	// IPv4-mapped addresses in tcp6 match plain IPv4 ones
+	mapped, err := parseProcAddr("0000000000000000FFFF00000100007F:0050")
+	if err != nil {
+		t.Fatalf("parseProcAddr failed: %v", err)
+	}
+	if !sameAddr(mapped, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80}) {
+		t.Fatalf("expected 127.0.0.1:80, got %v", mapped)
+	}
+}
+
+func TestSocks_AppScopedRule(t *testing.T) {
+	proxy := setupTestProxy(t)
+	proxy.DbService.BlockDomainForApp("localhost", "exact", "curl")
+	socksAddr := startTestSocks(t, proxy)
+
+	conn, err := net.Dial("tcp", socksAddr)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	writeFakeProc(t, proxy.procRoot, conn.LocalAddr().(*net.TCPAddr), conn.RemoteAddr().(*net.TCPAddr), 4242, "/usr/bin/curl", "curl")
+
+	socksConnect(t, conn, "localhost", 443)
+	if reply := readSocksReply(t, conn); reply != socksReplyNotAllowed {
+		t.Fatalf("expected the app rule to block curl, got reply %d", reply)
+	}
+
+	// Without a matching process the rule does not apply
+	echoAddr := startEchoServer(t)
+	other := socksDial(t, socksAddr, "localhost", echoAddr.Port)
+	defer other.Close()
+	if reply := readSocksReply(t, other); reply != socksReplySucceeded {
+		t.Fatalf("expected other processes to be allowed, got reply %d", reply)
+	}
+}
+
+func TestHTTP_ActiveConnectionHasProcess(t *testing.T) {
+	proxy := setupTestProxy(t)
+	proxy.DbService.BlockDomainForApp("blocked.example", "exact", "curl")
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 48271}
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: PROXY_PORT}
+	writeFakeProc(t, proxy.procRoot, local, remote, 4242, "/usr/bin/curl", "curl")
+
+	var active []ActiveConnection
+	handler := proxy.trackHTTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		active = proxy.ListActiveConnections()
+	}))
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = local.String()
+	req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, remote))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(active) != 1 || active[0].ProcessName != "curl" || active[0].ProcessPath != "/usr/bin/curl" {
+		t.Fatalf("expected the request to be listed with its process, got %+v", active)
+	}
+}
+
+// writeFakeProc creates a procfs tree in which pid owns the socket local -> remote
+func writeFakeProc(t *testing.T, root string, local, remote *net.TCPAddr, pid int, exe, comm string) {
+	const inode = 98765
+	table := "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n" +
+		fmt.Sprintf("   0: %s %s 01 00000000:00000000 00:00000000 00000000  1000        0 %d 1 0000000000000000 20 4 30 10 -1\n",
+			procAddr(remote), procAddr(local), inode+1) +
+		fmt.Sprintf("   1: %s %s 01 00000000:00000000 00:00000000 00000000  1000        0 %d 1 0000000000000000 20 4 30 10 -1\n",
+			procAddr(local), procAddr(remote), inode)
+
+	pidDir := filepath.Join(root, fmt.Sprint(pid))
+	for _, dir := range []string{filepath.Join(root, "net"), filepath.Join(pidDir, "fd"), filepath.Join(root, "1", "fd")} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		filepath.Join(root, "net", "tcp"):  table,
+		filepath.Join(root, "net", "tcp6"): "  sl  local_address remote_address st\n",
+		filepath.Join(pidDir, "comm"):      comm + "\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		filepath.Join(root, "1", "fd", "0"): "/dev/null",
+		filepath.Join(pidDir, "fd", "0"):    "/dev/null",
+		filepath.Join(pidDir, "fd", "7"):    fmt.Sprintf("socket:[%d]", inode),
+		filepath.Join(pidDir, "exe"):        exe,
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// procAddr formats an IPv4 address the way /proc/net/tcp does
+func procAddr(a *net.TCPAddr) string {
+	ip := a.IP.To4()
+	return fmt.Sprintf("%02X%02X%02X%02X:%04X", ip[3], ip[2], ip[1], ip[0], a.Port)
+}
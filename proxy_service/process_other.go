@@ -0,0 +1,14 @@
+//go:build !linux
+
+package proxy_service
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// findProcess is only implemented on Linux
+func findProcess(root string, local, remote *net.TCPAddr, cache *processCache, deadline time.Time) (processInfo, error) {
+	return processInfo{}, errors.New("process lookup not supported on this platform")
+}
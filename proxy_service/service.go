@@ -4,6 +4,7 @@ import (
 	"changeme/db_service"
 	"changeme/logging_service"
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -12,6 +13,8 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/elazarl/goproxy"
@@ -26,9 +29,74 @@ const PROXY_PORT = 30002
 // Changing the name of this struct will change the name of the services class in the frontend
 // Bound methods will exist inside frontend/bindings/github.com/user/proxy_service under the name of the struct
 type ProxyService struct {
-	ctx      context.Context
-	options  application.ServiceOptions
-	IsPaused bool
+	ctx     context.Context
+	options application.ServiceOptions
+
+	// StartPaused lets all traffic through from startup until ResumeProxy
+	// is called; the system proxy settings are left untouched.
+	StartPaused bool
+	// paused is read by every connection while PauseProxy and ResumeProxy
+	// flip it from the tray or the control socket
+	paused atomic.Bool
+
+	// Headless leaves the system proxy settings alone on shutdown unless
+	// ResumeProxy applied them, since the proxy may run next to a GUI
+	// instance or a proxy configured by hand.
+	Headless bool
+	// systemProxySet records that ResumeProxy pointed the system at the proxy
+	systemProxySet atomic.Bool
+
+	// UsePAC makes ResumeProxy point the system at the generated proxy.pac
+	// instead of routing all web traffic through the proxy. It is loaded from
+	// the saved SystemProxySettings on startup unless already set.
+	UsePAC bool
+
+	// EnableSocks starts a SOCKS5 listener on SocksAddr next to the HTTP proxy.
+	EnableSocks bool
+	// SocksAddr is the address the SOCKS5 listener binds to; empty means
+	// 127.0.0.1:SOCKS_PORT. Set it to reach SOCKS5 from other machines.
+	SocksAddr string
+
+	// DbService and LoggingService are used for policy decisions and request
+	// logging. When nil, the package singletons are used instead.
+	DbService      *db_service.DatabaseService
+	LoggingService *logging_service.LoggingService
+
+	server        *http.Server
+	socksListener net.Listener
+
+	pacMu           sync.Mutex
+	pacScript       string
+	pacProxyUnknown bool  // whether pacScript sends hosts without a rule to the proxy
+	pacExpires      int64 // when the first temporary rule in pacScript expires; 0 if none
+
+	pauseMu        sync.Mutex
+	pauseListeners []func(bool)
+
+	// procRoot is the procfs mount used to attribute connections to
+	// processes; empty means /proc. Tests point it at a fake tree.
+	procRoot  string
+	processes processCache
+
+	// pending holds the connections waiting for an answer in ask mode
+	askMu          sync.Mutex
+	pending        map[int64]*pendingDecision
+	nextDecisionID int64
+
+	// emitEvent sends events to the frontend; nil uses the running application
+	emitEvent func(name string, data any)
+
+	// conns holds the open tunnels and in-flight HTTP requests by id
+	connMu     sync.Mutex
+	conns      map[int64]*activeConn
+	nextConnID int64
+
+	// recheckTimer runs closeBlockedConnections once the rules settle
+	recheckMu    sync.Mutex
+	recheckTimer *time.Timer
+
+	// authLimit refuses clients that failed to log in too often
+	authLimit authLimiter
 }
 
 // singleton instance for easy access from other services
@@ -36,41 +104,273 @@ var instance *ProxyService
 
 func Instance() *ProxyService { return instance }
 
-func (p *ProxyService) StartProxy() {
-	proxy := goproxy.NewProxyHttpServer()
+// db returns the DatabaseService used for policy decisions
+func (p *ProxyService) db() *db_service.DatabaseService {
+	if p.DbService != nil {
+		return p.DbService
+	}
+	return db_service.Instance()
+}
 
-	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
-		if p.IsPaused {
-			log.Printf("Proxy is paused, but still serving request for host: %s", host)
-			return goproxy.OkConnect, host
+// logger returns the LoggingService used to record requests
+func (p *ProxyService) logger() *logging_service.LoggingService {
+	if p.LoggingService != nil {
+		return p.LoggingService
+	}
+	return logging_service.Instance()
+}
+
+// allowConnect decides whether a tunnel to host:port may be opened. It is
+// shared by the HTTP CONNECT handler and the SOCKS5 server so every protocol
+// gets the same policy. Rejections are logged right away and nil is returned;
+// approved requests get a tunnel that is logged once it closes. proc is the
+// local process that asked for the tunnel, used by app-scoped rules, and
+// user the authenticated proxy user, if any.
+func (p *ProxyService) allowConnect(host string, port int, method string, proc processInfo, user string) *tunnel {
+	start := time.Now()
+	if p.IsPaused() {
+		log.Printf("Proxy is paused, but still serving request for host: %s", host)
+		connectRequests.Inc(method, "paused")
+		return &tunnel{host: host, port: port, method: method, process: proc, user: user, start: start}
+	}
+
+	v := p.evaluate(host, port, method, proc, p.db().GetPolicy())
+	matchDuration.Observe(time.Since(start).Seconds())
+	if v.logRule.Domain != "" {
+		ruleMatches.Inc(v.logRule.FilterType)
+	}
+	if v.reason == logging_service.ReasonRule {
+		ruleMatches.Inc(v.rule.FilterType)
+	}
+
+	rule, blocked, reason := v.rule, v.blocked, v.reason
+	if v.unknown {
+		blocked, reason = p.decideUnknown(host, port, method, proc)
+	}
+	// A log-only rule only marks connections that are let through
+	wouldReject := !blocked && v.logRule.Domain != ""
+
+	if blocked {
+		connectRequests.Inc(method, "rejected")
+		if reason == logging_service.ReasonPort {
+			log.Printf("%s request for host: %s, port: %d, blocked: port %d is not in the allowed ports of the policy", method, host, port, port)
+		} else {
+			log.Printf("%s request for host: %s, port: %d, blocked: %v (%s)", method, host, port, blocked, reason)
 		}
+		go p.logger().LogEntry(logging_service.LogRequest{
+			Timestamp: start.UnixMilli(),
+			Host:      host,
+			Method:    method,
+			Port:      port,
+			Approved:  false,
+			Duration:  time.Since(start).Nanoseconds(),
+			Rule:      rule.Domain,
+			Reason:    reason,
+
+			ProcessName: proc.Name,
+			ProcessPath: proc.Path,
+			User:        user,
+		})
+		return nil
+	}
+	if wouldReject {
+		connectRequests.Inc(method, "would_reject")
+		log.Printf("%s request for host: %s, port: %d, would be blocked by log-only rule %s", method, host, port, v.logRule.Domain)
+		rule = v.logRule
+	} else {
+		connectRequests.Inc(method, "approved")
+	}
+	return &tunnel{
+		host:        host,
+		port:        port,
+		method:      method,
+		rule:        rule.Domain,
+		process:     proc,
+		user:        user,
+		start:       start,
+		decision:    time.Since(start),
+		wouldReject: wouldReject,
+		logged:      true,
+	}
+}
+
+// verdict is what the rules and the port policy say about a connection,
+// before the learning period and ask mode get involved
+type verdict struct {
+	rule    db_service.BlockedDomainInfo // the block or allow rule deciding it, if any
+	logRule db_service.BlockedDomainInfo // the log-only rule marking it, if any
+	blocked bool
+	reason  string // why it is blocked
+	// unknown is set when no rule decides the connection, so decideUnknown must
+	unknown bool
+}
+
+// evaluate checks a method connection to host:port from proc against the
+// rules and the port policy. It has no side effects, so open connections can be
+// checked again after the rules change.
+func (p *ProxyService) evaluate(host string, port int, method string, proc processInfo, policy db_service.Policy) verdict {
+	var v verdict
+	target := p.ruleTarget(host, port, proc, policy)
+	rule, found := p.db().FindRule(target)
+	// A log-only rule only marks the connection; the other rules and the
+	// policy still decide it
+	if found && rule.Action == db_service.ActionLog {
+		v.logRule = rule
+		target.SkipLogOnly = true
+		rule, found = p.db().FindRule(target)
+	}
+	switch {
+	case found && rule.Action == db_service.ActionBlock:
+		v.rule, v.blocked, v.reason = rule, true, logging_service.ReasonRule
+	// Ports outside the policy are refused unless an allow rule names them
+	case !portAllowed(policy, method, port) && !(found && rule.Action == db_service.ActionAllow && rule.Ports != ""):
+		v.blocked, v.reason = true, logging_service.ReasonPort
+	case found:
+		v.rule = rule
+	default:
+		v.unknown = true
+	}
+	return v
+}
 
-		start := time.Now()
-		port := 443
-		i := strings.LastIndex(host, ":")
-		if i != -1 {
-			if pnum, err := strconv.Atoi(host[i+1:]); err == nil {
-				port = pnum
+// portAllowed applies the port policy of the protocol a tunnel came in on
+func portAllowed(policy db_service.Policy, method string, port int) bool {
+	if method == socksMethod {
+		return policy.SocksPortAllowed(port)
+	}
+	return policy.PortAllowed(port)
+}
+
+// ruleTarget describes a connection to host:port from proc for rule evaluation.
+// Hostnames are resolved for ip and cidr rules when the policy asks for it.
+func (p *ProxyService) ruleTarget(host string, port int, proc processInfo, policy db_service.Policy) db_service.MatchTarget {
+	target := db_service.MatchTarget{
+		Domain:      strings.ToLower(host),
+		Port:        port,
+		ProcessName: proc.Name,
+		ProcessPath: proc.Path,
+	}
+	if policy.MatchResolvedIPs {
+		// Looked up once even when the rules are searched twice
+		var ips []net.IP
+		resolved := false
+		target.Resolve = func() []net.IP {
+			if !resolved {
+				ips, resolved = resolveHost(host), true
 			}
+			return ips
 		}
+	}
+	return target
+}
 
-		modifiedHost := host[:i]
+// resolveHost looks up the addresses of host, or returns nil when that fails
+func resolveHost(host string) []net.IP {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		log.Printf("Resolving %s for IP rules failed: %v", host, err)
+		return nil
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips
+}
 
-		blocked := db_service.Instance().IsDomainBlocked(strings.ToLower(modifiedHost))
+// splitHostPort splits a CONNECT target into host and port. IPv6 literals
+// are returned without brackets and a missing port means defaultPort.
+func splitHostPort(hostport string, defaultPort int) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		// No port: a hostname, an IPv4 literal or a (bracketed) IPv6 literal
+		if ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]")); ip != nil {
+			return ip.String(), defaultPort, nil
+		}
+		if hostport == "" || strings.ContainsAny(hostport, ":[]") {
+			return "", 0, fmt.Errorf("invalid host %q: %w", hostport, err)
+		}
+		return hostport, defaultPort, nil
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port in %q", hostport)
+	}
+	if host == "" {
+		return "", 0, fmt.Errorf("missing host in %q", hostport)
+	}
+	return host, port, nil
+}
 
-		if blocked {
-			log.Printf("CONNECT request for host: %s, port: %d, blocked: %v", modifiedHost, port, blocked)
-			go logging_service.Instance().LogRequest(modifiedHost, "CONNECT", "", port, false, time.Since(start).Nanoseconds())
-			return goproxy.RejectConnect, host
+// decideUnknown decides a host no rule matched and reports whether it is
+// blocked, and why. The learning period comes first, then ask mode lets the
+// user decide while the client waits, and otherwise the policy's default applies.
+func (p *ProxyService) decideUnknown(host string, port int, method string, proc processInfo) (bool, string) {
+	if !p.db().GetPolicy().Learning() {
+		if settings := p.GetAskSettings(); settings.Enabled {
+			return !p.ask(host, port, method, proc, settings), logging_service.ReasonAsk
 		}
-		go logging_service.Instance().LogRequest(modifiedHost, "CONNECT", "", port, true, time.Since(start).Nanoseconds())
-		return goproxy.OkConnect, host
-	})
+	}
+	return p.db().ApplyPolicy(host), logging_service.ReasonPolicy
+}
+
+// filterHTTP applies the tunnel policy to plain HTTP proxy requests. Refused
+// requests get a 403 and are logged right away; approved ones are logged by
+// trackHTTP once the response has been sent.
+func (p *ProxyService) filterHTTP(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	host, port := httpTarget(req.URL)
+	c, tracked := req.Context().Value(connContextKey{}).(*activeConn)
+	var proc processInfo
+	if tracked {
+		proc = c.process
+	} else {
+		proc = p.requestProcess(req)
+	}
+	t := p.allowConnect(host, port, req.Method, proc, requestUser(req))
+	if t == nil {
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "Blocked by proxy policy\n")
+	}
+	t.dialed = time.Now()
+	if tracked {
+		c.tunnel = t
+	}
+	ctx.UserData = t
+	return req, nil
+}
+
+// finishHTTP records when the response of an approved plain HTTP request
+// arrived. Requests the network guard refused are answered with a 403 and
+// logged as rejected with ReasonPrivateNetwork.
+func (p *ProxyService) finishHTTP(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	t, ok := ctx.UserData.(*tunnel)
+	if !ok {
+		return resp
+	}
+	// goproxy runs the response handlers twice after a failed round trip
+	ctx.UserData = nil
+	if resp != nil {
+		t.firstByte.Store(time.Since(t.dialed).Nanoseconds())
+		return resp
+	}
+	if errors.Is(ctx.Error, errPrivateNetwork) {
+		t.refused = logging_service.ReasonPrivateNetwork
+		return goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusForbidden, "Destination not allowed\n")
+	}
+	return nil
+}
+
+// StartProxy starts the HTTP proxy on PROXY_PORT and returns once it accepts connections.
+func (p *ProxyService) StartProxy() error {
+	p.db().OnRulesChanged(p.invalidatePAC)
+	p.db().OnRulesChanged(p.scheduleRecheck)
 
 	// Start the proxy server asynchronously so we can proceed to set system proxy after it is ready.
+	p.server = &http.Server{Addr: fmt.Sprintf(":%d", PROXY_PORT), Handler: p.handler()}
 	errCh := make(chan error, 1)
 	go func() {
-		if err := http.ListenAndServe(fmt.Sprintf(":%d", PROXY_PORT), proxy); err != nil {
+		if err := p.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			errCh <- err
 		}
 	}()
@@ -79,11 +379,73 @@ func (p *ProxyService) StartProxy() {
 	if err := waitForPort("127.0.0.1", PROXY_PORT, 5*time.Second); err != nil {
 		select {
 		case srvErr := <-errCh:
-			log.Fatal("Proxy failed to start: ", srvErr)
+			return fmt.Errorf("proxy failed to start: %w", srvErr)
 		default:
-			log.Fatal("Proxy did not become ready in time: ", err)
+			return fmt.Errorf("proxy did not become ready in time: %w", err)
 		}
 	}
+	return nil
+}
+
+// handler builds the HTTP proxy: CONNECT tunnels, plain HTTP requests and
+// the proxy.pac script for non-proxy requests
+func (p *ProxyService) handler() http.Handler {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.NonproxyHandler = http.HandlerFunc(p.serveNonProxy)
+	// Tunnels are relayed by hand so their lifetime and traffic can be logged.
+	// ConnectDial is set by goproxy when an upstream HTTPS_PROXY is configured.
+	dial := proxy.ConnectDial
+
+	proxy.OnRequest().DoFunc(p.filterHTTP)
+	proxy.OnResponse().DoFunc(p.finishHTTP)
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		hostname, port, err := splitHostPort(host, 443)
+		if err != nil {
+			log.Printf("Rejecting CONNECT: %v", err)
+			return goproxy.RejectConnect, host
+		}
+
+		t := p.allowConnect(hostname, port, "CONNECT", p.requestProcess(ctx.Req), requestUser(ctx.Req))
+		if t == nil {
+			return goproxy.RejectConnect, host
+		}
+		// The guard cannot see the address an upstream proxy connects to
+		tunnelDial := dial
+		if tunnelDial == nil {
+			client, _ := net.ResolveTCPAddr("tcp", ctx.Req.RemoteAddr)
+			tunnelDial = p.guardFor(client).dialer(tunnelDialTimeout).Dial
+		}
+		return &goproxy.ConnectAction{
+			Action: goproxy.ConnectHijack,
+			Hijack: func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+				upstream, err := t.dial(tunnelDial)
+				if errors.Is(err, errPrivateNetwork) {
+					_, _ = client.Write([]byte("HTTP/1.0 403 Forbidden\r\n\r\n"))
+					_ = client.Close()
+					p.finishTunnel(t)
+					return
+				}
+				if err != nil {
+					log.Printf("CONNECT to %s failed: %v", host, err)
+					_, _ = client.Write([]byte("HTTP/1.0 502 Bad Gateway\r\n\r\n"))
+					_ = client.Close()
+					p.finishTunnel(t)
+					return
+				}
+				if _, err := client.Write([]byte("HTTP/1.0 200 Connection established\r\n\r\n")); err != nil {
+					_ = upstream.Close()
+					_ = client.Close()
+					p.finishTunnel(t)
+					return
+				}
+				p.relay(t, client, upstream)
+			},
+		}, host
+	})
+
+	proxy.Tr.DialContext = dialHTTP
+	guardTransport(proxy)
+	return p.authorize(p.trackHTTP(p.guardHTTP(proxy.Tr, proxy)))
 }
 
 // waitForPort attempts to connect to host:port until timeout
@@ -101,12 +463,12 @@ func waitForPort(host string, port int, timeout time.Duration) error {
 	return fmt.Errorf("timeout waiting for %s:%d", host, port)
 }
 
-// setMacSystemProxy sets HTTP and HTTPS proxy for all available network services on macOS.
-func setMacSystemProxy(port int) error {
+// listMacNetworkServices returns the names of all network services on macOS.
+func listMacNetworkServices() ([]string, error) {
 	// Get list of network services
 	out, err := exec.Command("networksetup", "-listallnetworkservices").CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("listing network services failed: %w; output: %s", err, strings.TrimSpace(string(out)))
+		return nil, fmt.Errorf("listing network services failed: %w; output: %s", err, strings.TrimSpace(string(out)))
 	}
 	lines := strings.Split(string(out), "\n")
 	services := make([]string, 0, len(lines))
@@ -127,13 +489,28 @@ func setMacSystemProxy(port int) error {
 		}
 	}
 	if len(services) == 0 {
-		return fmt.Errorf("no network services found")
+		return nil, fmt.Errorf("no network services found")
+	}
+	return services, nil
+}
+
+// setMacSystemProxy sets HTTP and HTTPS proxy for all available network services on macOS.
+func setMacSystemProxy(port int) error {
+	services, err := listMacNetworkServices()
+	if err != nil {
+		return err
 	}
 
 	host := "127.0.0.1"
 	portStr := strconv.Itoa(port)
 	var firstErr error
 	for _, svc := range services {
+		// A previously set auto-config URL would take precedence
+		if out, err := exec.Command("networksetup", "-setautoproxystate", svc, "off").CombinedOutput(); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("setautoproxystate(off) failed for %q: %w; output: %s", svc, err, strings.TrimSpace(string(out)))
+			}
+		}
 		// Set HTTP proxy
 		if out, err := exec.Command("networksetup", "-setwebproxy", svc, host, portStr).CombinedOutput(); err != nil {
 			if firstErr == nil {
@@ -176,8 +553,26 @@ func (p *ProxyService) ServiceStartup(ctx context.Context, options application.S
 		log.Printf("Proxy Service already started")
 		return nil
 	}
+	instance = p
+	p.ctx = ctx
+	p.options = options
+	if !p.UsePAC {
+		p.UsePAC = p.GetSystemProxySettings().UsePAC
+	}
+	if p.StartPaused {
+		p.paused.Store(true)
+	}
+
 	// Start the local HTTP proxy as soon as the application starts.
-	go p.StartProxy()
+	if err := p.StartProxy(); err != nil {
+		return err
+	}
+	if p.EnableSocks {
+		// The proxy keeps working without SOCKS5, so don't abort startup
+		if err := p.StartSocks(); err != nil {
+			log.Printf("SOCKS5 proxy failed to start: %v", err)
+		}
+	}
 	return nil
 }
 
@@ -185,8 +580,27 @@ func (p *ProxyService) ServiceStartup(ctx context.Context, options application.S
 // You can use this to clean up any resources you have allocated
 // OPTIONAL: This method is optional.
 func (p *ProxyService) ServiceShutdown() error {
+	// Release connections still waiting for an answer
+	p.resolveAllPending()
+	p.recheckMu.Lock()
+	if p.recheckTimer != nil {
+		p.recheckTimer.Stop()
+	}
+	p.recheckMu.Unlock()
+
+	// Stop accepting new clients before the logging service drains
+	if p.server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := p.server.Shutdown(ctx); err != nil {
+			log.Printf("Warning: proxy shutdown: %v", err)
+		}
+	}
+	if p.socksListener != nil {
+		_ = p.socksListener.Close()
+	}
 	// On macOS, revert the system proxy settings we previously applied.
-	if runtime.GOOS == "darwin" {
+	if runtime.GOOS == "darwin" && p.ownsSystemProxy() {
 		if err := unsetMacSystemProxy(); err != nil {
 			log.Printf("Warning: failed to unset macOS system proxy: %v", err)
 		} else {
@@ -204,35 +618,17 @@ func (p *ProxyService) ServiceShutdown() error {
 
 // unsetMacSystemProxy disables HTTP and HTTPS proxy for all available network services on macOS.
 func unsetMacSystemProxy() error {
-	// Get list of network services
-	out, err := exec.Command("networksetup", "-listallnetworkservices").CombinedOutput()
+	services, err := listMacNetworkServices()
 	if err != nil {
-		return fmt.Errorf("listing network services failed: %w; output: %s", err, strings.TrimSpace(string(out)))
-	}
-	lines := strings.Split(string(out), "\n")
-	services := make([]string, 0, len(lines))
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
-		// Skip header line commonly present on macOS
-		if strings.HasPrefix(line, "An asterisk (") {
-			continue
-		}
-		// Some disabled services may be prefixed with an asterisk
-		line = strings.TrimPrefix(line, "*")
-		line = strings.TrimSpace(line)
-		if line != "" {
-			services = append(services, line)
-		}
-	}
-	if len(services) == 0 {
-		return fmt.Errorf("no network services found")
+		return err
 	}
 
 	var firstErr error
 	for _, svc := range services {
+		// Disable proxy auto-config
+		if out, err := exec.Command("networksetup", "-setautoproxystate", svc, "off").CombinedOutput(); err != nil {
+			firstErr = fmt.Errorf("setautoproxystate(off) failed for %q: %w; output: %s", svc, err, strings.TrimSpace(string(out)))
+		}
 		// Disable HTTP proxy
 		if out, err := exec.Command("networksetup", "-setwebproxystate", svc, "off").CombinedOutput(); err != nil {
 			firstErr = fmt.Errorf("setwebproxystate(off) failed for %q: %w; output: %s", svc, err, strings.TrimSpace(string(out)))
@@ -245,25 +641,77 @@ func unsetMacSystemProxy() error {
 	return firstErr
 }
 
+// ownsSystemProxy reports whether ServiceShutdown should revert the system
+// proxy settings; the GUI always does, headless only after ResumeProxy
+func (p *ProxyService) ownsSystemProxy() bool {
+	return !p.Headless || p.systemProxySet.Load()
+}
+
+// IsPaused reports whether the proxy currently lets all traffic through
+func (p *ProxyService) IsPaused() bool {
+	return p.paused.Load()
+}
+
 func (p *ProxyService) PauseProxy() error {
-	if p.IsPaused {
+	if !p.paused.CompareAndSwap(false, true) {
 		return nil
 	}
-	err := unsetMacSystemProxy()
-	if err != nil {
-		return err
+	// System proxy settings are only managed on macOS
+	if runtime.GOOS == "darwin" {
+		if err := unsetMacSystemProxy(); err != nil {
+			p.paused.Store(false)
+			return err
+		}
+		p.systemProxySet.Store(false)
 	}
-	p.IsPaused = true
+	p.notifyPauseChanged()
 	return nil
 }
 
 func (p *ProxyService) ResumeProxy() error {
-	if !p.IsPaused {
+	if !p.paused.CompareAndSwap(true, false) {
 		return nil
 	}
-	if err := setMacSystemProxy(PROXY_PORT); err != nil {
+	if err := p.applySystemProxy(); err != nil {
+		p.paused.Store(true)
 		return err
 	}
-	p.IsPaused = false
+	p.notifyPauseChanged()
 	return nil
 }
+
+// applySystemProxy points the system at the proxy, or at proxy.pac when UsePAC is set.
+// System proxy settings are only managed on macOS.
+func (p *ProxyService) applySystemProxy() error {
+	if runtime.GOOS != "darwin" {
+		return nil
+	}
+	var err error
+	if p.UsePAC {
+		err = setMacAutoProxy(p.PACURL())
+	} else {
+		err = setMacSystemProxy(PROXY_PORT)
+	}
+	if err == nil {
+		p.systemProxySet.Store(true)
+	}
+	return err
+}
+
+// OnPauseChanged registers fn to be called after the proxy is paused or resumed,
+// e.g. to keep the tray menu in sync when the state changes from elsewhere.
+func (p *ProxyService) OnPauseChanged(fn func(paused bool)) {
+	p.pauseMu.Lock()
+	defer p.pauseMu.Unlock()
+	p.pauseListeners = append(p.pauseListeners, fn)
+}
+
+func (p *ProxyService) notifyPauseChanged() {
+	p.pauseMu.Lock()
+	listeners := append([]func(bool){}, p.pauseListeners...)
+	p.pauseMu.Unlock()
+
+	for _, fn := range listeners {
+		fn(p.IsPaused())
+	}
+}
@@ -0,0 +1,208 @@
+package proxy_service
+
+import (
+	"changeme/db_service"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestPauseProxy_ConcurrentWithConnections(t *testing.T) {
+	proxy := setupTestProxy(t)
+	proxy.paused.Store(true)
+
+	// Run with -race: connections read the state while the tray flips it
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				proxy.allowConnect("example.com", 443, "CONNECT", processInfo{}, "")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				_ = proxy.ResumeProxy()
+				_ = proxy.PauseProxy()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if !proxy.IsPaused() {
+		t.Fatal("expected the proxy to end paused")
+	}
+}
+
+func TestServiceShutdown_HeadlessKeepsSystemProxy(t *testing.T) {
+	gui := &ProxyService{}
+	if !gui.ownsSystemProxy() {
+		t.Fatal("The GUI should always revert the system proxy on shutdown")
+	}
+
+	headless := &ProxyService{Headless: true}
+	if headless.ownsSystemProxy() {
+		t.Fatal("Headless mode should leave system proxy settings it never applied")
+	}
+	headless.systemProxySet.Store(true)
+	if !headless.ownsSystemProxy() {
+		t.Fatal("Headless mode should revert settings applied by ResumeProxy")
+	}
+}
+
+func TestAllowConnect_LogOnlyRule(t *testing.T) {
+	proxy := setupTestProxy(t)
+	proxy.DbService.SaveRule(db_service.BlockedDomainInfo{Domain: "*.ads.test", FilterType: "glob", Action: db_service.ActionLog})
+	wouldRejectBefore := connectRequests.Value("CONNECT", "would_reject")
+
+	tun := proxy.allowConnect("tracker.ads.test", 443, "CONNECT", processInfo{}, "")
+	if tun == nil {
+		t.Fatal("log-only rules must not block")
+	}
+	if got := connectRequests.Value("CONNECT", "would_reject") - wouldRejectBefore; got != 1 {
+		t.Fatalf("expected 1 would_reject request in metrics, got %d", got)
+	}
+	if entry := tun.logEntry(); !entry.Approved || !entry.WouldReject || entry.Rule != "*.ads.test" {
+		t.Fatalf("unexpected entry: %+v", entry)
+	}
+
+	// The policy still decides hosts a log-only rule matched
+	proxy.DbService.SetPolicy(db_service.Policy{DefaultAction: db_service.ActionBlock, AllowedPorts: "1-65535"})
+	if proxy.allowConnect("tracker.ads.test", 443, "CONNECT", processInfo{}, "") != nil {
+		t.Fatal("log-only rules must not bypass default-deny")
+	}
+	proxy.DbService.SaveRule(db_service.BlockedDomainInfo{Domain: "tracker.ads.test", Action: db_service.ActionAllow})
+	tun = proxy.allowConnect("tracker.ads.test", 443, "CONNECT", processInfo{}, "")
+	if tun == nil {
+		t.Fatal("expected the allow rule to let the host pass")
+	}
+	if entry := tun.logEntry(); !entry.WouldReject || entry.Rule != "*.ads.test" {
+		t.Fatalf("expected the tunnel to stay marked by the log-only rule, got %+v", entry)
+	}
+}
+
+func TestSplitHostPort(t *testing.T) {
+	tests := []struct {
+		in   string
+		host string
+		port int
+		ok   bool
+	}{
+		{"example.com:8443", "example.com", 8443, true},
+		{"example.com", "example.com", 443, true},
+		{"1.2.3.4:80", "1.2.3.4", 80, true},
+		{"[::1]:443", "::1", 443, true},
+		{"[2001:db8::1]", "2001:db8::1", 443, true},
+		{"2001:db8::1", "2001:db8::1", 443, true},
+		{"example.com:http", "", 0, false},
+		{"example.com:70000", "", 0, false},
+		{":443", "", 0, false},
+		{"", "", 0, false},
+	}
+	for _, tt := range tests {
+		host, port, err := splitHostPort(tt.in, 443)
+		if (err == nil) != tt.ok || host != tt.host || port != tt.port {
+			t.Errorf("splitHostPort(%q) = %q, %d, %v", tt.in, host, port, err)
+		}
+	}
+}
+
+func TestAllowConnect_IPRules(t *testing.T) {
+	proxy := setupTestProxy(t)
+	proxy.DbService.BlockDomainWithType("::1", "ip")
+	proxy.DbService.BlockDomainWithType("127.0.0.0/8", "cidr")
+
+	if proxy.allowConnect("::1", 443, "CONNECT", processInfo{}, "") != nil {
+		t.Fatal("expected the IPv6 literal to be blocked")
+	}
+	if proxy.allowConnect("127.0.0.2", 443, "CONNECT", processInfo{}, "") != nil {
+		t.Fatal("expected the address in the range to be blocked")
+	}
+
+	// Hostnames only match through their addresses when the policy enables it
+	if proxy.allowConnect("localhost", 443, "CONNECT", processInfo{}, "") == nil {
+		t.Fatal("hostnames should not be resolved by default")
+	}
+	proxy.DbService.SetPolicy(db_service.Policy{DefaultAction: db_service.ActionAllow, MatchResolvedIPs: true, AllowedPorts: "1-65535"})
+	if proxy.allowConnect("localhost", 443, "CONNECT", processInfo{}, "") != nil {
+		t.Fatal("expected localhost to be blocked by its resolved address")
+	}
+}
+
+func TestAllowConnect_Ports(t *testing.T) {
+	proxy := setupTestProxy(t)
+	proxy.DbService.SetPolicy(db_service.Policy{DefaultAction: db_service.ActionAllow})
+	proxy.DbService.SaveRule(db_service.BlockedDomainInfo{Domain: "mail.test", Ports: "25,465-587"})
+	proxy.DbService.SaveRule(db_service.BlockedDomainInfo{Domain: "git.test", Action: db_service.ActionAllow, Ports: "22"})
+
+	for _, tt := range []struct {
+		host    string
+		port    int
+		allowed bool
+	}{
+		{"example.test", 443, true},
+		{"example.test", 22, false}, // not in the default allowed ports
+		{"git.test", 22, true},      // named by an allow rule
+		{"git.test", 2222, false},
+		{"mail.test", 443, true},
+		{"mail.test", 25, false},
+	} {
+		if got := proxy.allowConnect(tt.host, tt.port, "CONNECT", processInfo{}, "") != nil; got != tt.allowed {
+			t.Errorf("allowConnect(%s:%d) = %v, want %v", tt.host, tt.port, got, tt.allowed)
+		}
+	}
+}
+
+func TestAllowConnect_DefaultPortsOnlyApplyToHTTP(t *testing.T) {
+	proxy := setupTestProxy(t)
+	proxy.DbService.SetPolicy(db_service.DefaultPolicy)
+
+	if proxy.allowConnect("git.example.com", 22, socksMethod, processInfo{}, "") == nil {
+		t.Fatal("expected SOCKS5 to reach port 22 without configured ports")
+	}
+	if proxy.allowConnect("git.example.com", 22, "CONNECT", processInfo{}, "") != nil {
+		t.Fatal("expected CONNECT to port 22 to be refused by the default ports")
+	}
+
+	proxy.DbService.SetPolicy(db_service.Policy{DefaultAction: db_service.ActionAllow, AllowedPorts: "443"})
+	if proxy.allowConnect("git.example.com", 22, socksMethod, processInfo{}, "") != nil {
+		t.Fatal("expected configured ports to restrict SOCKS5")
+	}
+}
+
+// Helper function to set up a proxy with an isolated database
+func setupTestProxy(t *testing.T) *ProxyService {
+	db, err := db_service.NewDBService(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create test db: %v", err)
+	}
+	t.Cleanup(func() { db.ServiceShutdown() })
+	// Test servers listen on random ports
+	db.SetPolicy(db_service.Policy{DefaultAction: db_service.ActionAllow, AllowedPorts: "1-65535"})
+	// An empty procfs keeps the test process from being attributed
+	return &ProxyService{DbService: db, procRoot: t.TempDir()}
+}
+
+func startEchoServer(t *testing.T) *net.TCPAddr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr)
+}
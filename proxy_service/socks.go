@@ -0,0 +1,330 @@
+package proxy_service
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const SOCKS_PORT = 30003
+
+// socksMethod is the method SOCKS5 tunnels are logged with
+const socksMethod = "SOCKS5"
+
+// SOCKS5 protocol constants (RFC 1928)
+const (
+	socksVersion = 0x05
+
+	socksAuthNone         = 0x00
+	socksAuthPassword     = 0x02
+	socksAuthNoAcceptable = 0xff
+
+	// Username/password authentication (RFC 1929)
+	socksAuthPasswordVersion = 0x01
+	socksAuthSucceeded       = 0x00
+	socksAuthFailed          = 0x01
+
+	socksCmdConnect = 0x01
+
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+
+	socksReplySucceeded          = 0x00
+	socksReplyGeneralFailure     = 0x01
+	socksReplyNotAllowed         = 0x02
+	socksReplyNetworkUnreachable = 0x03
+	socksReplyHostUnreachable    = 0x04
+	socksReplyConnectionRefused  = 0x05
+	socksReplyCmdNotSupported    = 0x07
+	socksReplyAddrNotSupported   = 0x08
+)
+
+// socksDialTimeout bounds how long we wait for the upstream connection
+const socksDialTimeout = 10 * time.Second
+
+// StartSocks binds the SOCKS5 listener on SocksAddr and serves it in the background.
+func (p *ProxyService) StartSocks() error {
+	addr := p.SocksAddr
+	if addr == "" {
+		addr = fmt.Sprintf("127.0.0.1:%d", SOCKS_PORT)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	p.socksListener = ln
+	log.Printf("SOCKS5 proxy listening on %s", ln.Addr())
+	go p.serveSocks(ln)
+	return nil
+}
+
+// serveSocks accepts SOCKS5 clients until the listener is closed
+func (p *ProxyService) serveSocks(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("SOCKS5 accept error: %v", err)
+			continue
+		}
+		go p.handleSocksConn(conn)
+	}
+}
+
+// handleSocksConn negotiates a single SOCKS5 session and, when the policy
+// allows it, tunnels the client to the requested destination. Hostnames are
+// resolved on the proxy side so clients never leak DNS lookups.
+func (p *ProxyService) handleSocksConn(conn net.Conn) {
+	defer conn.Close()
+
+	settings := p.GetAccessSettings()
+	if !clientAllowed(conn.RemoteAddr(), settings) {
+		log.Printf("Refused SOCKS5 client %s: address not allowed", conn.RemoteAddr())
+		clientRejections.Inc("address")
+		return
+	}
+
+	user, err := p.socksNegotiate(conn, settings.RequireAuth)
+	if err != nil {
+		log.Printf("SOCKS5 handshake failed: %v", err)
+		return
+	}
+
+	host, port, reply, err := socksReadRequest(conn)
+	if err != nil {
+		log.Printf("SOCKS5 request failed: %v", err)
+		if reply != socksReplySucceeded {
+			_ = socksWriteReply(conn, reply, nil)
+		}
+		return
+	}
+
+	t := p.allowConnect(host, port, socksMethod, p.lookupProcess(conn.RemoteAddr(), conn.LocalAddr()), user)
+	if t == nil {
+		_ = socksWriteReply(conn, socksReplyNotAllowed, nil)
+		return
+	}
+
+	upstream, err := t.dial(p.guardFor(conn.RemoteAddr()).dialer(socksDialTimeout).Dial)
+	if err != nil {
+		_ = socksWriteReply(conn, socksDialErrorReply(err), nil)
+		p.finishTunnel(t)
+		return
+	}
+
+	if err := socksWriteReply(conn, socksReplySucceeded, upstream.LocalAddr()); err != nil {
+		_ = upstream.Close()
+		p.finishTunnel(t)
+		return
+	}
+
+	p.relay(t, conn, upstream)
+}
+
+// socksNegotiate reads the client greeting and selects the "no
+// authentication" method, or username/password when requireAuth is set.
+// It returns the authenticated user.
+func (p *ProxyService) socksNegotiate(conn net.Conn, requireAuth bool) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	want := byte(socksAuthNone)
+	if requireAuth {
+		want = socksAuthPassword
+	}
+	for _, m := range methods {
+		if m != want {
+			continue
+		}
+		if _, err := conn.Write([]byte{socksVersion, want}); err != nil {
+			return "", err
+		}
+		if !requireAuth {
+			return "", nil
+		}
+		return p.socksAuthenticate(conn)
+	}
+	_, _ = conn.Write([]byte{socksVersion, socksAuthNoAcceptable})
+	if requireAuth {
+		clientRejections.Inc("auth")
+	}
+	return "", fmt.Errorf("no acceptable authentication method")
+}
+
+// socksAuthenticate runs the username/password subnegotiation and checks
+// the credentials against the proxy users
+func (p *ProxyService) socksAuthenticate(conn net.Conn) (string, error) {
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return "", err
+	}
+	if version[0] != socksAuthPasswordVersion {
+		return "", fmt.Errorf("unsupported authentication version %d", version[0])
+	}
+	user, err := socksReadString(conn)
+	if err != nil {
+		return "", err
+	}
+	password, err := socksReadString(conn)
+	if err != nil {
+		return "", err
+	}
+	if ok, limited := p.checkCredentials(conn.RemoteAddr().String(), user, password); !ok {
+		_, _ = conn.Write([]byte{socksAuthPasswordVersion, socksAuthFailed})
+		if limited {
+			return "", fmt.Errorf("too many failed logins")
+		}
+		return "", fmt.Errorf("invalid credentials for %q", user)
+	}
+	if _, err := conn.Write([]byte{socksAuthPasswordVersion, socksAuthSucceeded}); err != nil {
+		return "", err
+	}
+	return user, nil
+}
+
+// socksReadString reads a length-prefixed string
+func socksReadString(conn net.Conn) (string, error) {
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return "", err
+	}
+	value := make([]byte, length[0])
+	if _, err := io.ReadFull(conn, value); err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// socksReadRequest parses a SOCKS5 request and returns the destination. On
+// failure, reply holds the code that should be sent back to the client.
+func socksReadRequest(conn net.Conn) (host string, port int, reply byte, err error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", 0, socksReplySucceeded, err
+	}
+	if header[0] != socksVersion {
+		return "", 0, socksReplyGeneralFailure, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	if header[1] != socksCmdConnect {
+		return "", 0, socksReplyCmdNotSupported, fmt.Errorf("unsupported command %d", header[1])
+	}
+
+	switch header[3] {
+	case socksAddrIPv4:
+		addr := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return "", 0, socksReplySucceeded, err
+		}
+		host = net.IP(addr).String()
+	case socksAddrIPv6:
+		addr := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return "", 0, socksReplySucceeded, err
+		}
+		host = net.IP(addr).String()
+	case socksAddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", 0, socksReplySucceeded, err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", 0, socksReplySucceeded, err
+		}
+		host = string(name)
+	default:
+		return "", 0, socksReplyAddrNotSupported, fmt.Errorf("unsupported address type %d", header[3])
+	}
+
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(conn, portBytes); err != nil {
+		return "", 0, socksReplySucceeded, err
+	}
+	return host, int(binary.BigEndian.Uint16(portBytes)), socksReplySucceeded, nil
+}
+
+// socksWriteReply sends a SOCKS5 reply with the given bound address
+func socksWriteReply(conn net.Conn, reply byte, bound net.Addr) error {
+	ip := net.IPv4zero.To4()
+	port := 0
+	if tcpAddr, ok := bound.(*net.TCPAddr); ok {
+		ip = tcpAddr.IP
+		port = tcpAddr.Port
+	}
+
+	msg := []byte{socksVersion, reply, 0x00}
+	if ip4 := ip.To4(); ip4 != nil {
+		msg = append(msg, socksAddrIPv4)
+		msg = append(msg, ip4...)
+	} else {
+		msg = append(msg, socksAddrIPv6)
+		msg = append(msg, ip.To16()...)
+	}
+	msg = binary.BigEndian.AppendUint16(msg, uint16(port))
+
+	_, err := conn.Write(msg)
+	return err
+}
+
+// socksDialErrorReply maps a dial error to the closest SOCKS5 reply code
+func socksDialErrorReply(err error) byte {
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, errPrivateNetwork):
+		return socksReplyNotAllowed
+	case errors.As(err, &dnsErr):
+		return socksReplyHostUnreachable
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksReplyConnectionRefused
+	case errors.As(err, &opErr) && opErr.Timeout():
+		return socksReplyHostUnreachable
+	case errors.As(err, &opErr):
+		return socksReplyNetworkUnreachable
+	default:
+		return socksReplyGeneralFailure
+	}
+}
+
+// pipe copies data in both directions until either side closes
+func pipe(client, upstream net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(upstream, client)
+		closeWrite(upstream)
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(client, upstream)
+		closeWrite(client)
+	}()
+	wg.Wait()
+}
+
+// closeWrite half-closes TCP connections so the peer sees EOF
+func closeWrite(conn net.Conn) {
+	if hc, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = hc.CloseWrite()
+		return
+	}
+	_ = conn.Close()
+}
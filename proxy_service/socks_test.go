@@ -0,0 +1,155 @@
+package proxy_service
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestSocks_ConnectAllowed(t *testing.T) {
+	proxy := setupTestProxy(t)
+	echoAddr := startEchoServer(t)
+	socksAddr := startTestSocks(t, proxy)
+	approvedBefore := connectRequests.Value("SOCKS5", "approved")
+	upBefore := tunnelBytes.Value("up")
+
+	conn := socksDial(t, socksAddr, "localhost", echoAddr.Port)
+	defer conn.Close()
+
+	reply := readSocksReply(t, conn)
+	if reply != socksReplySucceeded {
+		t.Fatalf("expected success reply, got %d", reply)
+	}
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("expected echo %q, got %q", "ping", buf)
+	}
+	if got := connectRequests.Value("SOCKS5", "approved") - approvedBefore; got != 1 {
+		t.Fatalf("expected 1 approved SOCKS5 request in metrics, got %d", got)
+	}
+	if got := tunnelBytes.Value("up") - upBefore; got != 4 {
+		t.Fatalf("expected 4 bytes up in metrics, got %d", got)
+	}
+}
+
+func TestSocks_ConnectBlocked(t *testing.T) {
+	proxy := setupTestProxy(t)
+	proxy.DbService.BlockDomain("blocked.test")
+	socksAddr := startTestSocks(t, proxy)
+	matchesBefore := ruleMatches.Value("exact")
+
+	conn := socksDial(t, socksAddr, "BLOCKED.test", 443)
+	defer conn.Close()
+
+	if reply := readSocksReply(t, conn); reply != socksReplyNotAllowed {
+		t.Fatalf("expected not-allowed reply, got %d", reply)
+	}
+	if got := ruleMatches.Value("exact") - matchesBefore; got != 1 {
+		t.Fatalf("expected 1 exact rule match in metrics, got %d", got)
+	}
+}
+
+func TestSocks_StartBindsBeforeReturning(t *testing.T) {
+	proxy := setupTestProxy(t)
+	proxy.SocksAddr = "127.0.0.1:0"
+	if err := proxy.StartSocks(); err != nil {
+		t.Fatalf("StartSocks failed: %v", err)
+	}
+	defer proxy.socksListener.Close()
+
+	// The listener is set by the time StartSocks returns and already serves
+	conn, err := net.Dial("tcp", proxy.socksListener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	socksGreet(t, conn)
+}
+
+func TestSocks_UnsupportedCommand(t *testing.T) {
+	proxy := setupTestProxy(t)
+	socksAddr := startTestSocks(t, proxy)
+
+	conn, err := net.Dial("tcp", socksAddr)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	socksGreet(t, conn)
+
+	// BIND request
+	req := []byte{socksVersion, 0x02, 0x00, socksAddrIPv4, 127, 0, 0, 1, 0, 80}
+	if _, err := conn.Write(req); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if reply := readSocksReply(t, conn); reply != socksReplyCmdNotSupported {
+		t.Fatalf("expected command-not-supported reply, got %d", reply)
+	}
+}
+
+func startTestSocks(t *testing.T, p *ProxyService) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go p.serveSocks(ln)
+	return ln.Addr().String()
+}
+
+func socksGreet(t *testing.T, conn net.Conn) {
+	if _, err := conn.Write([]byte{socksVersion, 1, socksAuthNone}); err != nil {
+		t.Fatalf("greeting failed: %v", err)
+	}
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatalf("reading method selection failed: %v", err)
+	}
+	if resp[1] != socksAuthNone {
+		t.Fatalf("expected no-auth method, got %d", resp[1])
+	}
+}
+
+func socksDial(t *testing.T, socksAddr, host string, port int) net.Conn {
+	conn, err := net.Dial("tcp", socksAddr)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	socksConnect(t, conn, host, port)
+	return conn
+}
+
+func socksConnect(t *testing.T, conn net.Conn, host string, port int) {
+	socksGreet(t, conn)
+
+	req := []byte{socksVersion, socksCmdConnect, 0x00, socksAddrDomain, byte(len(host))}
+	req = append(req, host...)
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		t.Fatalf("write request failed: %v", err)
+	}
+}
+
+func readSocksReply(t *testing.T, conn net.Conn) byte {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("reading reply failed: %v", err)
+	}
+	addrLen := net.IPv4len
+	if header[3] == socksAddrIPv6 {
+		addrLen = net.IPv6len
+	}
+	rest := make([]byte, addrLen+2)
+	if _, err := io.ReadFull(conn, rest); err != nil {
+		t.Fatalf("reading reply address failed: %v", err)
+	}
+	return header[1]
+}
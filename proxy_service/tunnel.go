@@ -0,0 +1,182 @@
+package proxy_service
+
+import (
+	"changeme/logging_service"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tunnelDialTimeout bounds how long we wait for the upstream connection
+const tunnelDialTimeout = 10 * time.Second
+
+// resolveTimeout bounds the lookup of a hostname for ip and cidr rules
+const resolveTimeout = 2 * time.Second
+
+// tunnel follows one approved CONNECT or SOCKS5 session from the policy
+// decision until both sides have closed, so it can be logged with its real
+// lifetime and traffic.
+type tunnel struct {
+	host   string
+	port   int
+	method string
+	rule   string
+
+	process processInfo
+	user    string // authenticated proxy user, if any
+
+	// wouldReject is set when a log-only rule matched; the tunnel is allowed
+	wouldReject bool
+	// refused is the reason the dial was refused after the rules allowed
+	// the tunnel; it is then logged as rejected
+	refused string
+
+	start    time.Time     // when the request arrived
+	decision time.Duration // time spent evaluating the rules
+	dialTime time.Duration // time to connect to the upstream
+
+	dialed    time.Time
+	firstByte atomic.Int64 // ns from dialed to the first upstream byte, 0 until then
+	up, down  atomic.Int64
+
+	// logged is false while the proxy is paused; such tunnels are only relayed
+	logged bool
+}
+
+// dial connects to the tunnel's destination through dialer (nil for a direct connection)
+func (t *tunnel) dial(dialer func(network, addr string) (net.Conn, error)) (net.Conn, error) {
+	if dialer == nil {
+		dialer = (&net.Dialer{Timeout: tunnelDialTimeout}).Dial
+	}
+	start := time.Now()
+	conn, err := dialer("tcp", net.JoinHostPort(t.host, strconv.Itoa(t.port)))
+	t.dialed = time.Now()
+	t.dialTime = t.dialed.Sub(start)
+	if errors.Is(err, errPrivateNetwork) {
+		log.Printf("%s request for host: %s, port: %d, refused: %v", t.method, t.host, t.port, err)
+		privateNetworkBlocks.Inc(t.method)
+		t.refused = logging_service.ReasonPrivateNetwork
+	}
+	if err != nil {
+		return nil, err
+	}
+	activeTunnels.Inc()
+	return &trackedConn{Conn: conn, tunnel: t}, nil
+}
+
+// logEntry describes the finished tunnel for the request log
+func (t *tunnel) logEntry() logging_service.LogRequest {
+	entry := logging_service.LogRequest{
+		Timestamp:         t.start.UnixMilli(),
+		Host:              t.host,
+		Method:            t.method,
+		Port:              t.port,
+		Approved:          true,
+		Duration:          t.decision.Nanoseconds(),
+		Rule:              t.rule,
+		WouldReject:       t.wouldReject,
+		DialDuration:      t.dialTime.Nanoseconds(),
+		FirstByteDuration: t.firstByte.Load(),
+		OpenDuration:      time.Since(t.start).Nanoseconds(),
+		BytesUp:           t.up.Load(),
+		BytesDown:         t.down.Load(),
+		ProcessName:       t.process.Name,
+		ProcessPath:       t.process.Path,
+		User:              t.user,
+	}
+	if t.wouldReject {
+		entry.Reason = logging_service.ReasonRule
+	}
+	if t.refused != "" {
+		entry.Approved = false
+		entry.WouldReject = false
+		entry.Reason = t.refused
+	}
+	return entry
+}
+
+// relay pipes client and upstream until both directions are done and then
+// logs the tunnel. The tunnel is listed as an active connection meanwhile.
+// It closes both connections.
+func (p *ProxyService) relay(t *tunnel, client, upstream net.Conn) {
+	untrack := p.track(&activeConn{
+		host:       t.host,
+		port:       t.port,
+		method:     t.method,
+		clientAddr: client.RemoteAddr().String(),
+		process:    t.process,
+		user:       t.user,
+		start:      t.start,
+		up:         &t.up,
+		down:       &t.down,
+		close: func() {
+			_ = upstream.Close()
+			_ = client.Close()
+		},
+	})
+	pipe(client, upstream)
+	untrack()
+	_ = upstream.Close()
+	_ = client.Close()
+	p.finishTunnel(t)
+}
+
+// finishTunnel logs a tunnel once it is over, including failed dials
+func (p *ProxyService) finishTunnel(t *tunnel) {
+	if t.logged {
+		p.logger().LogEntry(t.logEntry())
+	}
+}
+
+// trackedConn counts bytes on an upstream tunnel connection. Reads are bytes
+// flowing down to the client, writes are bytes flowing up.
+type trackedConn struct {
+	net.Conn
+	tunnel    *tunnel
+	closeOnce sync.Once
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		tunnelBytes.Add(uint64(n), "down")
+		if c.tunnel.down.Add(int64(n)) == int64(n) {
+			c.tunnel.firstByte.Store(time.Since(c.tunnel.dialed).Nanoseconds())
+		}
+	}
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		tunnelBytes.Add(uint64(n), "up")
+		c.tunnel.up.Add(int64(n))
+	}
+	return n, err
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(activeTunnels.Dec)
+	return c.Conn.Close()
+}
+
+// CloseWrite and CloseRead keep half-close working so pipe can shut down
+// each direction independently.
+func (c *trackedConn) CloseWrite() error {
+	if hc, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
+
+func (c *trackedConn) CloseRead() error {
+	if hc, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return hc.CloseRead()
+	}
+	return nil
+}
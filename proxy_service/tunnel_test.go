@@ -0,0 +1,39 @@
+package proxy_service
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestTunnel_MeasuresTraffic(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	tun := &tunnel{host: "127.0.0.1", port: echoAddr.Port, method: "SOCKS5", start: time.Now(), logged: true}
+
+	conn, err := tun.dial(nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	conn.Close()
+
+	entry := tun.logEntry()
+	if entry.BytesUp != 5 || entry.BytesDown != 5 {
+		t.Fatalf("expected 5 bytes each way, got up %d down %d", entry.BytesUp, entry.BytesDown)
+	}
+	if entry.DialDuration <= 0 || entry.FirstByteDuration <= 0 {
+		t.Fatalf("expected dial and first byte durations, got %+v", entry)
+	}
+	if entry.OpenDuration < entry.DialDuration+entry.FirstByteDuration {
+		t.Fatalf("open duration %d shorter than dial plus first byte", entry.OpenDuration)
+	}
+	if !entry.Approved || entry.Timestamp != tun.start.UnixMilli() {
+		t.Fatalf("unexpected entry: %+v", entry)
+	}
+}